@@ -0,0 +1,341 @@
+// api.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRequestBodyBytes максимальный размер тела JSON запроса
+const maxRequestBodyBytes = 1 << 20
+
+// APIError структурированная ошибка JSON API
+type APIError struct {
+	Code    string `json:"code"`    // Машиночитаемый код ошибки
+	Message string `json:"message"` // Описание ошибки
+}
+
+// ErrorResponse тело ответа с ошибкой
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// Коды ошибок API
+const (
+	ErrorCodeBadRequest            = "bad_request"                 // Некорректный запрос (формат, параметры)
+	ErrorCodeValidation            = "validation_error"            // Данные команды не прошли проверку
+	ErrorCodeNotFound              = "not_found"                   // Объект не найден
+	ErrorCodeInvalidTransition     = "invalid_transition"          // Команда недопустима в текущем статусе заказа
+	ErrorCodeConflict              = "concurrency_conflict"        // Конфликт версий потока заказа
+	ErrorCodeUnauthorized          = "unauthorized"                // Инициатор команды не указан
+	ErrorCodeForbidden             = "forbidden"                   // У инициатора нет прав на команду
+	ErrorCodeRebuildInProgress     = "rebuild_in_progress"         // Перестроение проекции уже выполняется
+	ErrorCodeIdempotencyMismatch   = "idempotency_key_reused"      // Ключ идемпотентности использован для другого запроса
+	ErrorCodeIdempotencyInProgress = "idempotency_key_in_progress" // Запрос с этим ключом еще выполняется
+	ErrorCodeUnavailable           = "unavailable"                 // Операция недоступна (например, при остановке)
+	ErrorCodeInternal              = "internal_error"              // Внутренняя ошибка сервера
+)
+
+// OrderItemRequest позиция заказа в JSON запросе
+type OrderItemRequest struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"` // По умолчанию 1
+}
+
+// CreateOrderRequest тело запроса POST /orders
+type CreateOrderRequest struct {
+	CustomerID string             `json:"customer_id"`
+	Items      []OrderItemRequest `json:"items"`
+}
+
+// OrderCommandRequest тело запроса команды над существующим заказом
+type OrderCommandRequest struct {
+	Reason         string `json:"reason,omitempty"`          // Причина отмены или возврата
+	TrackingNumber string `json:"tracking_number,omitempty"` // Трек-номер отправления
+}
+
+// CommandResponse ответ на успешную команду
+type CommandResponse struct {
+	OrderID OrderID `json:"order_id"`
+	Status  string  `json:"status"`  // Статус заказа после команды
+	Message string  `json:"message"` // Описание результата
+}
+
+// OrderItemView позиция заказа в JSON ответе
+type OrderItemView struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+// OrderView заказ в JSON ответе
+type OrderView struct {
+	ID             OrderID         `json:"id"`
+	CustomerID     string          `json:"customer_id"`
+	Status         string          `json:"status"`
+	Items          []OrderItemView `json:"items"`
+	TrackingNumber string          `json:"tracking_number,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// newOrderView преобразует состояние заказа в JSON представление
+func newOrderView(order *OrderState) OrderView {
+	view := OrderView{
+		ID:             order.ID,
+		CustomerID:     order.CustomerID,
+		Status:         order.Status,
+		Items:          make([]OrderItemView, 0, len(order.Items)),
+		TrackingNumber: order.TrackingNumber,
+		CreatedAt:      order.CreateTime,
+		UpdatedAt:      order.UpdateTime,
+	}
+	for _, item := range order.Items {
+		view.Items = append(view.Items, OrderItemView{Name: item.Name, Quantity: item.Quantity})
+	}
+	return view
+}
+
+// isJSONRequest проверяет, передано ли тело запроса в формате JSON
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// wantsJSON определяет формат ответа: параметр format=json|text, затем заголовок Accept.
+// Если клиент принимает любой формат (curl по умолчанию), отвечаем в формате запроса,
+// а для запросов без JSON тела - текстом, как раньше.
+func wantsJSON(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return true
+	case "text":
+		return false
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") {
+		return true
+	}
+	if strings.Contains(accept, "text/plain") {
+		return false
+	}
+	return isJSONRequest(r)
+}
+
+// writeJSON отправляет ответ в формате JSON
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeJSONError отправляет ошибку в формате JSON (для эндпоинтов, отвечающих только JSON)
+func writeJSONError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, ErrorResponse{Error: APIError{Code: code, Message: message}})
+}
+
+// writeError отправляет ошибку в формате, который ожидает клиент
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	if wantsJSON(r) {
+		writeJSONError(w, status, code, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// commandErrorStatus возвращает HTTP статус и код ошибки обработки команды
+func commandErrorStatus(err error) (int, string) {
+	var validation *ValidationError
+	var transition *TransitionError
+	var forbidden *ForbiddenError
+	switch {
+	case errors.As(err, &validation):
+		return http.StatusBadRequest, ErrorCodeValidation
+	case errors.Is(err, ErrUnknownCommand):
+		return http.StatusBadRequest, ErrorCodeBadRequest
+	case errors.As(err, &forbidden) && forbidden.ActorID == "":
+		return http.StatusUnauthorized, ErrorCodeUnauthorized
+	case errors.As(err, &forbidden):
+		return http.StatusForbidden, ErrorCodeForbidden
+	case errors.Is(err, ErrOrderNotFound):
+		return http.StatusNotFound, ErrorCodeNotFound
+	case errors.As(err, &transition):
+		return http.StatusConflict, ErrorCodeInvalidTransition
+	case IsConcurrencyError(err):
+		return http.StatusConflict, ErrorCodeConflict
+	}
+	return http.StatusInternalServerError, ErrorCodeInternal
+}
+
+// writeCommandError отправляет ошибку обработки команды
+func writeCommandError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := commandErrorStatus(err)
+	writeError(w, r, status, code, err.Error())
+}
+
+// writeCommandResult отправляет результат успешной команды: JSON или текстовое сообщение
+func writeCommandResult(w http.ResponseWriter, r *http.Request, status int, result CommandResponse, text string) {
+	if wantsJSON(r) {
+		writeJSON(w, status, result)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, text)
+}
+
+// decodeJSONBody разбирает JSON тело запроса; пустое тело допустимо
+func decodeJSONBody(r *http.Request, w http.ResponseWriter, dst any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dst); err != nil && err != io.EOF {
+		return fmt.Errorf("некорректное тело запроса: %v", err)
+	}
+	return nil
+}
+
+// parseOrderID разбирает ID заказа из URL
+func parseOrderID(r *http.Request) (OrderID, error) {
+	id, err := ParseOrderID(mux.Vars(r)["id"])
+	if err != nil {
+		return "", errors.New("Некорректный ID")
+	}
+	return id, nil
+}
+
+// parseCreateOrderRequest разбирает запрос создания заказа из JSON тела или формы.
+// В форме позиции передаются повторяющимися параметрами item и quantity.
+func parseCreateOrderRequest(w http.ResponseWriter, r *http.Request) (CreateOrderCommand, error) {
+	var request CreateOrderRequest
+	if isJSONRequest(r) {
+		if err := decodeJSONBody(r, w, &request); err != nil {
+			return CreateOrderCommand{}, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return CreateOrderCommand{}, err
+		}
+		request.CustomerID = r.Form.Get("customer_id")
+		quantities := r.Form["quantity"]
+		for i, name := range r.Form["item"] {
+			item := OrderItemRequest{Name: name}
+			// Количество товара необязательно, по умолчанию 1
+			if i < len(quantities) && quantities[i] != "" {
+				quantity, err := strconv.Atoi(quantities[i])
+				if err != nil {
+					return CreateOrderCommand{}, errors.New("Некорректное количество")
+				}
+				item.Quantity = quantity
+			}
+			request.Items = append(request.Items, item)
+		}
+	}
+
+	command := CreateOrderCommand{CustomerID: request.CustomerID}
+	for _, item := range request.Items {
+		if item.Quantity == 0 {
+			item.Quantity = 1
+		}
+		command.Items = append(command.Items, OrderItem{Name: item.Name, Quantity: item.Quantity})
+	}
+	return command, nil
+}
+
+// parseOrderCommandRequest разбирает параметры команды над заказом из JSON тела или формы
+func parseOrderCommandRequest(w http.ResponseWriter, r *http.Request) (OrderCommandRequest, error) {
+	var request OrderCommandRequest
+	if isJSONRequest(r) {
+		err := decodeJSONBody(r, w, &request)
+		return request, err
+	}
+
+	request.Reason = r.FormValue("reason")
+	request.TrackingNumber = r.FormValue("tracking_number")
+	return request, nil
+}
+
+// serveOrderCommand разбирает запрос команды над заказом, собирает команду через build,
+// отправляет ее через шину команд и отвечает статусом заказа после команды или ошибкой
+func serveOrderCommand(w http.ResponseWriter, r *http.Request, bus *CommandBus, message string,
+	build func(orderID OrderID, request OrderCommandRequest) Command) {
+	// Получаем ID заказа из URL
+	id, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	// Получаем параметры команды
+	request, err := parseOrderCommandRequest(w, r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+		return
+	}
+
+	// Отправляем команду через шину
+	result, err := bus.Dispatch(requestContext(r), build(id, request))
+	if err != nil {
+		writeCommandError(w, r, err)
+		return
+	}
+
+	// Возвращаем ответ
+	writeCommandResult(w, r, http.StatusOK, CommandResponse{
+		OrderID: result.OrderID,
+		Status:  result.Status,
+		Message: message,
+	}, message)
+}
+
+// Заголовки с инициатором команды
+const (
+	actorIDHeader    = "X-Actor-ID"    // Идентификатор инициатора
+	actorRolesHeader = "X-Actor-Roles" // Роли инициатора через запятую
+)
+
+// requestContext возвращает контекст запроса с метаданными для записанных событий.
+// Инициатора команды в контекст кладет TrustedProxies.ActorMiddleware.
+func requestContext(r *http.Request) context.Context {
+	return WithEventMetadata(r.Context(), requestEventMetadata(r))
+}
+
+// requireRole пропускает запрос к административному API, только если у инициатора есть роль.
+// Инициатора в контекст кладет TrustedProxies.ActorMiddleware.
+func requireRole(role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			actor := ActorFromContext(r.Context())
+			switch {
+			case actor.ID == "":
+				writeJSONError(w, http.StatusUnauthorized, ErrorCodeUnauthorized,
+					fmt.Sprintf("административный API требует авторизации (роль: %s)", role))
+			case !actor.HasRole(role):
+				writeJSONError(w, http.StatusForbidden, ErrorCodeForbidden,
+					fmt.Sprintf("у %s нет прав на административный API (роль: %s)", actor.ID, role))
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// actorFromHeaders читает инициатора команды из заголовков X-Actor-ID и X-Actor-Roles
+func actorFromHeaders(r *http.Request) Actor {
+	actor := Actor{ID: r.Header.Get(actorIDHeader)}
+	for _, role := range strings.Split(r.Header.Get(actorRolesHeader), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			actor.Roles = append(actor.Roles, role)
+		}
+	}
+	return actor
+}
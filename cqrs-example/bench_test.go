@@ -0,0 +1,95 @@
+// bench_test.go
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchWriters количество параллельных писателей на процессор: групповая запись
+// выигрывает только при одновременных командах
+const benchWriters = 8
+
+// benchFsyncPolicies политики fsync, с которыми сравниваются реализации.
+// Обе реализации в каждом сценарии используют одну и ту же политику.
+var benchFsyncPolicies = []FsyncPolicy{FsyncAlways, FsyncNever}
+
+// BenchmarkEnqueueLegacy исходная запись: открытие, запись и закрытие файла на каждое
+// событие под эксклюзивной блокировкой, с fsync каждой записи для политики always
+func BenchmarkEnqueueLegacy(b *testing.B) {
+	for _, policy := range benchFsyncPolicies {
+		b.Run("fsync="+string(policy), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "event_log.json")
+			var mu sync.Mutex
+
+			benchParallel(b, func(event Event) error {
+				dto, err := eventRegistry.Encode(event)
+				if err != nil {
+					return err
+				}
+				data, err := json.Marshal(dto)
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				if _, err := file.Write(append(data, '\n')); err != nil {
+					return err
+				}
+				if policy == FsyncAlways {
+					return file.Sync()
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// BenchmarkEnqueueGroupCommit запись через очередь, которая объединяет одновременные
+// события в одну запись сегментированного лога с одним fsync
+func BenchmarkEnqueueGroupCommit(b *testing.B) {
+	for _, policy := range benchFsyncPolicies {
+		b.Run("fsync="+string(policy), func(b *testing.B) {
+			queue, err := NewEventQueue(LogConfig{
+				Dir:             b.TempDir(),
+				SegmentMaxBytes: 64 << 20,
+				Fsync:           policy,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer queue.Close()
+
+			benchParallel(b, func(event Event) error {
+				return queue.Append(event, AnyVersion)
+			})
+		})
+	}
+}
+
+// benchParallel вызывает write для b.N событий оплаты разных заказов из параллельных писателей
+func benchParallel(b *testing.B, write func(event Event) error) {
+	var orderID atomic.Int64
+	b.SetParallelism(benchWriters)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			event := OrderPaidEvent{BaseEvent: BaseEvent{OrderID: OrderIDFromInt(int(orderID.Add(1))), Timestamp: time.Now()}}
+			if err := write(event); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
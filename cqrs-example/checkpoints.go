@@ -0,0 +1,188 @@
+// checkpoints.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ProjectionCheckpoint сохраненное состояние проекции и позиция последнего учтенного события
+type ProjectionCheckpoint struct {
+	Name        string          `json:"name"`         // Имя проекции
+	CodeVersion int             `json:"code_version"` // Версия кода проекции
+	Position    int64           `json:"position"`     // Позиция последнего учтенного события
+	State       json.RawMessage `json:"state"`        // Состояние проекции
+	SavedAt     time.Time       `json:"saved_at"`     // Время сохранения
+}
+
+// CheckpointStore хранилище контрольных точек проекций
+type CheckpointStore interface {
+	// Load возвращает контрольную точку проекции или nil, если ее нет
+	Load(name string) (*ProjectionCheckpoint, error)
+	// Save сохраняет контрольную точку проекции
+	Save(checkpoint ProjectionCheckpoint) error
+}
+
+// NewCheckpointStore создает хранилище контрольных точек указанного типа: file, redis или memory
+func NewCheckpointStore(kind string, dir string, redisAddr string) (CheckpointStore, error) {
+	switch kind {
+	case "file":
+		return NewFileCheckpointStore(dir)
+	case "redis":
+		return NewRedisCheckpointStore(redisAddr)
+	case "memory":
+		return NewMemoryCheckpointStore(), nil
+	}
+	return nil, fmt.Errorf("неизвестное хранилище контрольных точек: %q (ожидается file, redis или memory)", kind)
+}
+
+// MemoryCheckpointStore хранит контрольные точки в памяти процесса,
+// например вместе с хранилищем событий memory
+type MemoryCheckpointStore struct {
+	checkpoints map[string]ProjectionCheckpoint
+	mu          sync.Mutex
+}
+
+// NewMemoryCheckpointStore создает хранилище контрольных точек в памяти
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{checkpoints: make(map[string]ProjectionCheckpoint)}
+}
+
+// Load возвращает сохраненную контрольную точку проекции
+func (s *MemoryCheckpointStore) Load(name string) (*ProjectionCheckpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoint, found := s.checkpoints[name]
+	if !found {
+		return nil, nil
+	}
+	return &checkpoint, nil
+}
+
+// Save сохраняет контрольную точку проекции в памяти
+func (s *MemoryCheckpointStore) Save(checkpoint ProjectionCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[checkpoint.Name] = checkpoint
+	return nil
+}
+
+// FileCheckpointStore хранит контрольные точки в JSON файлах, по файлу на проекцию
+type FileCheckpointStore struct {
+	dir string // Директория контрольных точек
+}
+
+// NewFileCheckpointStore создает файловое хранилище контрольных точек
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+// Load читает контрольную точку проекции из файла
+func (s *FileCheckpointStore) Load(name string) (*ProjectionCheckpoint, error) {
+	data, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint ProjectionCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("ошибка при разборе контрольной точки %s: %w", name, err)
+	}
+	return &checkpoint, nil
+}
+
+// Save атомарно записывает контрольную точку проекции в файл
+func (s *FileCheckpointStore) Save(checkpoint ProjectionCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	// Пишем во временный файл и переименовываем, чтобы не оставить файл наполовину записанным
+	tmpPath := s.path(checkpoint.Name) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path(checkpoint.Name))
+}
+
+// path возвращает путь к файлу контрольной точки проекции
+func (s *FileCheckpointStore) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// redisCheckpointTimeout таймаут операций с Redis
+const redisCheckpointTimeout = 5 * time.Second
+
+// RedisCheckpointStore хранит контрольные точки в Redis по ключу cqrs:projection:<имя>
+type RedisCheckpointStore struct {
+	client *redis.Client // Клиент Redis
+}
+
+// NewRedisCheckpointStore подключается к Redis для хранения контрольных точек
+func NewRedisCheckpointStore(addr string) (*RedisCheckpointStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisCheckpointTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ошибка подключения к Redis: %w", err)
+	}
+
+	return &RedisCheckpointStore{client: client}, nil
+}
+
+// Load читает контрольную точку проекции из Redis
+func (s *RedisCheckpointStore) Load(name string) (*ProjectionCheckpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisCheckpointTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, redisCheckpointKey(name)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var checkpoint ProjectionCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("ошибка при разборе контрольной точки %s: %w", name, err)
+	}
+	return &checkpoint, nil
+}
+
+// Save записывает контрольную точку проекции в Redis
+func (s *RedisCheckpointStore) Save(checkpoint ProjectionCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisCheckpointTimeout)
+	defer cancel()
+	return s.client.Set(ctx, redisCheckpointKey(checkpoint.Name), data, 0).Err()
+}
+
+// redisCheckpointKey возвращает ключ Redis для контрольной точки проекции
+func redisCheckpointKey(name string) string {
+	return "cqrs:projection:" + name
+}
@@ -0,0 +1,322 @@
+// command_bus.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command команда, которую можно отправить через шину
+type Command interface {
+	CommandName() string // Имя команды (ключ регистрации обработчика)
+}
+
+// Validator команда, которая умеет проверять свои данные до выполнения
+type Validator interface {
+	Validate() error
+}
+
+// CommandResult результат выполнения команды над заказом
+type CommandResult struct {
+	OrderID OrderID `json:"order_id"`
+	Status  string  `json:"status"` // Статус заказа после команды
+}
+
+// CommandHandler обрабатывает команду
+type CommandHandler func(ctx context.Context, cmd Command) (CommandResult, error)
+
+// CommandMiddleware оборачивает обработчик команды общей логикой
+type CommandMiddleware func(next CommandHandler) CommandHandler
+
+// commandRegistration обработчик команды и разбор ее из JSON
+type commandRegistration struct {
+	handler CommandHandler
+	decode  func(data []byte) (Command, error)
+}
+
+// CommandBus шина команд: каждая команда регистрируется со своим обработчиком,
+// а отправка проходит через цепочку middleware. Через шину команды отправляют все
+// транспорты: HTTP, командная строка, брокеры сообщений.
+type CommandBus struct {
+	commands   map[string]commandRegistration
+	middleware []CommandMiddleware
+}
+
+// ErrUnknownCommand возвращается при отправке незарегистрированной команды
+var ErrUnknownCommand = errors.New("неизвестная команда")
+
+// NewCommandBus создает шину команд. Middleware применяются в порядке перечисления:
+// первое получает команду первым.
+func NewCommandBus(middleware ...CommandMiddleware) *CommandBus {
+	return &CommandBus{
+		commands:   make(map[string]commandRegistration),
+		middleware: middleware,
+	}
+}
+
+// RegisterCommand регистрирует обработчик команды типа C.
+// Имя команды берется из C.CommandName(), JSON разбирается в значение C.
+func RegisterCommand[C Command](bus *CommandBus, handler func(ctx context.Context, cmd C) (CommandResult, error)) error {
+	var zero C
+	name := zero.CommandName()
+	if _, found := bus.commands[name]; found {
+		return fmt.Errorf("команда %s уже зарегистрирована", name)
+	}
+
+	bus.commands[name] = commandRegistration{
+		handler: func(ctx context.Context, cmd Command) (CommandResult, error) {
+			typed, ok := cmd.(C)
+			if !ok {
+				return CommandResult{}, fmt.Errorf("команда %s имеет неожиданный тип %T", name, cmd)
+			}
+			return handler(ctx, typed)
+		},
+		decode: func(data []byte) (Command, error) {
+			var cmd C
+			if err := json.Unmarshal(data, &cmd); err != nil {
+				return nil, validationError("некорректные данные команды %s: %v", name, err)
+			}
+			return cmd, nil
+		},
+	}
+	return nil
+}
+
+// Dispatch отправляет команду ее обработчику через цепочку middleware
+func (b *CommandBus) Dispatch(ctx context.Context, cmd Command) (CommandResult, error) {
+	registration, found := b.commands[cmd.CommandName()]
+	if !found {
+		return CommandResult{}, fmt.Errorf("%w: %s", ErrUnknownCommand, cmd.CommandName())
+	}
+
+	handler := registration.handler
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		handler = b.middleware[i](handler)
+	}
+	return handler(ctx, cmd)
+}
+
+// Decode разбирает команду по имени из JSON, например для командной строки или брокера
+func (b *CommandBus) Decode(name string, data []byte) (Command, error) {
+	registration, found := b.commands[name]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+	return registration.decode(data)
+}
+
+// Commands возвращает имена зарегистрированных команд
+func (b *CommandBus) Commands() []string {
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidationMiddleware проверяет данные команды до выполнения
+func ValidationMiddleware() CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd Command) (CommandResult, error) {
+			if validator, ok := cmd.(Validator); ok {
+				if err := validator.Validate(); err != nil {
+					return CommandResult{}, err
+				}
+			}
+			return next(ctx, cmd)
+		}
+	}
+}
+
+// LoggingMiddleware пишет структурированную запись о каждой команде
+func LoggingMiddleware(logger *slog.Logger) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd Command) (CommandResult, error) {
+			start := time.Now()
+			result, err := next(ctx, cmd)
+
+			attrs := []any{
+				"command", cmd.CommandName(),
+				"actor", ActorFromContext(ctx).ID,
+				"order_id", result.OrderID,
+				"duration", time.Since(start),
+			}
+			if err != nil {
+				logger.Warn("Команда отклонена", append(attrs, "error", err.Error())...)
+			} else {
+				logger.Info("Команда выполнена", append(attrs, "status", result.Status)...)
+			}
+			return result, err
+		}
+	}
+}
+
+// CommandStats статистика выполнения команды одного типа
+type CommandStats struct {
+	Command       string  `json:"command"`
+	Total         int64   `json:"total"`           // Всего отправлено
+	Failed        int64   `json:"failed"`          // Завершилось ошибкой
+	Conflicts     int64   `json:"conflicts"`       // Из них конфликтом версий
+	AvgDurationMs float64 `json:"avg_duration_ms"` // Среднее время выполнения
+	MaxDurationMs float64 `json:"max_duration_ms"` // Максимальное время выполнения
+}
+
+// CommandMetrics счетчики и время выполнения команд
+type CommandMetrics struct {
+	stats map[string]*commandMetric
+	mu    sync.Mutex
+}
+
+// commandMetric накопленные значения для одного типа команд
+type commandMetric struct {
+	total, failed, conflicts int64
+	duration, maxDuration    time.Duration
+}
+
+// NewCommandMetrics создает пустые метрики команд
+func NewCommandMetrics() *CommandMetrics {
+	return &CommandMetrics{stats: make(map[string]*commandMetric)}
+}
+
+// Middleware учитывает каждую команду в метриках
+func (m *CommandMetrics) Middleware() CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd Command) (CommandResult, error) {
+			start := time.Now()
+			result, err := next(ctx, cmd)
+			m.observe(cmd.CommandName(), time.Since(start), err)
+			return result, err
+		}
+	}
+}
+
+// observe учитывает выполнение команды
+func (m *CommandMetrics) observe(name string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric, found := m.stats[name]
+	if !found {
+		metric = &commandMetric{}
+		m.stats[name] = metric
+	}
+	metric.total++
+	metric.duration += duration
+	metric.maxDuration = max(metric.maxDuration, duration)
+	if err != nil {
+		metric.failed++
+		if IsConcurrencyError(err) {
+			metric.conflicts++
+		}
+	}
+}
+
+// Snapshot возвращает статистику всех команд, отсортированную по имени
+func (m *CommandMetrics) Snapshot() []CommandStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]CommandStats, 0, len(m.stats))
+	for name, metric := range m.stats {
+		result = append(result, CommandStats{
+			Command:       name,
+			Total:         metric.total,
+			Failed:        metric.failed,
+			Conflicts:     metric.conflicts,
+			AvgDurationMs: float64(metric.duration.Microseconds()) / float64(metric.total) / 1000,
+			MaxDurationMs: float64(metric.maxDuration.Microseconds()) / 1000,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Command < result[j].Command
+	})
+	return result
+}
+
+// Actor инициатор команды
+type Actor struct {
+	ID    string   // Идентификатор (пользователь, сервис)
+	Roles []string // Роли
+}
+
+// HasRole проверяет, есть ли у инициатора роль
+func (a Actor) HasRole(role string) bool {
+	for _, existing := range a.Roles {
+		if existing == role {
+			return true
+		}
+	}
+	return false
+}
+
+// actorContextKey ключ инициатора в контексте
+type actorContextKey struct{}
+
+// WithActor возвращает контекст с инициатором команды
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext возвращает инициатора команды из контекста (пустого, если его нет)
+func ActorFromContext(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorContextKey{}).(Actor)
+	return actor
+}
+
+// ForbiddenError возвращается, если у инициатора нет роли для команды
+type ForbiddenError struct {
+	Command string   // Команда
+	ActorID string   // Инициатор
+	Roles   []string // Роли, которым команда разрешена
+}
+
+// Error возвращает описание запрета
+func (e *ForbiddenError) Error() string {
+	if e.ActorID == "" {
+		return fmt.Sprintf("команда %s требует авторизации (роли: %s)", e.Command, strings.Join(e.Roles, ", "))
+	}
+	return fmt.Sprintf("у %s нет прав на команду %s (роли: %s)", e.ActorID, e.Command, strings.Join(e.Roles, ", "))
+}
+
+// CommandPolicy роли, которым разрешена каждая команда
+type CommandPolicy map[string][]string
+
+// AuthorizationMiddleware разрешает команду, только если у инициатора есть одна из ролей политики.
+// Команды, которых нет в политике, запрещены.
+func AuthorizationMiddleware(policy CommandPolicy) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd Command) (CommandResult, error) {
+			actor := ActorFromContext(ctx)
+			roles := policy[cmd.CommandName()]
+			for _, role := range roles {
+				if actor.HasRole(role) {
+					return next(ctx, cmd)
+				}
+			}
+			return CommandResult{}, &ForbiddenError{Command: cmd.CommandName(), ActorID: actor.ID, Roles: roles}
+		}
+	}
+}
+
+// RetryMiddleware повторяет команду при конфликте версий, но не более retries раз
+func RetryMiddleware(retries int) CommandMiddleware {
+	return func(next CommandHandler) CommandHandler {
+		return func(ctx context.Context, cmd Command) (CommandResult, error) {
+			var result CommandResult
+			err := retryOnConflict(retries, func() error {
+				var err error
+				result, err = next(ctx, cmd)
+				return err
+			})
+			return result, err
+		}
+	}
+}
@@ -2,130 +2,376 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"time"
+	"log/slog"
 )
 
 // CreateOrderCommand команда для создания заказа
 type CreateOrderCommand struct {
-	CustomerID string   // ID клиента
-	Items      []string // Список товаров
+	CustomerID string      `json:"customer_id"` // ID клиента
+	Items      []OrderItem `json:"items"`       // Позиции заказа
 }
 
 // PayOrderCommand команда для оплаты заказа
 type PayOrderCommand struct {
-	OrderID int // ID заказа
+	OrderID OrderID `json:"order_id"` // ID заказа
 }
 
 // CancelOrderCommand команда для отмены заказа
 type CancelOrderCommand struct {
-	OrderID int    // ID заказа
-	Reason  string // Причина отмены
+	OrderID OrderID `json:"order_id"` // ID заказа
+	Reason  string  `json:"reason"`   // Причина отмены
 }
 
-// HandleCreateOrder обрабатывает команду создания заказа
-func HandleCreateOrder(store *EventStore, cmd CreateOrderCommand) (int, error) {
-	// Валидация данных команды
+// ShipOrderCommand команда для отправки заказа
+type ShipOrderCommand struct {
+	OrderID        OrderID `json:"order_id"`        // ID заказа
+	TrackingNumber string  `json:"tracking_number"` // Трек-номер отправления
+}
+
+// DeliverOrderCommand команда для подтверждения доставки заказа
+type DeliverOrderCommand struct {
+	OrderID OrderID `json:"order_id"` // ID заказа
+}
+
+// RefundOrderCommand команда для возврата оплаты заказа
+type RefundOrderCommand struct {
+	OrderID OrderID `json:"order_id"` // ID заказа
+	Reason  string  `json:"reason"`   // Причина возврата
+}
+
+// CommandForgetCustomer имя команды удаления персональных данных клиента
+const CommandForgetCustomer = "ForgetCustomer"
+
+// ForgetCustomerCommand команда удаления персональных данных клиента (право на забвение)
+type ForgetCustomerCommand struct {
+	CustomerID string `json:"customer_id"` // ID клиента
+}
+
+// CommandName возвращает имя команды
+func (CreateOrderCommand) CommandName() string { return CommandCreateOrder }
+
+// CommandName возвращает имя команды
+func (PayOrderCommand) CommandName() string { return CommandPayOrder }
+
+// CommandName возвращает имя команды
+func (CancelOrderCommand) CommandName() string { return CommandCancelOrder }
+
+// CommandName возвращает имя команды
+func (ShipOrderCommand) CommandName() string { return CommandShipOrder }
+
+// CommandName возвращает имя команды
+func (DeliverOrderCommand) CommandName() string { return CommandDeliverOrder }
+
+// CommandName возвращает имя команды
+func (RefundOrderCommand) CommandName() string { return CommandRefundOrder }
+
+// CommandName возвращает имя команды
+func (ForgetCustomerCommand) CommandName() string { return CommandForgetCustomer }
+
+// Validate проверяет данные команды создания заказа
+func (cmd CreateOrderCommand) Validate() error {
 	if cmd.CustomerID == "" {
-		return 0, errors.New("ID клиента не может быть пустым")
+		return validationError("ID клиента не может быть пустым")
 	}
 	if len(cmd.Items) == 0 {
-		return 0, errors.New("заказ должен содержать хотя бы один товар")
+		return validationError("заказ должен содержать хотя бы один товар")
+	}
+	for _, item := range cmd.Items {
+		if item.Name == "" {
+			return validationError("название товара не может быть пустым")
+		}
+		if item.Quantity <= 0 {
+			return validationError("некорректное количество товара %s: %d", item.Name, item.Quantity)
+		}
+	}
+	return nil
+}
+
+// Validate проверяет данные команды отправки заказа
+func (cmd ShipOrderCommand) Validate() error {
+	if cmd.TrackingNumber == "" {
+		return validationError("трек-номер не может быть пустым")
+	}
+	return nil
+}
+
+// Validate проверяет данные команды удаления персональных данных
+func (cmd ForgetCustomerCommand) Validate() error {
+	if cmd.CustomerID == "" || cmd.CustomerID == RedactedValue {
+		return validationError("некорректный ID клиента")
 	}
+	return nil
+}
+
+// ErrOrderNotFound возвращается, если у заказа нет ни одного события
+var ErrOrderNotFound = errors.New("заказ не найден")
+
+// ValidationError ошибка проверки данных команды
+type ValidationError struct {
+	Message string // Описание ошибки
+}
+
+// Error возвращает описание ошибки
+func (e *ValidationError) Error() string {
+	return e.Message
+}
 
+// validationError создает ошибку проверки данных команды
+func validationError(format string, args ...any) error {
+	return &ValidationError{Message: fmt.Sprintf(format, args...)}
+}
+
+// loadOrder восстанавливает состояние заказа из снимка и последующих событий
+// и возвращает версию его потока
+func loadOrder(store *EventStore, orderID OrderID) (*OrderState, int, error) {
+	state, version := store.LoadOrderState(orderID)
+	if state == nil {
+		return nil, 0, ErrOrderNotFound
+	}
+	return state, version, nil
+}
+
+// HandleCreateOrder обрабатывает команду создания заказа.
+// Данные команды проверяются до вызова (ValidationMiddleware шины команд).
+func HandleCreateOrder(ctx context.Context, store *EventStore, cmd CreateOrderCommand) (OrderID, error) {
 	// Генерация нового ID заказа
-	orderID := store.NextOrderID()
+	orderID, err := store.NextOrderID()
+	if err != nil {
+		return "", err
+	}
 
 	// Создание события
 	event := OrderCreatedEvent{
-		BaseEvent: BaseEvent{
-			OrderID:   orderID,
-			Timestamp: time.Now(),
-		},
+		BaseEvent:  newBaseEvent(ctx, orderID),
 		CustomerID: cmd.CustomerID,
 		Items:      cmd.Items,
 	}
 
-	// Сохранение события
-	err := store.SaveEvent(event)
+	// Сохранение события в новый поток
+	err = store.SaveEvent(event, NoStream)
 	if err != nil {
-		return 0, fmt.Errorf("ошибка при сохранении события: %w", err)
+		return "", fmt.Errorf("ошибка при сохранении события: %w", err)
 	}
 
-	log.Printf("Заказ #%d создан для клиента %s", orderID, cmd.CustomerID)
+	// ID клиента - персональные данные, в журнал сервера его не пишем
+	log.Printf("Заказ #%s создан", orderID)
 	return orderID, nil
 }
 
 // HandlePayOrder обрабатывает команду оплаты заказа
-func HandlePayOrder(store *EventStore, cmd PayOrderCommand) error {
-	// Получение событий для заказа
-	events := store.GetEventsForOrder(cmd.OrderID)
-	if len(events) == 0 {
-		return errors.New("заказ не найден")
+func HandlePayOrder(ctx context.Context, store *EventStore, cmd PayOrderCommand) error {
+	// Восстановление состояния заказа и версии его потока
+	orderState, version, err := loadOrder(store, cmd.OrderID)
+	if err != nil {
+		return err
 	}
 
-	// Восстановление состояния заказа
-	orderState := buildOrderState(events)
-
-	// Проверка текущего состояния
-	if orderState.Status != "created" {
-		return fmt.Errorf("невозможно оплатить заказ в статусе %s", orderState.Status)
+	// Проверка перехода по таблице состояний заказа
+	if _, err := orderStateMachine.Check(CommandPayOrder, orderState.Status); err != nil {
+		return err
 	}
 
 	// Создание события оплаты
 	event := OrderPaidEvent{
-		BaseEvent: BaseEvent{
-			OrderID:   cmd.OrderID,
-			Timestamp: time.Now(),
-		},
+		BaseEvent: newBaseEvent(ctx, cmd.OrderID),
 	}
 
-	// Сохранение события
-	err := store.SaveEvent(event)
+	// Сохранение события с проверкой версии потока
+	err = store.SaveEvent(event, version)
 	if err != nil {
 		return fmt.Errorf("ошибка при сохранении события: %w", err)
 	}
 
-	log.Printf("Заказ #%d оплачен", cmd.OrderID)
+	log.Printf("Заказ #%s оплачен", cmd.OrderID)
 	return nil
 }
 
 // HandleCancelOrder обрабатывает команду отмены заказа
-func HandleCancelOrder(store *EventStore, cmd CancelOrderCommand) error {
-	// Получение событий для заказа
-	events := store.GetEventsForOrder(cmd.OrderID)
-	if len(events) == 0 {
-		return errors.New("заказ не найден")
+func HandleCancelOrder(ctx context.Context, store *EventStore, cmd CancelOrderCommand) error {
+	// Восстановление состояния заказа и версии его потока
+	orderState, version, err := loadOrder(store, cmd.OrderID)
+	if err != nil {
+		return err
 	}
 
-	// Восстановление состояния заказа
-	orderState := buildOrderState(events)
-
-	// Проверка текущего состояния
-	if orderState.Status == "cancelled" {
-		return errors.New("заказ уже отменен")
-	}
-	if orderState.Status == "delivered" {
-		return errors.New("невозможно отменить доставленный заказ")
+	// Проверка перехода по таблице состояний заказа
+	if _, err := orderStateMachine.Check(CommandCancelOrder, orderState.Status); err != nil {
+		return err
 	}
 
 	// Создание события отмены
 	event := OrderCancelledEvent{
-		BaseEvent: BaseEvent{
-			OrderID:   cmd.OrderID,
-			Timestamp: time.Now(),
-		},
-		Reason: cmd.Reason,
+		BaseEvent: newBaseEvent(ctx, cmd.OrderID),
+		Reason:    cmd.Reason,
 	}
 
-	// Сохранение события
-	err := store.SaveEvent(event)
+	// Сохранение события с проверкой версии потока
+	err = store.SaveEvent(event, version)
 	if err != nil {
 		return fmt.Errorf("ошибка при сохранении события: %w", err)
 	}
 
-	log.Printf("Заказ #%d отменен по причине: %s", cmd.OrderID, cmd.Reason)
+	log.Printf("Заказ #%s отменен по причине: %s", cmd.OrderID, cmd.Reason)
 	return nil
 }
+
+// HandleShipOrder обрабатывает команду отправки заказа.
+// Данные команды проверяются до вызова (ValidationMiddleware шины команд).
+func HandleShipOrder(ctx context.Context, store *EventStore, cmd ShipOrderCommand) error {
+	// Восстановление состояния заказа и версии его потока
+	orderState, version, err := loadOrder(store, cmd.OrderID)
+	if err != nil {
+		return err
+	}
+
+	// Проверка перехода по таблице состояний заказа
+	if _, err := orderStateMachine.Check(CommandShipOrder, orderState.Status); err != nil {
+		return err
+	}
+
+	// Создание события отправки
+	event := OrderShippedEvent{
+		BaseEvent:      newBaseEvent(ctx, cmd.OrderID),
+		TrackingNumber: cmd.TrackingNumber,
+	}
+
+	// Сохранение события с проверкой версии потока
+	err = store.SaveEvent(event, version)
+	if err != nil {
+		return fmt.Errorf("ошибка при сохранении события: %w", err)
+	}
+
+	log.Printf("Заказ #%s отправлен, трек-номер: %s", cmd.OrderID, cmd.TrackingNumber)
+	return nil
+}
+
+// HandleDeliverOrder обрабатывает команду подтверждения доставки заказа
+func HandleDeliverOrder(ctx context.Context, store *EventStore, cmd DeliverOrderCommand) error {
+	// Восстановление состояния заказа и версии его потока
+	orderState, version, err := loadOrder(store, cmd.OrderID)
+	if err != nil {
+		return err
+	}
+
+	// Проверка перехода по таблице состояний заказа
+	if _, err := orderStateMachine.Check(CommandDeliverOrder, orderState.Status); err != nil {
+		return err
+	}
+
+	// Создание события доставки
+	event := OrderDeliveredEvent{
+		BaseEvent: newBaseEvent(ctx, cmd.OrderID),
+	}
+
+	// Сохранение события с проверкой версии потока
+	err = store.SaveEvent(event, version)
+	if err != nil {
+		return fmt.Errorf("ошибка при сохранении события: %w", err)
+	}
+
+	log.Printf("Заказ #%s доставлен", cmd.OrderID)
+	return nil
+}
+
+// HandleRefundOrder обрабатывает команду возврата оплаты заказа
+func HandleRefundOrder(ctx context.Context, store *EventStore, cmd RefundOrderCommand) error {
+	// Восстановление состояния заказа и версии его потока
+	orderState, version, err := loadOrder(store, cmd.OrderID)
+	if err != nil {
+		return err
+	}
+
+	// Проверка перехода по таблице состояний заказа
+	if _, err := orderStateMachine.Check(CommandRefundOrder, orderState.Status); err != nil {
+		return err
+	}
+
+	// Создание события возврата оплаты
+	event := OrderRefundedEvent{
+		BaseEvent: newBaseEvent(ctx, cmd.OrderID),
+		Reason:    cmd.Reason,
+	}
+
+	// Сохранение события с проверкой версии потока
+	err = store.SaveEvent(event, version)
+	if err != nil {
+		return fmt.Errorf("ошибка при сохранении события: %w", err)
+	}
+
+	log.Printf("Оплата заказа #%s возвращена по причине: %s", cmd.OrderID, cmd.Reason)
+	return nil
+}
+
+// defaultCommandPolicy роли, которым разрешены команды заказа при включенной авторизации
+var defaultCommandPolicy = CommandPolicy{
+	CommandCreateOrder:  {"customer", "admin"},
+	CommandPayOrder:     {"customer", "admin"},
+	CommandCancelOrder:  {"customer", "admin"},
+	CommandShipOrder:    {"warehouse", "admin"},
+	CommandDeliverOrder: {"warehouse", "admin"},
+	CommandRefundOrder:  {"admin"},
+
+	CommandForgetCustomer: {"admin"},
+}
+
+// CommandBusConfig настройки шины команд заказа
+type CommandBusConfig struct {
+	ConflictRetries int             // Повторы команды при конфликте версий
+	Authorization   bool            // Проверять роли инициатора по defaultCommandPolicy
+	Metrics         *CommandMetrics // Метрики команд (nil - не собирать)
+	Logger          *slog.Logger    // Журнал команд
+}
+
+// NewOrderCommandBus создает шину с командами заказа и цепочкой middleware:
+// журнал, метрики, авторизация, проверка данных, повтор при конфликте версий
+func NewOrderCommandBus(store *EventStore, config CommandBusConfig) *CommandBus {
+	middleware := []CommandMiddleware{LoggingMiddleware(config.Logger)}
+	if config.Metrics != nil {
+		middleware = append(middleware, config.Metrics.Middleware())
+	}
+	if config.Authorization {
+		middleware = append(middleware, AuthorizationMiddleware(defaultCommandPolicy))
+	}
+	middleware = append(middleware, ValidationMiddleware(), RetryMiddleware(config.ConflictRetries))
+	bus := NewCommandBus(middleware...)
+
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd CreateOrderCommand) (CommandResult, error) {
+		orderID, err := HandleCreateOrder(ctx, store, cmd)
+		return orderCommandResult(cmd, orderID), err
+	}))
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd PayOrderCommand) (CommandResult, error) {
+		return orderCommandResult(cmd, cmd.OrderID), HandlePayOrder(ctx, store, cmd)
+	}))
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd CancelOrderCommand) (CommandResult, error) {
+		return orderCommandResult(cmd, cmd.OrderID), HandleCancelOrder(ctx, store, cmd)
+	}))
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd ShipOrderCommand) (CommandResult, error) {
+		return orderCommandResult(cmd, cmd.OrderID), HandleShipOrder(ctx, store, cmd)
+	}))
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd DeliverOrderCommand) (CommandResult, error) {
+		return orderCommandResult(cmd, cmd.OrderID), HandleDeliverOrder(ctx, store, cmd)
+	}))
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd RefundOrderCommand) (CommandResult, error) {
+		return orderCommandResult(cmd, cmd.OrderID), HandleRefundOrder(ctx, store, cmd)
+	}))
+	mustRegister(RegisterCommand(bus, func(ctx context.Context, cmd ForgetCustomerCommand) (CommandResult, error) {
+		// Удаление данных необратимо: роль admin нужна даже при выключенной авторизации
+		if actor := ActorFromContext(ctx); !actor.HasRole("admin") {
+			return CommandResult{}, &ForbiddenError{Command: cmd.CommandName(), ActorID: actor.ID, Roles: []string{"admin"}}
+		}
+		_, err := store.ForgetCustomer(cmd.CustomerID)
+		return CommandResult{}, err
+	}))
+
+	return bus
+}
+
+// orderCommandResult возвращает результат команды со статусом заказа из таблицы переходов
+func orderCommandResult(cmd Command, orderID OrderID) CommandResult {
+	transition, _ := orderStateMachine.Transition(cmd.CommandName())
+	return CommandResult{OrderID: orderID, Status: transition.To}
+}
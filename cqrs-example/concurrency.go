@@ -0,0 +1,46 @@
+// concurrency.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+const (
+	// AnyVersion отключает проверку версии потока при добавлении события
+	AnyVersion = -1
+	// NoStream ожидаемая версия для потока, в котором еще нет событий
+	NoStream = 0
+)
+
+// ConcurrencyError возвращается, когда версия потока заказа
+// не совпадает с версией, которую ожидала команда
+type ConcurrencyError struct {
+	OrderID         OrderID // ID заказа
+	ExpectedVersion int     // Версия, на основе которой принималось решение
+	ActualVersion   int     // Фактическая версия потока
+}
+
+// Error возвращает описание конфликта версий
+func (e *ConcurrencyError) Error() string {
+	return fmt.Sprintf("конфликт версий заказа #%s: ожидалась версия %d, текущая %d",
+		e.OrderID, e.ExpectedVersion, e.ActualVersion)
+}
+
+// IsConcurrencyError проверяет, вызвана ли ошибка конфликтом версий
+func IsConcurrencyError(err error) bool {
+	var conflict *ConcurrencyError
+	return errors.As(err, &conflict)
+}
+
+// retryOnConflict повторяет команду, пока она завершается конфликтом версий,
+// но не более retries дополнительных попыток
+func retryOnConflict(retries int, command func() error) error {
+	err := command()
+	for attempt := 1; attempt <= retries && IsConcurrencyError(err); attempt++ {
+		log.Printf("Конфликт версий, повтор команды (%d/%d): %v", attempt, retries, err)
+		err = command()
+	}
+	return err
+}
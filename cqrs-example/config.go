@@ -0,0 +1,204 @@
+// config.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Config настройки CQRS сервера, читаются из переменных окружения
+type Config struct {
+	DataDir            string              // Директория данных (CQRS_DATA_DIR)
+	ConflictRetries    int                 // Повторы команды при конфликте версий (CQRS_CONFLICT_RETRIES)
+	Authorization      bool                // Проверять роли инициатора команд (CQRS_AUTHORIZATION)
+	TrustedProxies     TrustedProxies      // Адреса, от которых принимаются заголовки инициатора (CQRS_TRUSTED_PROXIES)
+	StreamHeartbeat    time.Duration       // Период heartbeat потоков событий (CQRS_STREAM_HEARTBEAT)
+	Subscriptions      SubscriptionOptions // Доставка событий проекциям (CQRS_SUBSCRIBER_BUFFER, CQRS_SUBSCRIBER_OVERFLOW)
+	CheckpointStore    string              // Хранилище контрольных точек проекций: file, redis или memory (CQRS_CHECKPOINT_STORE)
+	CheckpointEvery    int                 // Сохранять контрольную точку каждые N событий (CQRS_CHECKPOINT_EVERY)
+	PaymentTimeout     time.Duration       // Отменять заказы, не оплаченные за это время, 0 - не отменять (CQRS_PAYMENT_TIMEOUT)
+	PaymentTimeoutFile string              // Время включения автоотмены ("" - только в памяти)
+	IdempotencyStore   string              // Хранилище ключей идемпотентности: memory или redis (CQRS_IDEMPOTENCY_STORE)
+	IdempotencyTTL     time.Duration       // Сколько хранить результат команды по ключу (CQRS_IDEMPOTENCY_TTL)
+	RedisAddr          string              // Адрес Redis (CQRS_REDIS_ADDR)
+	Outbox             OutboxConfig        // Публикация событий во внешний брокер (CQRS_OUTBOX_BROKER)
+	Store              EventStoreConfig    // Настройки хранилища событий (CQRS_EVENT_STORE, CQRS_EVENT_STREAM)
+}
+
+// loadConfig читает настройки из переменных окружения
+func loadConfig() (Config, error) {
+	dataDir := envString("CQRS_DATA_DIR", "data")
+
+	conflictRetries, err := envInt("CQRS_CONFLICT_RETRIES", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	authorization, err := envBool("CQRS_AUTHORIZATION", false)
+	if err != nil {
+		return Config{}, err
+	}
+	trustedProxies, err := ParseTrustedProxies(envString("CQRS_TRUSTED_PROXIES", "none"))
+	if err != nil {
+		return Config{}, err
+	}
+	snapshotEvery, err := envInt("CQRS_SNAPSHOT_EVERY", 20)
+	if err != nil {
+		return Config{}, err
+	}
+	segmentMaxBytes, err := envInt("CQRS_SEGMENT_MAX_BYTES", 4<<20)
+	if err != nil {
+		return Config{}, err
+	}
+	fsync, err := ParseFsyncPolicy(envString("CQRS_FSYNC", string(FsyncAlways)))
+	if err != nil {
+		return Config{}, err
+	}
+	fsyncInterval, err := envDuration("CQRS_FSYNC_INTERVAL", time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	allowUnlocked, err := envBool("CQRS_ALLOW_UNLOCKED_LOG", false)
+	if err != nil {
+		return Config{}, err
+	}
+	streamHeartbeat, err := envDuration("CQRS_STREAM_HEARTBEAT", 15*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	if streamHeartbeat == 0 {
+		return Config{}, fmt.Errorf("CQRS_STREAM_HEARTBEAT должен быть положительным")
+	}
+	subscriberBuffer, err := envInt("CQRS_SUBSCRIBER_BUFFER", 1024)
+	if err != nil {
+		return Config{}, err
+	}
+	overflow, err := ParseOverflowPolicy(envString("CQRS_SUBSCRIBER_OVERFLOW", string(OverflowBlock)))
+	if err != nil {
+		return Config{}, err
+	}
+	checkpointEvery, err := envInt("CQRS_CHECKPOINT_EVERY", 100)
+	if err != nil {
+		return Config{}, err
+	}
+	paymentTimeout, err := envDuration("CQRS_PAYMENT_TIMEOUT", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	idempotencyTTL, err := envDuration("CQRS_IDEMPOTENCY_TTL", 24*time.Hour)
+	if err != nil {
+		return Config{}, err
+	}
+	if idempotencyTTL == 0 {
+		return Config{}, fmt.Errorf("CQRS_IDEMPOTENCY_TTL должен быть положительным")
+	}
+
+	// События в памяти не переживают перезапуск, поэтому снимки и контрольные точки
+	// по умолчанию тоже хранятся в памяти, чтобы не опережать пустой лог
+	backend := envString("CQRS_EVENT_STORE", "file")
+	redisAddr := envString("CQRS_REDIS_ADDR", "localhost:6379")
+	snapshotFilePath := filepath.Join(dataDir, "snapshots.json")
+	keysFilePath := envString("CQRS_KEYS_FILE", filepath.Join(dataDir, "keys.json"))
+	paymentTimeoutFile := filepath.Join(dataDir, "payment_timeout.json")
+	checkpointStore := "file"
+	if backend == "memory" {
+		snapshotFilePath = ""
+		keysFilePath = ""
+		paymentTimeoutFile = ""
+		checkpointStore = "memory"
+	}
+
+	return Config{
+		DataDir:         dataDir,
+		ConflictRetries: conflictRetries,
+		Authorization:   authorization,
+		TrustedProxies:  trustedProxies,
+		StreamHeartbeat: streamHeartbeat,
+		Subscriptions: SubscriptionOptions{
+			BufferSize: subscriberBuffer,
+			Overflow:   overflow,
+		},
+		CheckpointStore:    envString("CQRS_CHECKPOINT_STORE", checkpointStore),
+		CheckpointEvery:    checkpointEvery,
+		PaymentTimeout:     paymentTimeout,
+		PaymentTimeoutFile: paymentTimeoutFile,
+		IdempotencyStore:   envString("CQRS_IDEMPOTENCY_STORE", "memory"),
+		IdempotencyTTL:     idempotencyTTL,
+		RedisAddr:          redisAddr,
+		Outbox: OutboxConfig{
+			Broker:       envString("CQRS_OUTBOX_BROKER", "none"),
+			KafkaBrokers: splitList(envString("CQRS_KAFKA_BROKERS", "localhost:9092")),
+			KafkaTopic:   envString("CQRS_KAFKA_TOPIC", "orders"),
+			NATSURL:      envString("CQRS_NATS_URL", nats.DefaultURL),
+			NATSSubject:  envString("CQRS_NATS_SUBJECT", "orders.events"),
+		},
+		Store: EventStoreConfig{
+			Backend: backend,
+			Log: LogConfig{
+				Dir:             filepath.Join(dataDir, "events"),
+				SegmentMaxBytes: int64(segmentMaxBytes),
+				Fsync:           fsync,
+				FsyncInterval:   fsyncInterval,
+				LegacyFile:      filepath.Join(dataDir, "event_log.json"),
+				AllowUnlocked:   allowUnlocked,
+			},
+			RedisAddr:        redisAddr,
+			RedisStream:      envString("CQRS_EVENT_STREAM", "cqrs:events"),
+			SnapshotFilePath: snapshotFilePath,
+			KeysFilePath:     keysFilePath,
+			SnapshotEvery:    snapshotEvery,
+			OrderIDs:         envString("CQRS_ORDER_IDS", OrderIDSequence),
+		},
+	}, nil
+}
+
+// envString возвращает значение переменной окружения или значение по умолчанию
+func envString(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// envInt читает неотрицательное целое из переменной окружения
+func envInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("некорректное значение %s: %q", name, value)
+	}
+	return result, nil
+}
+
+// envBool читает логическое значение (true/false, 1/0) из переменной окружения
+func envBool(name string, defaultValue bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("некорректное значение %s: %q", name, value)
+	}
+	return result, nil
+}
+
+// envDuration читает длительность (например, 500ms или 2s) из переменной окружения
+func envDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil || result < 0 {
+		return 0, fmt.Errorf("некорректное значение %s: %q", name, value)
+	}
+	return result, nil
+}
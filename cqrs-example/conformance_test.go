@@ -0,0 +1,454 @@
+// conformance_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// conformanceTimeout сколько ждать доставки событий подписчику
+const conformanceTimeout = 5 * time.Second
+
+// conformanceTarget хранилище событий, на котором проверяется набор.
+// Каждая проверка получает собственное пустое хранилище.
+type conformanceTarget struct {
+	name string
+	// create создает пустое хранилище и возвращает функцию, которая открывает его
+	// (в том числе повторно после Close); данные удаляются по завершении теста
+	create func(t *testing.T) func() (EventBackend, error)
+	// durable - события переживают закрытие и повторное открытие хранилища
+	durable bool
+	// available пропускает тест, если хранилище недоступно (nil - доступно всегда)
+	available func(t *testing.T)
+}
+
+// conformanceCheck одна проверка общего набора
+type conformanceCheck struct {
+	name    string
+	durable bool // Проверка имеет смысл только для долговременных хранилищ
+	run     func(open func() (EventBackend, error)) error
+}
+
+// conformanceTargets хранилища событий, которые обязаны проходить общий набор.
+// Redis проверяется, если он доступен по CQRS_REDIS_ADDR.
+var conformanceTargets = []conformanceTarget{
+	{name: "memory", create: func(t *testing.T) func() (EventBackend, error) {
+		return func() (EventBackend, error) {
+			return NewMemoryEventQueue(), nil
+		}
+	}},
+	{name: "file", durable: true, create: func(t *testing.T) func() (EventBackend, error) {
+		dir := t.TempDir()
+		return func() (EventBackend, error) {
+			return NewEventQueue(LogConfig{Dir: dir, SegmentMaxBytes: 4 << 10, Fsync: FsyncNever})
+		}
+	}},
+	{
+		name:    "redis",
+		durable: true,
+		available: func(t *testing.T) {
+			client := redis.NewClient(&redis.Options{Addr: conformanceRedisAddr()})
+			defer client.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := client.Ping(ctx).Err(); err != nil {
+				t.Skipf("Redis недоступен по адресу %s: %v", conformanceRedisAddr(), err)
+			}
+		},
+		create: func(t *testing.T) func() (EventBackend, error) {
+			id, err := newEventID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream := "cqrs:conformance:" + id
+			t.Cleanup(func() {
+				client := redis.NewClient(&redis.Options{Addr: conformanceRedisAddr()})
+				defer client.Close()
+				client.Del(context.Background(), stream)
+			})
+			return func() (EventBackend, error) {
+				return NewRedisEventQueue(conformanceRedisAddr(), stream)
+			}
+		},
+	},
+}
+
+// conformanceRedisAddr адрес Redis для проверки (CQRS_REDIS_ADDR)
+func conformanceRedisAddr() string {
+	return envString("CQRS_REDIS_ADDR", "localhost:6379")
+}
+
+// TestEventBackendConformance прогоняет общий набор проверок на каждом хранилище событий
+func TestEventBackendConformance(t *testing.T) {
+	for _, target := range conformanceTargets {
+		t.Run(target.name, func(t *testing.T) {
+			if target.available != nil {
+				target.available(t)
+			}
+			for _, check := range conformanceChecks {
+				t.Run(check.name, func(t *testing.T) {
+					if check.durable && !target.durable {
+						t.Skip("события не переживают перезапуск")
+					}
+					if err := check.run(target.create(t)); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
+
+// conformanceChecks общий набор проверок, который обязано проходить каждое хранилище событий
+var conformanceChecks = []conformanceCheck{
+	{name: "запись и чтение потока заказа", run: withBackend(checkAppendAndReadStream)},
+	{name: "проверка ожидаемой версии", run: withBackend(checkExpectedVersion)},
+	{name: "одновременная запись в один поток", run: withBackend(checkConcurrentAppends)},
+	{name: "чтение лога с позиции", run: withBackend(checkReadAll)},
+	{name: "уведомление о новых событиях", run: withBackend(checkChanged)},
+	{name: "подписка: история и новые события", run: withBackend(checkSubscribe)},
+	{name: "скрытие персональных данных", run: withBackend(checkRedact)},
+	{name: "события сохраняются после повторного открытия", durable: true, run: checkReopen},
+}
+
+// withBackend открывает хранилище на время проверки
+func withBackend(check func(backend EventBackend) error) func(open func() (EventBackend, error)) error {
+	return func(open func() (EventBackend, error)) error {
+		backend, err := open()
+		if err != nil {
+			return err
+		}
+		defer backend.Close()
+		return check(backend)
+	}
+}
+
+// checkAppendAndReadStream события заказа читаются в порядке записи, версия растет на единицу
+func checkAppendAndReadStream(backend EventBackend) error {
+	if err := appendOrderEvents(backend, "1"); err != nil {
+		return err
+	}
+
+	events, version := backend.ReadStream("1", 0)
+	if version != 3 || len(events) != 3 {
+		return fmt.Errorf("поток заказа: %d событий, версия %d, ожидалось 3 и 3", len(events), version)
+	}
+	for i, expected := range []string{"OrderCreated", "OrderPaid", "OrderCancelled"} {
+		if events[i].GetType() != expected || events[i].GetOrderID() != "1" {
+			return fmt.Errorf("событие %d: %s заказа #%s, ожидалось %s заказа #1",
+				i, events[i].GetType(), events[i].GetOrderID(), expected)
+		}
+	}
+	if created := events[0].(OrderCreatedEvent); created.CustomerID != "alice" || len(created.Items) != 1 {
+		return fmt.Errorf("данные события OrderCreated не сохранились: %+v", created)
+	}
+	if metadata := events[1].GetMetadata(); metadata != conformanceMetadata {
+		return fmt.Errorf("метаданные события не сохранились: %+v", metadata)
+	}
+
+	tail, version := backend.ReadStream("1", 2)
+	if version != 3 || len(tail) != 1 || tail[0].GetType() != "OrderCancelled" {
+		return fmt.Errorf("чтение потока с версии 2: %d событий, версия %d", len(tail), version)
+	}
+	if version := backend.StreamVersion("1"); version != 3 {
+		return fmt.Errorf("версия потока %d, ожидалась 3", version)
+	}
+	if events, version := backend.ReadStream("2", 0); len(events) != 0 || version != NoStream {
+		return fmt.Errorf("пустой поток: %d событий, версия %d", len(events), version)
+	}
+	return nil
+}
+
+// checkExpectedVersion запись с неверной версией отклоняется и не меняет поток
+func checkExpectedVersion(backend EventBackend) error {
+	if err := backend.Append(conformanceCreated("1"), NoStream); err != nil {
+		return err
+	}
+
+	err := backend.Append(conformancePaid("1"), NoStream)
+	var conflict *ConcurrencyError
+	if !errors.As(err, &conflict) {
+		return fmt.Errorf("ожидался конфликт версий, получено: %v", err)
+	}
+	if conflict.ExpectedVersion != NoStream || conflict.ActualVersion != 1 {
+		return fmt.Errorf("конфликт версий: ожидаемая %d, текущая %d, ожидалось 0 и 1",
+			conflict.ExpectedVersion, conflict.ActualVersion)
+	}
+	if version := backend.StreamVersion("1"); version != 1 {
+		return fmt.Errorf("после конфликта версия потока %d, ожидалась 1", version)
+	}
+
+	if err := backend.Append(conformancePaid("1"), AnyVersion); err != nil {
+		return fmt.Errorf("запись без проверки версии: %w", err)
+	}
+	if version := backend.StreamVersion("1"); version != 2 {
+		return fmt.Errorf("версия потока %d, ожидалась 2", version)
+	}
+	return nil
+}
+
+// checkConcurrentAppends из одновременных записей с одной версией проходит ровно одна
+func checkConcurrentAppends(backend EventBackend) error {
+	const writers = 16
+
+	var wg sync.WaitGroup
+	results := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- backend.Append(conformanceCreated("7"), NoStream)
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	succeeded, conflicts := 0, 0
+	for err := range results {
+		switch {
+		case err == nil:
+			succeeded++
+		case IsConcurrencyError(err):
+			conflicts++
+		default:
+			return err
+		}
+	}
+	if succeeded != 1 || conflicts != writers-1 {
+		return fmt.Errorf("успешных записей %d, конфликтов %d, ожидалось 1 и %d", succeeded, conflicts, writers-1)
+	}
+	if version := backend.StreamVersion("7"); version != 1 {
+		return fmt.Errorf("версия потока %d, ожидалась 1", version)
+	}
+	return nil
+}
+
+// checkReadAll лог читается по курсору страницами, позиции идут подряд, фильтры работают
+func checkReadAll(backend EventBackend) error {
+	if err := appendOrderEvents(backend, "1"); err != nil {
+		return err
+	}
+	if err := appendOrderEvents(backend, "2"); err != nil {
+		return err
+	}
+	if last := backend.LastPosition(); last != 6 {
+		return fmt.Errorf("последняя позиция %d, ожидалась 6", last)
+	}
+
+	var all []RecordedEvent
+	after := int64(0)
+	for {
+		page, next, hasMore := backend.ReadAll(EventQuery{After: after, Limit: 4})
+		all = append(all, page...)
+		after = next
+		if !hasMore {
+			break
+		}
+	}
+	if len(all) != 6 || after != 6 {
+		return fmt.Errorf("прочитано %d событий до позиции %d, ожидалось 6 до 6", len(all), after)
+	}
+	ids := make(map[string]bool)
+	for i, record := range all {
+		if record.Position != int64(i+1) {
+			return fmt.Errorf("событие %d имеет позицию %d", i, record.Position)
+		}
+		if record.EventID == "" || ids[record.EventID] {
+			return fmt.Errorf("событие на позиции %d имеет пустой или повторяющийся ID %q", record.Position, record.EventID)
+		}
+		ids[record.EventID] = true
+	}
+
+	paid, _, _ := backend.ReadAll(EventQuery{Type: "OrderPaid"})
+	if len(paid) != 2 || paid[0].Position != 2 || paid[1].Position != 5 {
+		return fmt.Errorf("фильтр по типу вернул %d событий", len(paid))
+	}
+	order, _, _ := backend.ReadAll(EventQuery{After: 4, OrderID: "2"})
+	if len(order) != 2 || order[0].Position != 5 {
+		return fmt.Errorf("фильтр по заказу после позиции 4 вернул %d событий", len(order))
+	}
+	if rest, next, hasMore := backend.ReadAll(EventQuery{After: 6}); len(rest) != 0 || next != 6 || hasMore {
+		return fmt.Errorf("чтение после конца лога: %d событий, курсор %d", len(rest), next)
+	}
+	return nil
+}
+
+// checkChanged канал уведомления закрывается после записи события
+func checkChanged(backend EventBackend) error {
+	changed := backend.Changed()
+	select {
+	case <-changed:
+		return errors.New("канал закрыт до записи событий")
+	default:
+	}
+
+	if err := backend.Append(conformanceCreated("1"), NoStream); err != nil {
+		return err
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-time.After(conformanceTimeout):
+		return errors.New("канал не закрылся после записи события")
+	}
+}
+
+// checkSubscribe подписчик получает события после позиции after из истории, затем новые, по порядку и без повторов
+func checkSubscribe(backend EventBackend) error {
+	if err := appendOrderEvents(backend, "1"); err != nil {
+		return err
+	}
+
+	received := make(chan int64, 16)
+	options := SubscriptionOptions{BufferSize: 1, Overflow: OverflowBlock}
+	backend.Subscribe("conformance", 1, options, func(record RecordedEvent) {
+		received <- record.Position
+	})
+
+	if err := appendOrderEvents(backend, "2"); err != nil {
+		return err
+	}
+
+	for expected := int64(2); expected <= 6; expected++ {
+		select {
+		case position := <-received:
+			if position != expected {
+				return fmt.Errorf("получено событие на позиции %d, ожидалась %d", position, expected)
+			}
+		case <-time.After(conformanceTimeout):
+			return fmt.Errorf("событие на позиции %d не доставлено", expected)
+		}
+	}
+
+	select {
+	case position := <-received:
+		return fmt.Errorf("лишнее событие на позиции %d", position)
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+// checkRedact после Redact персональные данные клиента скрыты во всех его событиях, остальные не изменены
+func checkRedact(backend EventBackend) error {
+	if err := appendOrderEvents(backend, "1"); err != nil {
+		return err
+	}
+	other := OrderCreatedEvent{BaseEvent: conformanceBase("2"), CustomerID: "bob", Items: []OrderItem{{Name: "ручка", Quantity: 1}}}
+	if err := backend.Append(other, NoStream); err != nil {
+		return err
+	}
+
+	redacted, err := backend.Redact("alice")
+	if err != nil {
+		return err
+	}
+	if redacted != 1 {
+		return fmt.Errorf("скрыто событий %d, ожидалось 1", redacted)
+	}
+
+	events, _ := backend.ReadStream("1", 0)
+	if created := events[0].(OrderCreatedEvent); created.CustomerID != RedactedValue || len(created.Items) != 1 {
+		return fmt.Errorf("событие клиента после скрытия: %+v", created)
+	}
+	events, _ = backend.ReadStream("2", 0)
+	if created := events[0].(OrderCreatedEvent); created.CustomerID != "bob" {
+		return fmt.Errorf("событие другого клиента изменено: %+v", created)
+	}
+	return nil
+}
+
+// checkReopen после повторного открытия события, позиции, ID и версии потоков сохраняются
+func checkReopen(open func() (EventBackend, error)) error {
+	backend, err := open()
+	if err != nil {
+		return err
+	}
+	if err := appendOrderEvents(backend, "1"); err != nil {
+		backend.Close()
+		return err
+	}
+	before, _, _ := backend.ReadAll(EventQuery{})
+	if err := backend.Close(); err != nil {
+		return err
+	}
+
+	backend, err = open()
+	if err != nil {
+		return fmt.Errorf("повторное открытие: %w", err)
+	}
+	defer backend.Close()
+
+	after, _, _ := backend.ReadAll(EventQuery{})
+	if len(after) != len(before) {
+		return fmt.Errorf("после открытия %d событий, до закрытия было %d", len(after), len(before))
+	}
+	for i := range before {
+		if after[i].Position != before[i].Position || after[i].EventID != before[i].EventID ||
+			after[i].Event.GetType() != before[i].Event.GetType() ||
+			after[i].Event.GetMetadata() != before[i].Event.GetMetadata() {
+			return fmt.Errorf("событие на позиции %d изменилось после открытия", before[i].Position)
+		}
+	}
+
+	if err := backend.Append(conformanceShipped("1"), 2); !IsConcurrencyError(err) {
+		return fmt.Errorf("после открытия запись с устаревшей версией не отклонена: %v", err)
+	}
+	if err := backend.Append(conformanceCreated("2"), NoStream); err != nil {
+		return err
+	}
+	if last := backend.LastPosition(); last != 4 {
+		return fmt.Errorf("позиция после открытия и записи %d, ожидалась 4", last)
+	}
+	return nil
+}
+
+// appendOrderEvents записывает создание, оплату и отмену заказа с проверкой версий
+func appendOrderEvents(backend EventBackend, orderID OrderID) error {
+	events := []Event{conformanceCreated(orderID), conformancePaid(orderID), conformanceCancelled(orderID)}
+	for version, event := range events {
+		if err := backend.Append(event, version); err != nil {
+			return fmt.Errorf("запись %s заказа #%s: %w", event.GetType(), orderID, err)
+		}
+	}
+	return nil
+}
+
+// Тестовые события заказа
+
+func conformanceBase(orderID OrderID) BaseEvent {
+	return BaseEvent{OrderID: orderID, Timestamp: time.Now().UTC().Truncate(time.Second), Metadata: conformanceMetadata}
+}
+
+// conformanceMetadata метаданные тестовых событий: хранилище обязано вернуть их без изменений
+var conformanceMetadata = EventMetadata{
+	CorrelationID: "conformance-correlation",
+	CausationID:   "conformance-request",
+	ActorID:       "conformance",
+	Source:        "conformance",
+}
+
+func conformanceCreated(orderID OrderID) Event {
+	return OrderCreatedEvent{
+		BaseEvent:  conformanceBase(orderID),
+		CustomerID: "alice",
+		Items:      []OrderItem{{Name: "книга-" + string(orderID), Quantity: 1}},
+	}
+}
+
+func conformancePaid(orderID OrderID) Event {
+	return OrderPaidEvent{BaseEvent: conformanceBase(orderID)}
+}
+
+func conformanceShipped(orderID OrderID) Event {
+	return OrderShippedEvent{BaseEvent: conformanceBase(orderID), TrackingNumber: "RU1"}
+}
+
+func conformanceCancelled(orderID OrderID) Event {
+	return OrderCancelledEvent{BaseEvent: conformanceBase(orderID), Reason: "conformance"}
+}
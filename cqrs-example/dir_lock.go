@@ -0,0 +1,81 @@
+// dir_lock.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// lockFileName файл блокировки в директории лога
+const lockFileName = "LOCK"
+
+// errLocked возвращается lockFile, если файл заблокирован другим процессом
+var errLocked = errors.New("файл заблокирован")
+
+// errLockUnsupported возвращается lockFile на платформах без блокировки файлов
+var errLockUnsupported = errors.New("блокировка файлов не поддерживается на этой платформе " +
+	"(запуск без нее возможен только с CQRS_ALLOW_UNLOCKED_LOG=true и единственным писателем)")
+
+// DirLockedError возвращается, когда директорию уже занял другой процесс
+type DirLockedError struct {
+	Dir   string // Заблокированная директория
+	Owner int    // PID процесса, который держит блокировку (0 - неизвестен)
+}
+
+// Error возвращает описание конфликта
+func (e *DirLockedError) Error() string {
+	if e.Owner > 0 {
+		return fmt.Sprintf("директория %s уже используется другим процессом (PID %d): два писателя испортят лог событий", e.Dir, e.Owner)
+	}
+	return fmt.Sprintf("директория %s уже используется другим процессом: два писателя испортят лог событий", e.Dir)
+}
+
+// DirLock эксклюзивная блокировка директории, которую держит процесс-писатель
+type DirLock struct {
+	file *os.File
+}
+
+// LockDir захватывает эксклюзивную блокировку директории. Блокировка снимается
+// Release или автоматически при завершении процесса. Если директорию держит
+// другой процесс, возвращает *DirLockedError.
+func LockDir(dir string) (*DirLock, error) {
+	path := filepath.Join(dir, lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при открытии файла блокировки: %w", err)
+	}
+
+	if err := lockFile(file); err != nil {
+		owner, _ := os.ReadFile(path)
+		file.Close()
+		if errors.Is(err, errLocked) {
+			pid, _ := strconv.Atoi(strings.TrimSpace(string(owner)))
+			return nil, &DirLockedError{Dir: dir, Owner: pid}
+		}
+		return nil, fmt.Errorf("ошибка при блокировке %s: %w", path, err)
+	}
+
+	// Записываем PID владельца, чтобы второй процесс мог его назвать
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &DirLock{file: file}, nil
+}
+
+// Release снимает блокировку. Файл блокировки не удаляется: иначе другой процесс
+// мог бы заблокировать уже удаленный файл.
+func (l *DirLock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
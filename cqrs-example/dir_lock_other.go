@@ -0,0 +1,18 @@
+// dir_lock_other.go
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile на платформах без flock не может заблокировать файл: без явного
+// разрешения лог не открывается, чтобы два писателя не испортили его
+func lockFile(file *os.File) error {
+	return errLockUnsupported
+}
+
+// unlockFile ничего не делает
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+// dispatch.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// cliActor инициатор команд, отправленных из командной строки
+var cliActor = Actor{ID: "cli", Roles: []string{"admin"}}
+
+// runDispatch отправляет одну команду через шину команд и печатает результат.
+// Запускается командой: go run *.go dispatch <команда> '<JSON>', например
+// go run *.go dispatch PayOrder '{"order_id":1}'. Сервер с тем же логом должен быть остановлен.
+func runDispatch(args []string) {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Ошибка в настройках: %v", err)
+	}
+
+	store, err := NewEventStore(config.Store)
+	if err != nil {
+		log.Fatalf("Ошибка при инициализации хранилища событий: %v", err)
+	}
+
+	bus := NewOrderCommandBus(store, CommandBusConfig{
+		ConflictRetries: config.ConflictRetries,
+		Authorization:   config.Authorization,
+		Logger:          slog.Default(),
+	})
+
+	if len(args) != 2 {
+		store.Close()
+		fmt.Printf("Использование: go run *.go dispatch <команда> <JSON>\nКоманды: %s\n",
+			strings.Join(bus.Commands(), ", "))
+		os.Exit(1)
+	}
+
+	result, err := dispatchJSON(bus, args[0], []byte(args[1]))
+
+	// Закрываем хранилище до выхода: log.Fatalf не выполняет отложенные вызовы
+	if closeErr := store.Close(); closeErr != nil {
+		log.Printf("Ошибка при закрытии хранилища событий: %v", closeErr)
+	}
+	if err != nil {
+		log.Fatalf("Команда %s не выполнена: %v", args[0], err)
+	}
+	json.NewEncoder(os.Stdout).Encode(result)
+}
+
+// dispatchJSON разбирает команду из JSON и отправляет ее через шину от имени cliActor
+func dispatchJSON(bus *CommandBus, name string, data []byte) (CommandResult, error) {
+	cmd, err := bus.Decode(name, data)
+	if err != nil {
+		return CommandResult{}, err
+	}
+	correlationID, err := newEventID()
+	if err != nil {
+		return CommandResult{}, err
+	}
+	ctx := WithEventMetadata(WithActor(context.Background(), cliActor), EventMetadata{
+		CorrelationID: correlationID,
+		Source:        SourceCLI,
+	})
+	return bus.Dispatch(ctx, cmd)
+}
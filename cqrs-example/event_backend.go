@@ -0,0 +1,114 @@
+// event_backend.go
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EventBackend хранилище событий, на котором строится EventStore.
+// Все реализации обязаны проходить общий набор проверок (conformance_test.go).
+type EventBackend interface {
+	// Append записывает событие, если версия потока заказа равна expectedVersion
+	// (AnyVersion - без проверки); иначе возвращает *ConcurrencyError
+	Append(event Event, expectedVersion int) error
+	// ReadStream возвращает события заказа после версии fromVersion и текущую версию потока
+	ReadStream(orderID OrderID, fromVersion int) ([]Event, int)
+	// StreamVersion возвращает текущую версию потока событий заказа
+	StreamVersion(orderID OrderID) int
+	// ReadAll читает лог по курсору и фильтрам: события, следующий курсор и признак продолжения
+	ReadAll(query EventQuery) ([]RecordedEvent, int64, bool)
+	// LastPosition возвращает глобальную позицию последнего записанного события
+	LastPosition() int64
+	// Changed возвращает канал, который закроется при записи новых событий
+	Changed() <-chan struct{}
+	// Subscribe подписывает обработчик на события с позицией больше after
+	Subscribe(name string, after int64, options SubscriptionOptions, handler func(record RecordedEvent)) *Subscription
+	// Subscriptions возвращает состояние подписчиков для мониторинга
+	Subscriptions() []SubscriptionStats
+	// Redact скрывает персональные данные владельца subject в уже прочитанных событиях
+	Redact(subject string) (int, error)
+	// EncodeRecorded сериализует записанное событие в DTO
+	EncodeRecorded(record RecordedEvent) (EventDTO, error)
+	// Close дожидается записи принятых событий и закрывает хранилище
+	Close() error
+}
+
+// EventJournal долговременное хранение сериализованных записей лога под EventQueue
+type EventJournal interface {
+	// AppendBatch атомарно дописывает пачку записей в конец журнала
+	AppendBatch(records [][]byte) error
+	// Replay передает обработчику все записи журнала по порядку
+	Replay(handler func(data []byte) error) error
+	// Close сбрасывает записи и закрывает журнал
+	Close() error
+}
+
+// TailJournal журнал, в который может писать другой процесс и запись в который может
+// пройти, несмотря на ошибку (например, при таймауте). После ошибки записи очередь
+// дочитывает его хвост и продолжает принимать события.
+type TailJournal interface {
+	EventJournal
+	// ReadAfter передает обработчику записи с позицией больше position по порядку;
+	// следующая пачка дописывается после последней прочитанной записи
+	ReadAfter(position int64, handler func(data []byte) error) error
+}
+
+// NewEventBackend создает хранилище событий указанного в настройках типа: file, memory или redis
+func NewEventBackend(config EventStoreConfig) (EventBackend, error) {
+	switch config.Backend {
+	case "", "file":
+		return NewEventQueue(config.Log)
+	case "memory":
+		return NewMemoryEventQueue(), nil
+	case "redis":
+		return NewRedisEventQueue(config.RedisAddr, config.RedisStream)
+	}
+	return nil, fmt.Errorf("неизвестное хранилище событий: %q (ожидается file, memory или redis)", config.Backend)
+}
+
+// NewMemoryEventQueue создает очередь событий, которая хранит события только в памяти процесса
+func NewMemoryEventQueue() *EventQueue {
+	queue, err := newEventQueue(&MemoryJournal{})
+	if err != nil {
+		// Пустой журнал в памяти загружается без ошибок
+		panic(err)
+	}
+	return queue
+}
+
+// MemoryJournal журнал в памяти: записи теряются при остановке процесса
+type MemoryJournal struct {
+	records [][]byte
+	mu      sync.Mutex
+}
+
+// AppendBatch добавляет записи в память
+func (j *MemoryJournal) AppendBatch(records [][]byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, record := range records {
+		j.records = append(j.records, append([]byte(nil), record...))
+	}
+	return nil
+}
+
+// Replay передает обработчику сохраненные записи
+func (j *MemoryJournal) Replay(handler func(data []byte) error) error {
+	j.mu.Lock()
+	records := append([][]byte(nil), j.records...)
+	j.mu.Unlock()
+
+	for _, record := range records {
+		if err := handler(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ничего не делает
+func (j *MemoryJournal) Close() error {
+	return nil
+}
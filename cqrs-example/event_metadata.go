@@ -0,0 +1,85 @@
+// event_metadata.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Источники событий
+const (
+	SourceHTTP           = "http"
+	SourceCLI            = "cli"
+	SourcePaymentTimeout = "payment-timeout"
+)
+
+// Заголовки с идентификаторами запроса для трассировки
+const (
+	requestIDHeader     = "X-Request-ID"     // ID запроса
+	correlationIDHeader = "X-Correlation-ID" // ID цепочки запросов
+	traceparentHeader   = "traceparent"      // Контекст трассировки W3C Trace Context
+)
+
+// traceparentPattern формат заголовка traceparent: версия-trace_id-parent_id-флаги
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// EventMetadata сведения о происхождении события. Хранятся в конверте записи лога
+// рядом с ID события и не входят в данные события.
+type EventMetadata struct {
+	CorrelationID string `json:"correlation_id,omitempty"` // ID цепочки: общий для всех событий одного исходного запроса
+	CausationID   string `json:"causation_id,omitempty"`   // ID запроса или события, непосредственно вызвавшего это событие
+	ActorID       string `json:"actor_id,omitempty"`       // Инициатор команды
+	Source        string `json:"source,omitempty"`         // Источник: http, cli, payment-timeout
+}
+
+// eventMetadataContextKey ключ метаданных событий в контексте
+type eventMetadataContextKey struct{}
+
+// WithEventMetadata возвращает контекст с метаданными для событий, записанных командой
+func WithEventMetadata(ctx context.Context, metadata EventMetadata) context.Context {
+	return context.WithValue(ctx, eventMetadataContextKey{}, metadata)
+}
+
+// EventMetadataFromContext возвращает метаданные событий из контекста.
+// Инициатор берется из контекста команды, если он не задан в метаданных явно.
+func EventMetadataFromContext(ctx context.Context) EventMetadata {
+	metadata, _ := ctx.Value(eventMetadataContextKey{}).(EventMetadata)
+	if metadata.ActorID == "" {
+		metadata.ActorID = ActorFromContext(ctx).ID
+	}
+	return metadata
+}
+
+// newBaseEvent создает основу события заказа с текущим временем и метаданными из контекста команды
+func newBaseEvent(ctx context.Context, orderID OrderID) BaseEvent {
+	return BaseEvent{
+		OrderID:   orderID,
+		Timestamp: time.Now(),
+		Metadata:  EventMetadataFromContext(ctx),
+	}
+}
+
+// requestEventMetadata собирает метаданные событий из заголовков HTTP запроса.
+// Причина события - сам запрос (X-Request-ID или новый ID). Цепочку задает trace_id
+// из traceparent, затем X-Correlation-ID; без них цепочка начинается с этого запроса.
+func requestEventMetadata(r *http.Request) EventMetadata {
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID, _ = newEventID()
+	}
+
+	metadata := EventMetadata{
+		CorrelationID: r.Header.Get(correlationIDHeader),
+		CausationID:   requestID,
+		Source:        SourceHTTP,
+	}
+	if match := traceparentPattern.FindStringSubmatch(r.Header.Get(traceparentHeader)); match != nil {
+		metadata.CorrelationID = match[1]
+	}
+	if metadata.CorrelationID == "" {
+		metadata.CorrelationID = requestID
+	}
+	return metadata
+}
@@ -3,91 +3,320 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"log"
 	"sync"
-	"time"
 )
 
 // EventQueue представляет очередь событий с возможностью их сохранения и загрузки
 type EventQueue struct {
-	events     []Event          // Сама очередь событий
-	mu         sync.RWMutex     // Мьютекс для безопасного доступа
-	logFile    string           // Путь к файлу для хранения событий
-	subscribers []func(Event)   // Подписчики на новые события
+	events      []RecordedEvent   // Сама очередь событий в порядке глобальных позиций
+	mu          sync.RWMutex      // Мьютекс для безопасного доступа
+	journal     EventJournal      // Журнал для хранения событий
+	subscribers []*Subscription   // Подписчики на новые события
+	streams     map[OrderID][]int // Индекс: позиции событий каждого заказа в очереди
+	registry    *EventRegistry    // Реестр типов событий для сериализации
+
+	pending      map[OrderID]int     // События заказов, переданные писателю, но еще не записанные
+	nextPosition int64               // Глобальная позиция следующего принятого события
+	changed      chan struct{}       // Закрывается при записи очередной пачки событий
+	submitMu     sync.Mutex          // Сохраняет порядок резервирования версий и передачи писателю
+	appends      chan *appendRequest // Запросы на запись для писателя
+	closed       bool                // Очередь закрыта и не принимает события
+	failed       error               // Ошибка записи в журнал, после которой очередь не принимает события
+	stopped      chan struct{}       // Писатель завершил работу
 }
 
-// NewEventQueue создает новую очередь событий
-func NewEventQueue(logFilePath string) (*EventQueue, error) {
+// NewEventQueue создает очередь событий поверх сегментированного лога в файлах
+func NewEventQueue(config LogConfig) (*EventQueue, error) {
+	// Открываем журнал, обрезая оборванный при сбое хвост
+	eventLog, report, err := OpenSegmentedLog(config)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при открытии лога событий: %w", err)
+	}
+	if report != nil {
+		log.Printf("Обнаружен оборванный хвост лога: сегмент %s обрезан до %d байт, отброшено %d байт: %q",
+			report.Segment, report.Offset, report.DiscardedBytes, report.DiscardedTail)
+	}
+
+	return newEventQueue(eventLog)
+}
+
+// newEventQueue создает очередь событий поверх журнала и загружает из него события.
+// При ошибке журнал закрывается.
+func newEventQueue(journal EventJournal) (*EventQueue, error) {
 	queue := &EventQueue{
-		events:      make([]Event, 0),
-		logFile:     logFilePath,
-		subscribers: make([]func(Event), 0),
+		events:      make([]RecordedEvent, 0),
+		journal:     journal,
+		subscribers: make([]*Subscription, 0),
+		streams:     make(map[OrderID][]int),
+		registry:    eventRegistry,
+		pending:     make(map[OrderID]int),
+		changed:     make(chan struct{}),
+		appends:     make(chan *appendRequest, maxCommitBatch),
+		stopped:     make(chan struct{}),
 	}
 
-	// Загружаем события из файла, если он существует
+	// Загружаем события из журнала
 	err := queue.loadEventsFromLog()
-	if err != nil && !os.IsNotExist(err) {
+	if err != nil {
+		journal.Close()
 		return nil, fmt.Errorf("ошибка при загрузке событий из лога: %w", err)
 	}
 
+	queue.nextPosition = int64(len(queue.events)) + 1
+
+	// Запускаем писателя, объединяющего одновременные записи в пачки
+	go queue.writeLoop()
+
 	return queue, nil
 }
 
-// Subscribe подписывает обработчик на новые события
-func (q *EventQueue) Subscribe(handler func(Event)) {
-	q.mu.Lock()
-	defer q.mu.Unlock()
-	q.subscribers = append(q.subscribers, handler)
+// Close дожидается записи принятых событий, сбрасывает журнал на диск и закрывает его
+func (q *EventQueue) Close() error {
+	q.submitMu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.appends)
+	}
+	q.submitMu.Unlock()
+
+	<-q.stopped
+
+	// Дожидаемся, пока подписчики обработают уже доставленные события
+	q.mu.RLock()
+	subscribers := append([]*Subscription(nil), q.subscribers...)
+	q.mu.RUnlock()
+	for _, sub := range subscribers {
+		sub.stop()
+	}
+
+	return q.journal.Close()
 }
 
-// Enqueue добавляет событие в очередь и записывает его в лог
-func (q *EventQueue) Enqueue(event Event) error {
-	q.mu.Lock()
-	defer q.mu.Unlock()
+// Append добавляет событие в очередь и записывает его в лог.
+// Если expectedVersion не равен AnyVersion, событие добавляется только тогда,
+// когда текущая версия потока заказа совпадает с ожидаемой.
+// Метод возвращается после того, как пачка с событием записана в журнал.
+func (q *EventQueue) Append(event Event, expectedVersion int) error {
+	// Сериализуем событие до резервирования версии
+	dto, err := q.registry.Encode(event)
+	if err == nil {
+		dto, err = q.registry.Seal(dto)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка при записи события в лог: %w", err)
+	}
+	eventID, err := newEventID()
+	if err != nil {
+		return err
+	}
 
-	// Добавляем событие в очередь
-	q.events = append(q.events, event)
+	// Резервируем версию и позицию и передаем запрос писателю в одном порядке,
+	// чтобы события попали в журнал в порядке проверки версий и выдачи позиций
+	q.submitMu.Lock()
+	if q.closed {
+		q.submitMu.Unlock()
+		return errors.New("очередь событий закрыта")
+	}
+
+	q.mu.Lock()
+	if q.failed != nil {
+		// Позиции после неудачной пачки уже выданы: новая запись оставила бы пропуск в логе.
+		// Журнал, который можно дочитать, восстанавливает позицию по своему хвосту.
+		q.mu.Unlock()
+		if err := q.resume(); err != nil {
+			q.submitMu.Unlock()
+			return fmt.Errorf("лог событий недоступен после ошибки записи: %w", err)
+		}
+		q.mu.Lock()
+	}
+	orderID := event.GetOrderID()
+	currentVersion := len(q.streams[orderID]) + q.pending[orderID]
+	if expectedVersion != AnyVersion && expectedVersion != currentVersion {
+		q.mu.Unlock()
+		q.submitMu.Unlock()
+		return &ConcurrencyError{
+			OrderID:         orderID,
+			ExpectedVersion: expectedVersion,
+			ActualVersion:   currentVersion,
+		}
+	}
+	q.pending[orderID]++
+	q.mu.Unlock()
 
-	// Сохраняем событие в лог
-	err := q.appendEventToLog(event)
+	record := RecordedEvent{
+		Position: q.nextPosition,
+		EventID:  eventID,
+		Event:    event,
+	}
+	dto.Position = record.Position
+	dto.EventID = record.EventID
+	data, err := json.Marshal(dto)
 	if err != nil {
+		q.mu.Lock()
+		q.pending[orderID]--
+		q.mu.Unlock()
+		q.submitMu.Unlock()
+		return fmt.Errorf("ошибка при записи события в лог: %w", err)
+	}
+	q.nextPosition++
+
+	request := &appendRequest{
+		record: record,
+		data:   data,
+		done:   make(chan error, 1),
+	}
+	q.appends <- request
+	q.submitMu.Unlock()
+
+	// Ждем подтверждения записи от писателя
+	if err := <-request.done; err != nil {
 		return fmt.Errorf("ошибка при записи события в лог: %w", err)
 	}
+	return nil
+}
 
-	// Уведомляем подписчиков о новом событии
-	for _, handler := range q.subscribers {
-		go handler(event)
+// resume выводит очередь из состояния отказа: писатель отклоняет запросы, принятые
+// до ошибки, и дочитывает хвост журнала, после чего позиции выдаются с его конца.
+// Вызывается под submitMu, поэтому новых запросов в это время нет.
+func (q *EventQueue) resume() error {
+	if _, ok := q.journal.(TailJournal); !ok {
+		q.mu.RLock()
+		defer q.mu.RUnlock()
+		return fmt.Errorf("%w (перезапустите сервис)", q.failed)
 	}
 
+	request := &appendRequest{resync: true, done: make(chan error, 1)}
+	q.appends <- request
+	if err := <-request.done; err != nil {
+		return err
+	}
+
+	q.mu.RLock()
+	q.nextPosition = int64(len(q.events)) + 1
+	q.mu.RUnlock()
 	return nil
 }
 
-// GetAll возвращает все события из очереди
-func (q *EventQueue) GetAll() []Event {
+// ReadAll возвращает события с позицией больше query.After, подходящие под фильтры,
+// не более query.Limit штук. next - позиция, до которой лог просмотрен (курсор для
+// следующего чтения), hasMore сообщает, что подходящие события еще остались.
+func (q *EventQueue) ReadAll(query EventQuery) (events []RecordedEvent, next int64, hasMore bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	events = make([]RecordedEvent, 0)
+	next = max(query.After, 0)
+	match := func(record RecordedEvent) bool {
+		if query.Type != "" && record.Event.GetType() != query.Type {
+			return false
+		}
+		if query.OrderID != "" && record.Event.GetOrderID() != query.OrderID {
+			return false
+		}
+		return true
+	}
+
+	// Для фильтра по заказу идем по индексу потока, иначе - с позиции курсора
+	var candidates []int
+	if query.OrderID != "" {
+		candidates = q.streams[query.OrderID]
+	} else {
+		start := int(min(next, int64(len(q.events))))
+		candidates = make([]int, 0, len(q.events)-start)
+		for index := start; index < len(q.events); index++ {
+			candidates = append(candidates, index)
+		}
+	}
+
+	for _, index := range candidates {
+		record := q.events[index]
+		if record.Position <= query.After || !match(record) {
+			continue
+		}
+		if query.Limit > 0 && len(events) == query.Limit {
+			return events, next, true
+		}
+		events = append(events, record)
+		next = record.Position
+	}
+
+	// Подходящих событий больше нет: курсор переносим в конец лога
+	next = max(next, int64(len(q.events)))
+	return events, next, false
+}
+
+// Changed возвращает канал, который закроется при записи следующей пачки событий.
+// Канал нужно получить до чтения лога, чтобы не пропустить запись между чтением и ожиданием.
+func (q *EventQueue) Changed() <-chan struct{} {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.changed
+}
+
+// LastPosition возвращает глобальную позицию последнего записанного события
+func (q *EventQueue) LastPosition() int64 {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
+	return int64(len(q.events))
+}
 
-	// Создаем копию слайса событий
-	result := make([]Event, len(q.events))
-	copy(result, q.events)
+// ReadStream возвращает события заказа, добавленные после версии fromVersion,
+// и текущую версию потока
+func (q *EventQueue) ReadStream(orderID OrderID, fromVersion int) ([]Event, int) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
 
-	return result
+	positions := q.streams[orderID]
+	if fromVersion < 0 {
+		fromVersion = 0
+	}
+	if fromVersion > len(positions) {
+		fromVersion = len(positions)
+	}
+
+	result := make([]Event, 0, len(positions)-fromVersion)
+	for _, position := range positions[fromVersion:] {
+		result = append(result, q.events[position].Event)
+	}
+
+	return result, len(positions)
 }
 
-// GetByOrderID возвращает все события для указанного заказа
-func (q *EventQueue) GetByOrderID(orderID int) []Event {
+// StreamVersion возвращает текущую версию потока событий заказа
+func (q *EventQueue) StreamVersion(orderID OrderID) int {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
+	return len(q.streams[orderID])
+}
+
+// Redact заменяет в памяти персональные данные владельца subject на RedactedValue
+// и возвращает количество измененных событий. В журнале данные остаются зашифрованными.
+func (q *EventQueue) Redact(subject string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
 
-	result := make([]Event, 0)
-	for _, event := range q.events {
-		if event.GetOrderID() == orderID {
-			result = append(result, event)
+	redacted := 0
+	for i, record := range q.events {
+		event, changed, err := q.registry.Redact(record.Event, subject)
+		if err != nil {
+			return redacted, err
+		}
+		if changed {
+			q.events[i].Event = event
+			redacted++
 		}
 	}
+	return redacted, nil
+}
 
-	return result
+// addEvent добавляет событие в очередь и индекс потоков (вызывается под блокировкой)
+func (q *EventQueue) addEvent(record RecordedEvent) {
+	orderID := record.Event.GetOrderID()
+	q.streams[orderID] = append(q.streams[orderID], len(q.events))
+	q.events = append(q.events, record)
 }
 
 // Сериализация событий для хранения
@@ -95,131 +324,74 @@ func (q *EventQueue) GetByOrderID(orderID int) []Event {
 // EventDTO структура для сериализации событий
 type EventDTO struct {
 	Type      string          `json:"type"`
-	OrderID   int             `json:"order_id"`
+	Version   int             `json:"version,omitempty"`  // Версия схемы данных (0 - запись до версионирования)
+	Position  int64           `json:"position,omitempty"` // Глобальная позиция в логе
+	EventID   string          `json:"event_id,omitempty"` // Уникальный ID события
+	OrderID   OrderID         `json:"order_id"`
 	Timestamp string          `json:"timestamp"`
+	Metadata  *EventMetadata  `json:"metadata,omitempty"` // Происхождение события (нет у старых записей)
 	Data      json.RawMessage `json:"data"`
 }
 
-// appendEventToLog сохраняет событие в лог-файл
-func (q *EventQueue) appendEventToLog(event Event) error {
-	// Открываем файл для добавления
-	file, err := os.OpenFile(q.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// EncodeRecorded сериализует записанное событие в DTO, например для выдачи по HTTP
+func (q *EventQueue) EncodeRecorded(record RecordedEvent) (EventDTO, error) {
+	dto, err := q.registry.Encode(record.Event)
 	if err != nil {
-		return err
+		return EventDTO{}, err
 	}
-	defer file.Close()
-
-	// Сериализуем событие в зависимости от его типа
-	var data []byte
-	var eventType string
+	dto.Position = record.Position
+	dto.EventID = record.EventID
+	return dto, nil
+}
 
-	switch e := event.(type) {
-	case OrderCreatedEvent:
-		eventType = "OrderCreated"
-		data, err = json.Marshal(e)
-	case OrderPaidEvent:
-		eventType = "OrderPaid"
-		data, err = json.Marshal(e)
-	case OrderCancelledEvent:
-		eventType = "OrderCancelled"
-		data, err = json.Marshal(e)
-	default:
-		return fmt.Errorf("неизвестный тип события: %T", e)
-	}
+// loadEventsFromLog загружает события из журнала
+func (q *EventQueue) loadEventsFromLog() error {
+	q.events = make([]RecordedEvent, 0)
+	q.streams = make(map[OrderID][]int)
+	unknown := 0
 
+	err := q.journal.Replay(func(data []byte) error {
+		record, err := q.decodeRecord(data, int64(len(q.events))+1)
+		if err != nil {
+			return err
+		}
+		if _, ok := record.Event.(RawEvent); ok {
+			unknown++
+		}
+		q.addEvent(record)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	// Создаем DTO для сохранения
-	dto := EventDTO{
-		Type:      eventType,
-		OrderID:   event.GetOrderID(),
-		Timestamp: event.GetTimestamp(),
-		Data:      data,
-	}
-
-	// Сериализуем DTO в JSON
-	jsonData, err := json.Marshal(dto)
-	if err != nil {
-		return err
+	if unknown > 0 {
+		log.Printf("В логе найдено %d событий неизвестных типов, они сохранены без разбора", unknown)
 	}
 
-	// Записываем событие в файл
-	_, err = file.Write(append(jsonData, '\n'))
-	return err
+	return nil
 }
 
-// loadEventsFromLog загружает события из лог-файла
-func (q *EventQueue) loadEventsFromLog() error {
-	// Проверяем существование файла
-	_, err := os.Stat(q.logFile)
-	if os.IsNotExist(err) {
-		return err // Файл не существует, это не ошибка
+// decodeRecord разбирает запись журнала, которая должна оказаться на позиции position
+func (q *EventQueue) decodeRecord(data []byte, position int64) (RecordedEvent, error) {
+	var dto EventDTO
+	if err := json.Unmarshal(data, &dto); err != nil {
+		return RecordedEvent{}, err
 	}
 
-	// Открываем файл для чтения
-	file, err := os.Open(q.logFile)
+	// Десериализуем событие через реестр типов событий
+	event, err := q.registry.Decode(dto)
 	if err != nil {
-		return err
+		return RecordedEvent{}, fmt.Errorf("ошибка при разборе события %s: %w", dto.Type, err)
 	}
-	defer file.Close()
-
-	// Читаем файл построчно
-	decoder := json.NewDecoder(file)
 
-	q.events = make([]Event, 0)
-
-	for decoder.More() {
-		var dto EventDTO
-		if err := decoder.Decode(&dto); err != nil {
-			return err
-		}
-
-		// Десериализуем событие в зависимости от его типа
-		var event Event
-
-		switch dto.Type {
-		case "OrderCreated":
-			var e OrderCreatedEvent
-			if err := json.Unmarshal(dto.Data, &e); err != nil {
-				return err
-			}
-			// Восстанавливаем время из строки
-			t, err := time.Parse(time.RFC3339, dto.Timestamp)
-			if err != nil {
-				return err
-			}
-			e.Timestamp = t
-			event = e
-		case "OrderPaid":
-			var e OrderPaidEvent
-			if err := json.Unmarshal(dto.Data, &e); err != nil {
-				return err
-			}
-			t, err := time.Parse(time.RFC3339, dto.Timestamp)
-			if err != nil {
-				return err
-			}
-			e.Timestamp = t
-			event = e
-		case "OrderCancelled":
-			var e OrderCancelledEvent
-			if err := json.Unmarshal(dto.Data, &e); err != nil {
-				return err
-			}
-			t, err := time.Parse(time.RFC3339, dto.Timestamp)
-			if err != nil {
-				return err
-			}
-			e.Timestamp = t
-			event = e
-		default:
-			return fmt.Errorf("неизвестный тип события: %s", dto.Type)
-		}
-
-		q.events = append(q.events, event)
+	// Записи до введения позиций получают позицию по порядку в логе
+	if dto.Position != 0 && dto.Position != position {
+		return RecordedEvent{}, fmt.Errorf("нарушен порядок позиций: ожидалась %d, в логе %d", position, dto.Position)
 	}
-
-	return nil
+	eventID := dto.EventID
+	if eventID == "" {
+		eventID = legacyEventID(position)
+	}
+	return RecordedEvent{Position: position, EventID: eventID, Event: event}, nil
 }
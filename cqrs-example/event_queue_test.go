@@ -0,0 +1,190 @@
+// event_queue_test.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// flakyJournal журнал в памяти, который можно дочитать (как поток Redis) и который
+// отказывает в записи по требованию. Как и скрипт Redis, отклоняет пачку, если ее
+// первая позиция не следует за концом журнала.
+type flakyJournal struct {
+	records [][]byte
+	fail    error // Ошибка следующей записи
+	persist bool  // Записать пачку, несмотря на ошибку: ответ потерян после записи
+	mu      sync.Mutex
+}
+
+func (j *flakyJournal) AppendBatch(records [][]byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var first EventDTO
+	if err := json.Unmarshal(records[0], &first); err != nil {
+		return err
+	}
+	if first.Position != int64(len(j.records))+1 {
+		return fmt.Errorf("POSITION %d", len(j.records))
+	}
+	err := j.fail
+	j.fail = nil
+	if err == nil || j.persist {
+		j.records = append(j.records, records...)
+	}
+	return err
+}
+
+func (j *flakyJournal) Replay(handler func(data []byte) error) error {
+	return j.ReadAfter(0, handler)
+}
+
+func (j *flakyJournal) ReadAfter(position int64, handler func(data []byte) error) error {
+	j.mu.Lock()
+	records := append([][]byte(nil), j.records[position:]...)
+	j.mu.Unlock()
+
+	for _, record := range records {
+		if err := handler(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *flakyJournal) Close() error {
+	return nil
+}
+
+// write дописывает событие в журнал в обход очереди, как другой процесс
+func (j *flakyJournal) write(t *testing.T, event Event) {
+	dto, err := eventRegistry.Encode(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Lock()
+	dto.Position = int64(len(j.records)) + 1
+	dto.EventID = fmt.Sprintf("foreign-%d", dto.Position)
+	j.mu.Unlock()
+
+	data, err := json.Marshal(dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Lock()
+	j.records = append(j.records, data)
+	j.mu.Unlock()
+}
+
+// fatalJournal журнал без дочитывания хвоста (как файловый лог)
+type fatalJournal struct {
+	MemoryJournal
+	fail error
+}
+
+func (j *fatalJournal) AppendBatch(records [][]byte) error {
+	if err := j.fail; err != nil {
+		j.fail = nil
+		return err
+	}
+	return j.MemoryJournal.AppendBatch(records)
+}
+
+func TestEventQueueRecoversAfterFailedBatch(t *testing.T) {
+	errTimeout := errors.New("i/o timeout")
+
+	tests := []struct {
+		name string
+		// broken записывает событие заказа #1 так, что Append возвращает ошибку
+		broken func(t *testing.T, journal *flakyJournal, queue *EventQueue)
+		// next следующее событие: должно записаться на позицию position
+		next     Event
+		version  int
+		position int64
+	}{
+		{
+			name: "пачка не записана",
+			broken: func(t *testing.T, journal *flakyJournal, queue *EventQueue) {
+				journal.fail = errTimeout
+				if err := queue.Append(conformanceCreated("1"), NoStream); err == nil {
+					t.Fatal("ожидалась ошибка записи")
+				}
+			},
+			next:     conformanceCreated("1"),
+			version:  NoStream,
+			position: 1,
+		},
+		{
+			name: "пачка записана, ответ потерян",
+			broken: func(t *testing.T, journal *flakyJournal, queue *EventQueue) {
+				journal.fail, journal.persist = errTimeout, true
+				if err := queue.Append(conformanceCreated("1"), NoStream); err == nil {
+					t.Fatal("ожидалась ошибка записи")
+				}
+			},
+			next:     conformancePaid("1"),
+			version:  1,
+			position: 2,
+		},
+		{
+			name: "в журнал записал другой процесс",
+			broken: func(t *testing.T, journal *flakyJournal, queue *EventQueue) {
+				journal.write(t, conformanceCreated("1"))
+				if err := queue.Append(conformanceCreated("2"), NoStream); err == nil {
+					t.Fatal("ожидалась ошибка позиции")
+				}
+			},
+			next:     conformancePaid("1"),
+			version:  1,
+			position: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			journal := &flakyJournal{}
+			queue, err := newEventQueue(journal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer queue.Close()
+
+			test.broken(t, journal, queue)
+			if err := queue.Append(test.next, test.version); err != nil {
+				t.Fatalf("запись после ошибки: %v", err)
+			}
+
+			if last := queue.LastPosition(); last != test.position {
+				t.Fatalf("последняя позиция %d, ожидалась %d", last, test.position)
+			}
+			records, _, _ := queue.ReadAll(EventQuery{})
+			for i, record := range records {
+				if record.Position != int64(i+1) {
+					t.Fatalf("событие %d на позиции %d: в логе пропуск", i, record.Position)
+				}
+			}
+			if len(journal.records) != len(records) {
+				t.Fatalf("в журнале %d записей, в очереди %d", len(journal.records), len(records))
+			}
+		})
+	}
+}
+
+func TestEventQueueStaysFailedWithoutTailJournal(t *testing.T) {
+	journal := &fatalJournal{fail: errors.New("disk full")}
+	queue, err := newEventQueue(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	if err := queue.Append(conformanceCreated("1"), NoStream); err == nil {
+		t.Fatal("ожидалась ошибка записи")
+	}
+	if err := queue.Append(conformanceCreated("2"), NoStream); err == nil {
+		t.Fatal("после ошибки записи файлового журнала очередь должна отклонять события")
+	}
+}
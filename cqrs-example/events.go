@@ -2,24 +2,28 @@
 package main
 
 import (
+	"crypto/rand"
+	"fmt"
 	"time"
 )
 
 // Event интерфейс для всех событий
 type Event interface {
-	GetOrderID() int      // Получение ID заказа
-	GetType() string      // Получение типа события
-	GetTimestamp() string // Получение времени события
+	GetOrderID() OrderID        // Получение ID заказа
+	GetType() string            // Получение типа события
+	GetTimestamp() string       // Получение времени события
+	GetMetadata() EventMetadata // Получение метаданных происхождения события
 }
 
 // BaseEvent базовая структура для всех событий
 type BaseEvent struct {
-	OrderID   int       // ID заказа
-	Timestamp time.Time // Время события
+	OrderID   OrderID       // ID заказа
+	Timestamp time.Time     // Время события
+	Metadata  EventMetadata `json:"-"` // Происхождение события (хранится в конверте записи)
 }
 
 // GetOrderID возвращает ID заказа
-func (e BaseEvent) GetOrderID() int {
+func (e BaseEvent) GetOrderID() OrderID {
 	return e.OrderID
 }
 
@@ -28,11 +32,84 @@ func (e BaseEvent) GetTimestamp() string {
 	return e.Timestamp.Format(time.RFC3339)
 }
 
-// OrderCreatedEvent событие создания заказа
+// GetMetadata возвращает метаданные происхождения события
+func (e BaseEvent) GetMetadata() EventMetadata {
+	return e.Metadata
+}
+
+// restoreBase заполняет поля, отсутствующие в данных события, значениями из конверта записи
+func (e *BaseEvent) restoreBase(base BaseEvent) {
+	if e.OrderID == "" {
+		e.OrderID = base.OrderID
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = base.Timestamp
+	}
+	if e.Metadata == (EventMetadata{}) {
+		e.Metadata = base.Metadata
+	}
+}
+
+// Регистрируем типы событий заказа в реестре
+func init() {
+	mustRegister(RegisterJSONEvent[OrderCreatedEvent](eventRegistry, upcastOrderCreatedV1))
+	mustRegister(RegisterJSONEvent[OrderPaidEvent](eventRegistry))
+	mustRegister(RegisterJSONEvent[OrderCancelledEvent](eventRegistry))
+	mustRegister(RegisterJSONEvent[OrderShippedEvent](eventRegistry))
+	mustRegister(RegisterJSONEvent[OrderDeliveredEvent](eventRegistry))
+	mustRegister(RegisterJSONEvent[OrderRefundedEvent](eventRegistry))
+
+	// ID клиента - персональные данные: шифруются ключом клиента и удаляются вместе с ним
+	mustRegister(eventRegistry.MarkPersonalData("OrderCreated", "CustomerID"))
+}
+
+// RecordedEvent событие, записанное в лог, с его глобальной позицией и уникальным ID
+type RecordedEvent struct {
+	Position int64  // Глобальная позиция в логе (начиная с 1)
+	EventID  string // Уникальный ID события
+	Event    Event  // Само событие
+}
+
+// EventQuery параметры чтения событий из лога
+type EventQuery struct {
+	After   int64   // Вернуть события с позицией больше After
+	Limit   int     // Максимальное количество событий (0 - без ограничения)
+	Type    string  // Фильтр по типу события
+	OrderID OrderID // Фильтр по ID заказа ("" - все заказы)
+}
+
+// newEventID генерирует уникальный ID события в формате UUID v4
+func newEventID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("ошибка при генерации ID события: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// legacyEventID возвращает стабильный ID для событий, записанных до введения ID
+func legacyEventID(position int64) string {
+	return fmt.Sprintf("legacy-%d", position)
+}
+
+// OrderItem позиция заказа
+type OrderItem struct {
+	Name     string // Название товара
+	Quantity int    // Количество
+}
+
+// String возвращает позицию заказа в текстовом виде
+func (i OrderItem) String() string {
+	return fmt.Sprintf("%s x%d", i.Name, i.Quantity)
+}
+
+// OrderCreatedEvent событие создания заказа (версия схемы 2)
 type OrderCreatedEvent struct {
 	BaseEvent
-	CustomerID string   // ID клиента
-	Items      []string // Список товаров в заказе
+	CustomerID string      // ID клиента
+	Items      []OrderItem // Позиции заказа
 }
 
 // GetType возвращает тип события
@@ -61,14 +138,47 @@ func (e OrderCancelledEvent) GetType() string {
 	return "OrderCancelled"
 }
 
+// OrderShippedEvent событие отправки заказа
+type OrderShippedEvent struct {
+	BaseEvent
+	TrackingNumber string // Трек-номер отправления
+}
+
+// GetType возвращает тип события
+func (e OrderShippedEvent) GetType() string {
+	return "OrderShipped"
+}
+
+// OrderDeliveredEvent событие доставки заказа
+type OrderDeliveredEvent struct {
+	BaseEvent
+}
+
+// GetType возвращает тип события
+func (e OrderDeliveredEvent) GetType() string {
+	return "OrderDelivered"
+}
+
+// OrderRefundedEvent событие возврата оплаты заказа
+type OrderRefundedEvent struct {
+	BaseEvent
+	Reason string // Причина возврата
+}
+
+// GetType возвращает тип события
+func (e OrderRefundedEvent) GetType() string {
+	return "OrderRefunded"
+}
+
 // OrderState представляет текущее состояние заказа
 type OrderState struct {
-	ID         int       // ID заказа
-	CustomerID string    // ID клиента
-	Items      []string  // Товары
-	Status     string    // Статус (created, paid, cancelled)
-	CreateTime time.Time // Время создания
-	UpdateTime time.Time // Время последнего обновления
+	ID             OrderID     // ID заказа
+	CustomerID     string      // ID клиента
+	Items          []OrderItem // Позиции заказа
+	Status         string      // Статус (created, paid, shipped, delivered, cancelled, refunded)
+	TrackingNumber string      // Трек-номер отправления
+	CreateTime     time.Time   // Время создания
+	UpdateTime     time.Time   // Время последнего обновления
 }
 
 // buildOrderState восстанавливает состояние заказа из списка событий
@@ -80,7 +190,7 @@ func buildOrderState(events []Event) *OrderState {
 	// Начальное состояние
 	state := &OrderState{
 		ID:     events[0].GetOrderID(),
-		Status: "unknown",
+		Status: StatusUnknown,
 	}
 
 	// Применяем все события последовательно
@@ -91,23 +201,36 @@ func buildOrderState(events []Event) *OrderState {
 	return state
 }
 
-// applyEvent применяет событие к состоянию заказа
+// applyEvent применяет событие к состоянию заказа.
+// Статус после события берется из таблицы переходов orderStateMachine,
+// здесь применяются только данные событий.
 func applyEvent(state *OrderState, event Event) {
+	if status, found := orderStateMachine.StatusAfter(event.GetType()); found {
+		state.Status = status
+	}
+
 	switch e := event.(type) {
 	case OrderCreatedEvent:
 		// Применяем событие создания
 		state.CustomerID = e.CustomerID
 		state.Items = e.Items
-		state.Status = "created"
 		state.CreateTime = e.Timestamp
 		state.UpdateTime = e.Timestamp
 	case OrderPaidEvent:
 		// Применяем событие оплаты
-		state.Status = "paid"
 		state.UpdateTime = e.Timestamp
 	case OrderCancelledEvent:
 		// Применяем событие отмены
-		state.Status = "cancelled"
+		state.UpdateTime = e.Timestamp
+	case OrderShippedEvent:
+		// Применяем событие отправки
+		state.TrackingNumber = e.TrackingNumber
+		state.UpdateTime = e.Timestamp
+	case OrderDeliveredEvent:
+		// Применяем событие доставки
+		state.UpdateTime = e.Timestamp
+	case OrderRefundedEvent:
+		// Применяем событие возврата оплаты
 		state.UpdateTime = e.Timestamp
 	}
 }
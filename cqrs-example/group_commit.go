@@ -0,0 +1,166 @@
+// group_commit.go
+package main
+
+import (
+	"log"
+	"runtime"
+)
+
+// maxCommitBatch максимальное количество событий в одной пачке записи
+const maxCommitBatch = 256
+
+// appendRequest запрос на запись события, ожидающий подтверждения
+type appendRequest struct {
+	record RecordedEvent // Событие с позицией и ID
+	data   []byte        // Сериализованная запись журнала
+	resync bool          // Дочитать хвост журнала после ошибки записи вместо записи события
+	done   chan error    // Результат записи пачки
+}
+
+// writeLoop долгоживущий писатель очереди: собирает одновременные запросы в пачку,
+// записывает ее в журнал одной операцией с одним fsync, добавляет события в память
+// в порядке записи и подтверждает каждый запрос
+func (q *EventQueue) writeLoop() {
+	defer close(q.stopped)
+
+	batch := make([]*appendRequest, 0, maxCommitBatch)
+	records := make([][]byte, 0, maxCommitBatch)
+
+	for request := range q.appends {
+		if request.resync {
+			request.done <- q.resync()
+			continue
+		}
+
+		// Даем готовым к работе писателям передать свои запросы и забираем
+		// все накопившееся за время записи предыдущей пачки
+		batch = append(batch[:0], request)
+		runtime.Gosched()
+		var resync *appendRequest
+	collect:
+		for len(batch) < maxCommitBatch {
+			select {
+			case next, ok := <-q.appends:
+				if !ok {
+					break collect
+				}
+				if next.resync {
+					resync = next
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		// После ошибки записи пачки позиции последующих запросов уже выданы,
+		// поэтому они не записываются: иначе в логе появился бы пропуск позиций
+		q.mu.RLock()
+		err := q.failed
+		q.mu.RUnlock()
+		if err == nil {
+			records = records[:0]
+			for _, request := range batch {
+				records = append(records, request.data)
+			}
+			err = q.journal.AppendBatch(records)
+		}
+
+		q.commitBatch(batch, err)
+		if resync != nil {
+			resync.done <- q.resync()
+		}
+	}
+}
+
+// resync дочитывает хвост журнала после ошибки записи и снимает состояние отказа.
+// Записи, которые прошли несмотря на ошибку или были сделаны другим процессом,
+// добавляются в очередь и передаются подписчикам. Выполняется писателем, когда все
+// запросы с позициями, выданными до ошибки, уже отклонены.
+func (q *EventQueue) resync() error {
+	journal, ok := q.journal.(TailJournal)
+	if !ok {
+		return q.failed
+	}
+
+	q.mu.RLock()
+	last := int64(len(q.events))
+	q.mu.RUnlock()
+
+	var records []RecordedEvent
+	err := journal.ReadAfter(last, func(data []byte) error {
+		record, err := q.decodeRecord(data, last+int64(len(records))+1)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	for _, record := range records {
+		q.addEvent(record)
+	}
+	if len(records) > 0 {
+		close(q.changed)
+		q.changed = make(chan struct{})
+	}
+	q.failed = nil
+	subscribers := q.subscribers
+	q.mu.Unlock()
+
+	if len(records) > 0 {
+		log.Printf("Журнал событий дочитан после ошибки записи: добавлено %d событий", len(records))
+	}
+	for _, record := range records {
+		for _, sub := range subscribers {
+			sub.offer(record)
+		}
+	}
+	return nil
+}
+
+// commitBatch добавляет записанные события в очередь, снимает резервирование версий,
+// передает события подписчикам и подтверждает запросы. Ошибка записи переводит
+// очередь в состояние отказа: позиции, выданные после неудачной пачки, не вернуть.
+// Журнал файлов остается в отказе, как и SegmentedLog; TailJournal выходит из него через resync.
+func (q *EventQueue) commitBatch(batch []*appendRequest, err error) {
+	q.mu.Lock()
+	if err != nil && q.failed == nil {
+		q.failed = err
+		log.Printf("Ошибка записи в журнал событий, ожидающие записи события отклонены: %v", err)
+	}
+	for _, request := range batch {
+		orderID := request.record.Event.GetOrderID()
+		q.pending[orderID]--
+		if q.pending[orderID] == 0 {
+			delete(q.pending, orderID)
+		}
+
+		// Добавляем событие в очередь только после успешной записи
+		if err == nil {
+			q.addEvent(request.record)
+		}
+	}
+	if err == nil {
+		// Будим читателей, ожидающих новых событий
+		close(q.changed)
+		q.changed = make(chan struct{})
+	}
+	subscribers := q.subscribers
+	q.mu.Unlock()
+
+	for _, request := range batch {
+		if err == nil {
+			// Передаем событие в упорядоченные буферы подписчиков
+			for _, sub := range subscribers {
+				sub.offer(request.record)
+			}
+		}
+		request.done <- err
+	}
+}
@@ -0,0 +1,159 @@
+// history.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PointInTime момент в истории лога: глобальная позиция или время события
+type PointInTime struct {
+	Position int64     // Учитывать события с позицией не больше Position (0 - не ограничено)
+	Time     time.Time // Учитывать события не позже Time (нулевое - не ограничено)
+}
+
+// ParsePointInTime разбирает параметр as_of: позицию в логе (целое число)
+// или время в формате RFC3339, например 2025-01-31T15:00:00+03:00
+func ParsePointInTime(value string) (PointInTime, error) {
+	if position, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if position <= 0 {
+			return PointInTime{}, fmt.Errorf("позиция as_of должна быть положительной")
+		}
+		return PointInTime{Position: position}, nil
+	}
+
+	moment, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return PointInTime{}, fmt.Errorf("параметр as_of должен быть позицией в логе или временем RFC3339: %q", value)
+	}
+	return PointInTime{Time: moment}, nil
+}
+
+// parseAsOf читает необязательный параметр запроса as_of; nil - текущее состояние
+func parseAsOf(r *http.Request) (*PointInTime, error) {
+	value := r.URL.Query().Get("as_of")
+	if value == "" {
+		return nil, nil
+	}
+	asOf, err := ParsePointInTime(value)
+	if err != nil {
+		return nil, err
+	}
+	return &asOf, nil
+}
+
+// Includes проверяет, произошло ли событие не позже этого момента
+func (p PointInTime) Includes(record RecordedEvent) bool {
+	if p.Position > 0 && record.Position > p.Position {
+		return false
+	}
+	if !p.Time.IsZero() && eventTime(record.Event).After(p.Time) {
+		return false
+	}
+	return true
+}
+
+// String возвращает описание момента для текстовых ответов
+func (p PointInTime) String() string {
+	if p.Position > 0 {
+		return "позиция " + strconv.FormatInt(p.Position, 10)
+	}
+	return p.Time.Format(time.RFC3339)
+}
+
+// OrderHistoryEntry событие заказа и состояние, которое получилось после него
+type OrderHistoryEntry struct {
+	Version int       `json:"version"` // Версия потока заказа после события
+	Event   EventDTO  `json:"event"`
+	State   OrderView `json:"state"`
+}
+
+// OrderStateAt восстанавливает состояние заказа из событий, произошедших не позже asOf.
+// Возвращает nil, если к этому моменту заказ еще не был создан.
+func (s *EventStore) OrderStateAt(orderID OrderID, asOf PointInTime) *OrderState {
+	records, _, _ := s.backend.ReadAll(EventQuery{OrderID: orderID})
+
+	var state *OrderState
+	for _, record := range records {
+		if asOf.Position > 0 && record.Position > asOf.Position {
+			// Позиции идут по порядку: дальше только более поздние события
+			break
+		}
+		if !asOf.Includes(record) {
+			// Время событий может идти не по порядку позиций (часы разных серверов),
+			// поэтому по времени отбираем каждое событие, как и OrdersAt
+			continue
+		}
+		if state == nil {
+			state = &OrderState{ID: orderID, Status: StatusUnknown}
+		}
+		applyEvent(state, record.Event)
+	}
+	return state
+}
+
+// OrdersAt восстанавливает состояние всех заказов на момент asOf, упорядоченных по ID
+func (s *EventStore) OrdersAt(asOf PointInTime) []*OrderState {
+	records, _, _ := s.backend.ReadAll(EventQuery{})
+
+	states := make(map[OrderID]*OrderState)
+	for _, record := range records {
+		if asOf.Position > 0 && record.Position > asOf.Position {
+			// Позиции идут по порядку: дальше только более поздние события
+			break
+		}
+		if !asOf.Includes(record) {
+			continue
+		}
+
+		orderID := record.Event.GetOrderID()
+		state, found := states[orderID]
+		if !found {
+			state = &OrderState{ID: orderID, Status: StatusUnknown}
+			states[orderID] = state
+		}
+		applyEvent(state, record.Event)
+	}
+
+	orders := make([]*OrderState, 0, len(states))
+	for _, state := range states {
+		orders = append(orders, state)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].ID.Less(orders[j].ID)
+	})
+	return orders
+}
+
+// OrderHistory возвращает события заказа, произошедшие не позже asOf,
+// вместе с состоянием заказа после каждого из них
+func (s *EventStore) OrderHistory(orderID OrderID, asOf PointInTime) ([]OrderHistoryEntry, error) {
+	records, _, _ := s.backend.ReadAll(EventQuery{OrderID: orderID})
+
+	history := make([]OrderHistoryEntry, 0, len(records))
+	state := &OrderState{ID: orderID, Status: StatusUnknown}
+	for version, record := range records {
+		if asOf.Position > 0 && record.Position > asOf.Position {
+			break
+		}
+		if !asOf.Includes(record) {
+			// Версия - номер события в потоке, пропуск по времени ее не сдвигает
+			continue
+		}
+
+		dto, err := s.backend.EncodeRecorded(record)
+		if err != nil {
+			return nil, err
+		}
+		applyEvent(state, record.Event)
+		history = append(history, OrderHistoryEntry{
+			Version: version + 1,
+			Event:   dto,
+			State:   newOrderView(state),
+		})
+	}
+	return history, nil
+}
@@ -0,0 +1,130 @@
+// history_test.go
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newHistoryTestStore создает хранилище в памяти с событиями:
+//
+//	позиция 1: заказ #1 создан   10:00
+//	позиция 2: заказ #1 оплачен  10:05
+//	позиция 3: заказ #2 создан   10:06
+//	позиция 4: заказ #1 отправлен, но часы сервера отстают: 10:03
+func newHistoryTestStore(t *testing.T) *EventStore {
+	t.Helper()
+	queue, err := newEventQueue(&MemoryJournal{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+
+	at := func(orderID OrderID, minute int) BaseEvent {
+		return BaseEvent{OrderID: orderID, Timestamp: time.Date(2025, 1, 1, 10, minute, 0, 0, time.UTC)}
+	}
+	events := []struct {
+		event   Event
+		version int
+	}{
+		{OrderCreatedEvent{BaseEvent: at("1", 0), CustomerID: "alice"}, NoStream},
+		{OrderPaidEvent{BaseEvent: at("1", 5)}, 1},
+		{OrderCreatedEvent{BaseEvent: at("2", 6), CustomerID: "bob"}, NoStream},
+		{OrderShippedEvent{BaseEvent: at("1", 3), TrackingNumber: "RU1"}, 2},
+	}
+	for _, e := range events {
+		if err := queue.Append(e.event, e.version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &EventStore{backend: queue}
+}
+
+func TestOrderStateAt(t *testing.T) {
+	store := newHistoryTestStore(t)
+	at := func(minute, second int) PointInTime {
+		return PointInTime{Time: time.Date(2025, 1, 1, 10, minute, second, 0, time.UTC)}
+	}
+
+	tests := []struct {
+		name     string
+		asOf     PointInTime
+		status   string // "" - заказа еще нет
+		versions []int  // Версии записей истории заказа
+	}{
+		{"первая позиция", PointInTime{Position: 1}, StatusCreated, []int{1}},
+		{"позиция оплаты", PointInTime{Position: 2}, StatusPaid, []int{1, 2}},
+		{"позиция события другого заказа", PointInTime{Position: 3}, StatusPaid, []int{1, 2}},
+		{"последняя позиция", PointInTime{Position: 4}, StatusShipped, []int{1, 2, 3}},
+		{"позиция за концом лога", PointInTime{Position: 100}, StatusShipped, []int{1, 2, 3}},
+		{"до создания", at(0, -1), "", []int{}},
+		{"ровно время создания", at(0, 0), StatusCreated, []int{1}},
+		// Оплата (10:05) еще не произошла, а отправка с отстающими часами (10:03) уже учтена
+		{"между событиями с часами не по порядку", at(4, 59), StatusShipped, []int{1, 3}},
+		{"ровно время оплаты", at(5, 0), StatusShipped, []int{1, 2, 3}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := store.OrderStateAt("1", test.asOf)
+			status := ""
+			if state != nil {
+				status = state.Status
+			}
+			if status != test.status {
+				t.Fatalf("статус %q, ожидался %q", status, test.status)
+			}
+
+			// Состояние одного заказа совпадает с состоянием из списка всех заказов
+			listed := ""
+			for _, order := range store.OrdersAt(test.asOf) {
+				if order.ID == "1" {
+					listed = order.Status
+				}
+			}
+			if listed != status {
+				t.Fatalf("OrdersAt: статус %q, OrderStateAt: %q", listed, status)
+			}
+
+			history, err := store.OrderHistory("1", test.asOf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions := make([]int, 0, len(history))
+			for _, entry := range history {
+				versions = append(versions, entry.Version)
+			}
+			if !reflect.DeepEqual(versions, test.versions) {
+				t.Fatalf("версии истории %v, ожидались %v", versions, test.versions)
+			}
+			if len(history) > 0 && history[len(history)-1].State.Status != status {
+				t.Fatalf("последняя запись истории в статусе %s, ожидался %s", history[len(history)-1].State.Status, status)
+			}
+		})
+	}
+}
+
+func TestParsePointInTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    PointInTime
+		wantErr bool
+	}{
+		{value: "1", want: PointInTime{Position: 1}},
+		{value: "2025-01-01T13:00:00+03:00", want: PointInTime{Time: time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)}},
+		{value: "0", wantErr: true},
+		{value: "-5", wantErr: true},
+		{value: "вчера", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParsePointInTime(test.value)
+		if (err != nil) != test.wantErr {
+			t.Fatalf("ParsePointInTime(%q): ошибка %v", test.value, err)
+		}
+		if got.Position != test.want.Position || !got.Time.Equal(test.want.Time) {
+			t.Fatalf("ParsePointInTime(%q) = %+v, ожидалось %+v", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// idempotency.go
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	idempotencyHeader       = "Idempotency-Key"     // Заголовок с ключом идемпотентности
+	idempotencyReplayHeader = "Idempotent-Replayed" // Заголовок ответа, повторенного из хранилища
+	maxIdempotencyKeyLength = 255                   // Максимальная длина ключа
+)
+
+// IdempotencyRecord результат первого выполнения запроса с ключом идемпотентности
+type IdempotencyRecord struct {
+	Fingerprint string    `json:"fingerprint"`            // Отпечаток запроса (метод, путь, параметры, тело)
+	Pending     bool      `json:"pending"`                // Запрос еще выполняется
+	Status      int       `json:"status,omitempty"`       // HTTP статус ответа
+	ContentType string    `json:"content_type,omitempty"` // Тип содержимого ответа
+	Body        []byte    `json:"body,omitempty"`         // Тело ответа
+	CreatedAt   time.Time `json:"created_at"`             // Время первого запроса
+}
+
+// IdempotencyStore хранилище результатов запросов по ключам идемпотентности
+type IdempotencyStore interface {
+	// Reserve атомарно занимает ключ записью pending, если ключ свободен, и возвращает nil.
+	// Если ключ уже занят, возвращает существующую запись.
+	Reserve(key string, record IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error)
+	// Complete сохраняет результат выполнения запроса
+	Complete(key string, record IdempotencyRecord, ttl time.Duration) error
+	// Release освобождает ключ, чтобы запрос можно было повторить
+	Release(key string) error
+}
+
+// NewIdempotencyStore создает хранилище ключей идемпотентности указанного типа: memory или redis
+func NewIdempotencyStore(kind string, redisAddr string) (IdempotencyStore, error) {
+	switch kind {
+	case "memory":
+		return NewMemoryIdempotencyStore(), nil
+	case "redis":
+		return NewRedisIdempotencyStore(redisAddr)
+	}
+	return nil, fmt.Errorf("неизвестное хранилище ключей идемпотентности: %q (ожидается memory или redis)", kind)
+}
+
+// memoryIdempotencyEntry запись хранилища в памяти со сроком жизни
+type memoryIdempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// idempotencyExpiry срок жизни ключа в очереди на удаление
+type idempotencyExpiry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// idempotencyExpiryHeap очередь сроков жизни ключей, ближайший срок - первым
+type idempotencyExpiryHeap []idempotencyExpiry
+
+func (h idempotencyExpiryHeap) Len() int           { return len(h) }
+func (h idempotencyExpiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h idempotencyExpiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *idempotencyExpiryHeap) Push(x any)        { *h = append(*h, x.(idempotencyExpiry)) }
+func (h *idempotencyExpiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// MemoryIdempotencyStore хранит ключи идемпотентности в памяти процесса
+type MemoryIdempotencyStore struct {
+	entries map[string]memoryIdempotencyEntry
+	expiry  idempotencyExpiryHeap // Сроки жизни: истекшие ключи удаляются без обхода всех записей
+	mu      sync.Mutex
+}
+
+// NewMemoryIdempotencyStore создает хранилище ключей идемпотентности в памяти
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries: make(map[string]memoryIdempotencyEntry),
+	}
+}
+
+// Reserve занимает ключ, если он свободен или его срок истек
+func (s *MemoryIdempotencyStore) Reserve(key string, record IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.removeExpired(now)
+
+	if entry, found := s.entries[key]; found {
+		existing := entry.record
+		return &existing, nil
+	}
+	s.put(key, record, now.Add(ttl))
+	return nil, nil
+}
+
+// Complete сохраняет результат выполнения запроса
+func (s *MemoryIdempotencyStore) Complete(key string, record IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(key, record, time.Now().Add(ttl))
+	return nil
+}
+
+// Release освобождает ключ
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// put сохраняет запись и ставит ее срок в очередь (вызывается под блокировкой)
+func (s *MemoryIdempotencyStore) put(key string, record IdempotencyRecord, expiresAt time.Time) {
+	s.entries[key] = memoryIdempotencyEntry{record: record, expiresAt: expiresAt}
+	heap.Push(&s.expiry, idempotencyExpiry{key: key, expiresAt: expiresAt})
+}
+
+// removeExpired удаляет записи с истекшим сроком (вызывается под блокировкой).
+// Срок в очереди мог устареть, если запись была продлена или удалена: такой срок пропускается.
+func (s *MemoryIdempotencyStore) removeExpired(now time.Time) {
+	for len(s.expiry) > 0 && now.After(s.expiry[0].expiresAt) {
+		item := heap.Pop(&s.expiry).(idempotencyExpiry)
+		if entry, found := s.entries[item.key]; found && entry.expiresAt.Equal(item.expiresAt) {
+			delete(s.entries, item.key)
+		}
+	}
+}
+
+// redisIdempotencyTimeout таймаут операций с Redis
+const redisIdempotencyTimeout = 5 * time.Second
+
+// RedisIdempotencyStore хранит ключи идемпотентности в Redis по ключу cqrs:idempotency:<ключ хранилища>
+type RedisIdempotencyStore struct {
+	client *redis.Client // Клиент Redis
+}
+
+// NewRedisIdempotencyStore подключается к Redis для хранения ключей идемпотентности
+func NewRedisIdempotencyStore(addr string) (*RedisIdempotencyStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisIdempotencyTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ошибка подключения к Redis: %w", err)
+	}
+
+	return &RedisIdempotencyStore{client: client}, nil
+}
+
+// Reserve занимает ключ командой SET NX; если ключ занят, читает существующую запись
+func (s *RedisIdempotencyStore) Reserve(key string, record IdempotencyRecord, ttl time.Duration) (*IdempotencyRecord, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisIdempotencyTimeout)
+	defer cancel()
+
+	reserved, err := s.client.SetNX(ctx, redisIdempotencyKey(key), data, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if reserved {
+		return nil, nil
+	}
+
+	data, err = s.client.Get(ctx, redisIdempotencyKey(key)).Bytes()
+	if err == redis.Nil {
+		// Ключ истек между SET NX и GET - пробуем занять его снова
+		return s.Reserve(key, record, ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var existing IdempotencyRecord
+	if err := json.Unmarshal(data, &existing); err != nil {
+		return nil, fmt.Errorf("ошибка при разборе записи идемпотентности: %w", err)
+	}
+	return &existing, nil
+}
+
+// Complete сохраняет результат выполнения запроса
+func (s *RedisIdempotencyStore) Complete(key string, record IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisIdempotencyTimeout)
+	defer cancel()
+	return s.client.Set(ctx, redisIdempotencyKey(key), data, ttl).Err()
+}
+
+// Release освобождает ключ
+func (s *RedisIdempotencyStore) Release(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisIdempotencyTimeout)
+	defer cancel()
+	return s.client.Del(ctx, redisIdempotencyKey(key)).Err()
+}
+
+// redisIdempotencyKey возвращает ключ Redis для ключа идемпотентности
+func redisIdempotencyKey(key string) string {
+	return "cqrs:idempotency:" + key
+}
+
+// responseRecorder запоминает ответ обработчика, одновременно передавая его клиенту
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader запоминает статус ответа
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write запоминает тело ответа
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// IdempotencyMiddleware выполняет команду с заголовком Idempotency-Key один раз:
+// первый результат сохраняется на ttl и возвращается без изменений на повторные запросы,
+// а повтор ключа с другим запросом отклоняется. Ключи разных инициаторов и маршрутов
+// не пересекаются: один клиент не может получить сохраненный ответ другого.
+type IdempotencyMiddleware struct {
+	store IdempotencyStore
+	ttl   time.Duration
+}
+
+// NewIdempotencyMiddleware создает middleware ключей идемпотентности
+func NewIdempotencyMiddleware(store IdempotencyStore, ttl time.Duration) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{store: store, ttl: ttl}
+}
+
+// Middleware оборачивает обработчик; действует только на команды (POST и DELETE) с ключом
+func (m *IdempotencyMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest,
+				fmt.Sprintf("ключ идемпотентности длиннее %d символов", maxIdempotencyKeyLength))
+			return
+		}
+
+		// Тело читаем целиком, чтобы посчитать отпечаток и передать его обработчику
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, "некорректное тело запроса")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+		storeKey := idempotencyStoreKey(r, key)
+
+		existing, err := m.store.Reserve(storeKey, IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Pending:     true,
+			CreatedAt:   time.Now(),
+		}, m.ttl)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal,
+				fmt.Sprintf("ошибка хранилища ключей идемпотентности: %v", err))
+			return
+		}
+		if existing != nil {
+			m.replay(w, r, existing, fingerprint)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		// Сохраняем только окончательный результат: после конфликта или внутренней ошибки
+		// запрос с тем же ключом можно повторить
+		if retryableStatus(recorder.status) {
+			if err := m.store.Release(storeKey); err != nil {
+				logIdempotencyError(key, err)
+			}
+			return
+		}
+		err = m.store.Complete(storeKey, IdempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   time.Now(),
+		}, m.ttl)
+		if err != nil {
+			logIdempotencyError(key, err)
+		}
+	})
+}
+
+// retryableStatus проверяет, что повтор запроса может дать другой результат: конфликт
+// (версий потока или статуса заказа), превышение лимита запросов или ошибка сервера
+func retryableStatus(status int) bool {
+	return status == http.StatusConflict || status == http.StatusTooManyRequests ||
+		status >= http.StatusInternalServerError
+}
+
+// replay отвечает на повторный запрос сохраненным результатом
+func (m *IdempotencyMiddleware) replay(w http.ResponseWriter, r *http.Request, record *IdempotencyRecord, fingerprint string) {
+	switch {
+	case record.Fingerprint != fingerprint:
+		writeError(w, r, http.StatusUnprocessableEntity, ErrorCodeIdempotencyMismatch,
+			"ключ идемпотентности уже использован для другого запроса")
+	case record.Pending:
+		writeError(w, r, http.StatusConflict, ErrorCodeIdempotencyInProgress,
+			"запрос с этим ключом идемпотентности еще выполняется")
+	default:
+		if record.ContentType != "" {
+			w.Header().Set("Content-Type", record.ContentType)
+		}
+		w.Header().Set(idempotencyReplayHeader, "true")
+		w.WriteHeader(record.Status)
+		w.Write(record.Body)
+	}
+}
+
+// idempotencyStoreKey возвращает ключ хранилища: хеш инициатора, метода, маршрута
+// и ключа клиента. Хеш не раскрывает ID инициатора в хранилище и ограничивает длину ключа.
+func idempotencyStoreKey(r *http.Request, key string) string {
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			route = template
+		}
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n%s", ActorFromContext(r.Context()).ID, r.Method, route, key)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// requestFingerprint возвращает отпечаток запроса: метод, путь, параметры и тело
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// logIdempotencyError записывает ошибку хранилища ключей, не влияя на уже отправленный ответ
+func logIdempotencyError(key string, err error) {
+	log.Printf("Ошибка при сохранении результата для ключа идемпотентности %s: %v", key, err)
+}
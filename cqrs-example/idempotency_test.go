@@ -0,0 +1,67 @@
+// idempotency_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyMiddlewareCachesOnlyFinalResults(t *testing.T) {
+	tests := []struct {
+		name   string
+		first  int  // Статус первого выполнения
+		cached bool // Повтор получает сохраненный ответ, а не выполняет команду заново
+	}{
+		{"успех", http.StatusCreated, true},
+		{"ошибка проверки", http.StatusBadRequest, true},
+		{"не найден", http.StatusNotFound, true},
+		{"конфликт версий", http.StatusConflict, false},
+		{"лимит запросов", http.StatusTooManyRequests, false},
+		{"внутренняя ошибка", http.StatusInternalServerError, false},
+		{"сервис недоступен", http.StatusServiceUnavailable, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			handler := NewIdempotencyMiddleware(NewMemoryIdempotencyStore(), time.Hour).Middleware(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					calls++
+					if calls == 1 {
+						w.WriteHeader(test.first)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+				}))
+
+			serve := func() *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodPost, "/orders/1/pay", nil)
+				r.Header.Set(idempotencyHeader, "key-1")
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				return w
+			}
+
+			if w := serve(); w.Code != test.first {
+				t.Fatalf("первый запрос: статус %d, ожидался %d", w.Code, test.first)
+			}
+			retry := serve()
+
+			if test.cached {
+				if calls != 1 || retry.Code != test.first || retry.Header().Get(idempotencyReplayHeader) != "true" {
+					t.Fatalf("повтор выполнил команду заново (вызовов %d, статус %d)", calls, retry.Code)
+				}
+				return
+			}
+			if calls != 2 || retry.Code != http.StatusOK {
+				t.Fatalf("повтор не выполнил команду (вызовов %d, статус %d)", calls, retry.Code)
+			}
+			// Окончательный результат повтора сохраняется как обычно
+			if serve(); calls != 2 {
+				t.Fatal("успешный повтор не сохранен")
+			}
+		})
+	}
+}
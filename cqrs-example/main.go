@@ -2,117 +2,238 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"strconv"
-	"path/filepath"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
-	// Путь к файлу событий
-	eventLogPath := filepath.Join("data", "event_log.json")
+	// Служебные команды: go run . <команда>
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			// Переписываем лог событий в последнюю версию схемы
+			runMigrate(os.Args[2:])
+		case "dispatch":
+			// Отправляем команду через шину команд из командной строки
+			runDispatch(os.Args[2:])
+		default:
+			fmt.Println("Использование: go run . [migrate [директория лога] | dispatch <команда> <JSON>]")
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Читаем настройки из переменных окружения
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Ошибка в настройках: %v", err)
+	}
+
+	// Без доверенного прокси все команды выполняются от анонимного инициатора
+	if len(config.TrustedProxies) == 0 {
+		log.Printf("CQRS_TRUSTED_PROXIES не задан: заголовки X-Actor-ID и X-Actor-Roles игнорируются")
+	}
 
 	// Создаем директорию для данных, если она не существует
-	os.MkdirAll(filepath.Dir(eventLogPath), 0755)
+	os.MkdirAll(config.DataDir, 0755)
 
 	// Инициализируем хранилище событий
-	store, err := NewEventStore(eventLogPath)
+	store, err := NewEventStore(config.Store)
 	if err != nil {
 		log.Fatalf("Ошибка при инициализации хранилища событий: %v", err)
 	}
 
-	// Создаем проекцию заказов
-	orderProjection := NewOrderProjection(store)
+	// Хранилище контрольных точек проекций
+	checkpoints, err := NewCheckpointStore(config.CheckpointStore, filepath.Join(config.DataDir, "projections"), config.RedisAddr)
+	if err != nil {
+		log.Fatalf("Ошибка при инициализации хранилища контрольных точек: %v", err)
+	}
+	projectionOptions := ProjectionOptions{
+		Subscription:    config.Subscriptions,
+		CheckpointEvery: config.CheckpointEvery,
+		// Контрольные точки до последнего удаления персональных данных могут их содержать
+		DiscardBefore: store.LastErasure(),
+	}
+
+	// Создаем проекцию заказов и продолжаем ее с сохраненной контрольной точки
+	orderRunner, err := StartProjection(store, func() Projection { return NewOrderProjection() }, checkpoints, projectionOptions)
+	if err != nil {
+		log.Fatalf("Ошибка при запуске проекции заказов: %v", err)
+	}
+	// Экземпляр проекции может быть подменен после фонового перестроения,
+	// поэтому запросы всегда берут текущий
+	orderProjection := func() *OrderProjection {
+		return orderRunner.Current().(*OrderProjection)
+	}
+
+	// Дополнительные модели чтения получают события из того же лога через собственные подписки
+	customerRunner, err := StartProjection(store, func() Projection { return NewCustomerSummaryProjection() }, checkpoints, projectionOptions)
+	if err != nil {
+		log.Fatalf("Ошибка при запуске проекции клиентов: %v", err)
+	}
+	statusRunner, err := StartProjection(store, func() Projection { return NewStatusStatsProjection() }, checkpoints, projectionOptions)
+	if err != nil {
+		log.Fatalf("Ошибка при запуске проекции статусов: %v", err)
+	}
+	itemRunner, err := StartProjection(store, func() Projection { return NewItemPopularityProjection() }, checkpoints, projectionOptions)
+	if err != nil {
+		log.Fatalf("Ошибка при запуске проекции товаров: %v", err)
+	}
+	projections := NewProjectionAdmin(orderRunner, customerRunner, statusRunner, itemRunner)
+
+	// Шина команд: все транспорты отправляют команды через одну цепочку middleware
+	commandMetrics := NewCommandMetrics()
+	bus := NewOrderCommandBus(store, CommandBusConfig{
+		ConflictRetries: config.ConflictRetries,
+		Authorization:   config.Authorization,
+		Metrics:         commandMetrics,
+		Logger:          slog.Default(),
+	})
+
+	// Процесс-менеджер отменяет заказы, не оплаченные за CQRS_PAYMENT_TIMEOUT
+	var paymentTimeouts *PaymentTimeoutManager
+	if config.PaymentTimeout > 0 {
+		paymentTimeouts, err = StartPaymentTimeoutManager(store, bus, config.PaymentTimeout, config.PaymentTimeoutFile, config.Subscriptions)
+		if err != nil {
+			log.Fatalf("Ошибка при запуске автоотмены неоплаченных заказов: %v", err)
+		}
+	} else if err := ResetPaymentTimeoutSince(config.PaymentTimeoutFile); err != nil {
+		log.Printf("Ошибка при сбросе времени включения автоотмены: %v", err)
+	}
+
+	// Публикация событий во внешний брокер с позиции, сохраненной в хранилище контрольных точек
+	var outbox *OutboxRelay
+	if config.Outbox.Broker != "none" {
+		publisher, err := NewPublisher(config.Outbox)
+		if err != nil {
+			log.Fatalf("Ошибка при подключении к брокеру: %v", err)
+		}
+		outbox, err = StartOutboxRelay(store, config.Outbox.Broker, publisher, checkpoints)
+		if err != nil {
+			log.Fatalf("Ошибка при запуске публикации событий: %v", err)
+		}
+	}
+
+	// Хранилище результатов команд по заголовку Idempotency-Key
+	idempotencyStore, err := NewIdempotencyStore(config.IdempotencyStore, config.RedisAddr)
+	if err != nil {
+		log.Fatalf("Ошибка при инициализации хранилища ключей идемпотентности: %v", err)
+	}
 
 	// Настраиваем HTTP сервер
 	r := mux.NewRouter()
 
-	// Маршруты для команд (изменение состояния)
+	// Инициатор команды берется из заголовков только от доверенного прокси
+	r.Use(config.TrustedProxies.ActorMiddleware)
+
+	// Повторная команда с тем же Idempotency-Key возвращает первый результат
+	r.Use(NewIdempotencyMiddleware(idempotencyStore, config.IdempotencyTTL).Middleware)
+
+	// Маршруты для команд (изменение состояния).
+	// Запросы принимаются в JSON или как форма, ответ - JSON или текст (см. wantsJSON).
 	r.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
 		// Обработка команды CreateOrder
 
-		// Получаем параметры из формы запроса
-		customerID := r.FormValue("customer_id")
-		item := r.FormValue("item")
-
-		// Создаем команду
-		command := CreateOrderCommand{
-			CustomerID: customerID,
-			Items:     []string{item},
+		// Получаем клиента и позиции заказа из JSON тела или формы
+		command, err := parseCreateOrderRequest(w, r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
 		}
 
-		// Обрабатываем команду
-		orderID, err := HandleCreateOrder(store, command)
+		// Отправляем команду через шину
+		result, err := bus.Dispatch(requestContext(r), command)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeCommandError(w, r, err)
 			return
 		}
 
 		// Возвращаем ответ
-		fmt.Fprintf(w, "Заказ создан, ID: %d", orderID)
+		writeCommandResult(w, r, http.StatusCreated, CommandResponse{
+			OrderID: result.OrderID,
+			Status:  result.Status,
+			Message: "Заказ создан",
+		}, fmt.Sprintf("Заказ создан, ID: %s", result.OrderID))
 	}).Methods("POST")
 
 	r.HandleFunc("/orders/{id}/pay", func(w http.ResponseWriter, r *http.Request) {
-		// Обработка команды PayOrder
+		// Обработка команды PayOrder через шину команд
+		serveOrderCommand(w, r, bus, "Заказ оплачен", func(id OrderID, request OrderCommandRequest) Command {
+			return PayOrderCommand{OrderID: id}
+		})
+	}).Methods("POST")
 
-		// Получаем ID заказа из URL
-		vars := mux.Vars(r)
-		id, err := strconv.Atoi(vars["id"])
-		if err != nil {
-			http.Error(w, "Некорректный ID", http.StatusBadRequest)
-			return
-		}
+	r.HandleFunc("/orders/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		// Обработка команды CancelOrder через шину команд
+		serveOrderCommand(w, r, bus, "Заказ отменен", func(id OrderID, request OrderCommandRequest) Command {
+			command := CancelOrderCommand{OrderID: id, Reason: request.Reason}
+			if command.Reason == "" {
+				command.Reason = "Причина не указана"
+			}
+			return command
+		})
+	}).Methods("POST")
 
-		// Создаем команду
-		command := PayOrderCommand{OrderID: id}
+	r.HandleFunc("/orders/{id}/ship", func(w http.ResponseWriter, r *http.Request) {
+		// Обработка команды ShipOrder через шину команд
+		serveOrderCommand(w, r, bus, "Заказ отправлен", func(id OrderID, request OrderCommandRequest) Command {
+			return ShipOrderCommand{OrderID: id, TrackingNumber: request.TrackingNumber}
+		})
+	}).Methods("POST")
 
-		// Обрабатываем команду
-		err = HandlePayOrder(store, command)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	r.HandleFunc("/orders/{id}/deliver", func(w http.ResponseWriter, r *http.Request) {
+		// Обработка команды DeliverOrder через шину команд
+		serveOrderCommand(w, r, bus, "Заказ доставлен", func(id OrderID, request OrderCommandRequest) Command {
+			return DeliverOrderCommand{OrderID: id}
+		})
+	}).Methods("POST")
 
-		// Возвращаем ответ
-		fmt.Fprint(w, "Заказ оплачен")
+	r.HandleFunc("/orders/{id}/refund", func(w http.ResponseWriter, r *http.Request) {
+		// Обработка команды RefundOrder через шину команд
+		serveOrderCommand(w, r, bus, "Оплата заказа возвращена", func(id OrderID, request OrderCommandRequest) Command {
+			command := RefundOrderCommand{OrderID: id, Reason: request.Reason}
+			if command.Reason == "" {
+				command.Reason = "Причина не указана"
+			}
+			return command
+		})
 	}).Methods("POST")
 
-	r.HandleFunc("/orders/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
-		// Обработка команды CancelOrder
+	r.HandleFunc("/orders/{id}/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		// Создание снимка состояния заказа по запросу
 
 		// Получаем ID заказа из URL
-		vars := mux.Vars(r)
-		id, err := strconv.Atoi(vars["id"])
+		id, err := parseOrderID(r)
 		if err != nil {
-			http.Error(w, "Некорректный ID", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
 			return
 		}
 
-		// Получаем причину отмены из формы
-		reason := r.FormValue("reason")
-		if reason == "" {
-			reason = "Причина не указана"
-		}
-
-		// Создаем команду
-		command := CancelOrderCommand{
-			OrderID: id,
-			Reason:  reason,
-		}
-
-		// Обрабатываем команду
-		err = HandleCancelOrder(store, command)
+		snapshot, err := store.TakeSnapshot(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeCommandError(w, r, err)
 			return
 		}
 
 		// Возвращаем ответ
-		fmt.Fprint(w, "Заказ отменен")
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, map[string]any{"order_id": id, "version": snapshot.Version})
+			return
+		}
+		fmt.Fprintf(w, "Снимок заказа #%s сохранен на версии %d", id, snapshot.Version)
 	}).Methods("POST")
 
 	// Маршруты для запросов (чтение состояния)
@@ -120,62 +241,426 @@ func main() {
 		// Получение данных заказа
 
 		// Получаем ID заказа из URL
-		vars := mux.Vars(r)
-		id, err := strconv.Atoi(vars["id"])
+		id, err := parseOrderID(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+
+		asOf, err := parseAsOf(r)
 		if err != nil {
-			http.Error(w, "Некорректный ID", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
 			return
 		}
 
-		// Получаем заказ из проекции
-		order := orderProjection.GetOrder(id)
+		// Текущее состояние берем из проекции, состояние на момент as_of восстанавливаем из лога
+		var order *OrderState
+		if asOf != nil {
+			order = store.OrderStateAt(id, *asOf)
+		} else {
+			order = orderProjection().GetOrder(id)
+		}
 		if order == nil {
-			http.Error(w, "Заказ не найден", http.StatusNotFound)
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "Заказ не найден")
+			return
+		}
+
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, newOrderView(order))
 			return
 		}
 
 		// Формируем ответ в текстовом формате
 		w.Header().Set("Content-Type", "text/plain")
-		fmt.Fprintf(w, "Заказ #%d\n", order.ID)
+		fmt.Fprintf(w, "Заказ #%s\n", order.ID)
+		if asOf != nil {
+			fmt.Fprintf(w, "Состояние на момент: %s\n", asOf)
+		}
 		fmt.Fprintf(w, "Клиент: %s\n", order.CustomerID)
 		fmt.Fprintf(w, "Статус: %s\n", order.Status)
 		fmt.Fprintf(w, "Товары: %v\n", order.Items)
+		if order.TrackingNumber != "" {
+			fmt.Fprintf(w, "Трек-номер: %s\n", order.TrackingNumber)
+		}
 		fmt.Fprintf(w, "Создан: %v\n", order.CreateTime)
 		fmt.Fprintf(w, "Обновлен: %v\n", order.UpdateTime)
 	}).Methods("GET")
 
 	r.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
-		// Получение списка всех заказов
+		// Получение списка заказов с фильтрами, сортировкой и постраничной выдачей
 
-		// Получаем заказы из проекции
-		orders := orderProjection.GetAllOrders()
+		asOf, err := parseAsOf(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		query, err := ParseOrderQuery(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+
+		// Текущие заказы отбираем по индексам проекции, заказы на момент as_of восстанавливаем из лога
+		var page OrderPage
+		if asOf != nil {
+			page = FilterOrders(store.OrdersAt(*asOf), query)
+		} else {
+			page = orderProjection().Query(query)
+		}
+
+		if wantsJSON(r) {
+			response := OrdersPage{
+				Orders:     make([]OrderView, 0, len(page.Orders)),
+				NextCursor: page.NextCursor,
+				HasMore:    page.NextCursor != "",
+			}
+			for _, order := range page.Orders {
+				response.Orders = append(response.Orders, newOrderView(order))
+			}
+			writeJSON(w, http.StatusOK, response)
+			return
+		}
 
 		// Формируем ответ в текстовом формате
 		w.Header().Set("Content-Type", "text/plain")
-		fmt.Fprintln(w, "Список заказов:")
+		if asOf != nil {
+			fmt.Fprintf(w, "Список заказов (as_of: %s):\n", asOf)
+		} else {
+			fmt.Fprintln(w, "Список заказов:")
+		}
 
-		for _, order := range orders {
-			fmt.Fprintf(w, "Заказ #%d - Клиент: %s, Статус: %s, Товары: %v\n",
+		for _, order := range page.Orders {
+			fmt.Fprintf(w, "Заказ #%s - Клиент: %s, Статус: %s, Товары: %v\n",
 				order.ID, order.CustomerID, order.Status, order.Items)
 		}
+		if page.NextCursor != "" {
+			fmt.Fprintf(w, "Следующая страница: cursor=%s\n", page.NextCursor)
+		}
+	}).Methods("GET")
+
+	// История заказа: каждое событие и состояние заказа после него
+	r.HandleFunc("/orders/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		id, err := parseOrderID(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		asOf, err := parseAsOf(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		if asOf == nil {
+			asOf = &PointInTime{}
+		}
+
+		history, err := store.OrderHistory(id, *asOf)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+			return
+		}
+		if len(history) == 0 {
+			writeError(w, r, http.StatusNotFound, ErrorCodeNotFound, "Заказ не найден")
+			return
+		}
+
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, history)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "История заказа #%s:\n", id)
+		for _, entry := range history {
+			fmt.Fprintf(w, "v%d [%d] %s %s -> Статус: %s\n",
+				entry.Version, entry.Event.Position, entry.Event.Timestamp, entry.Event.Type, entry.State.Status)
+		}
+	}).Methods("GET")
+
+	// Конечный автомат заказа: ?format=mermaid (по умолчанию), dot или json
+	r.HandleFunc("/state-machine", func(w http.ResponseWriter, r *http.Request) {
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "mermaid":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, orderStateMachine.Mermaid())
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			fmt.Fprint(w, orderStateMachine.Graphviz())
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(orderStateMachine.Transitions())
+		default:
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest,
+				fmt.Sprintf("неизвестный формат: %q (ожидается mermaid, dot или json)", format))
+		}
+	}).Methods("GET")
+
+	// Сводки по клиентам: количество заказов, разбивка по статусам, заказанные товары
+	r.HandleFunc("/customers", func(w http.ResponseWriter, r *http.Request) {
+		customers := customerRunner.Current().(*CustomerSummaryProjection).GetAllCustomers()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customers)
+	}).Methods("GET")
+
+	// Право на забвение: ключ персональных данных клиента удаляется, проекции перестраиваются
+	r.HandleFunc("/customers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, err := bus.Dispatch(requestContext(r), ForgetCustomerCommand{CustomerID: mux.Vars(r)["id"]})
+		if err != nil {
+			writeCommandError(w, r, err)
+			return
+		}
+		projections.RebuildAll()
+
+		message := "Персональные данные клиента удалены, проекции перестраиваются"
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, map[string]string{"message": message})
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, message)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/customers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		customer := customerRunner.Current().(*CustomerSummaryProjection).GetCustomer(mux.Vars(r)["id"])
+		if customer == nil {
+			writeJSONError(w, http.StatusNotFound, ErrorCodeNotFound, "Клиент не найден")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(customer)
+	}).Methods("GET")
+
+	// Счетчики заказов по статусам: текущие и по интервалам времени (?limit=<интервалов>)
+	r.HandleFunc("/stats/statuses", func(w http.ResponseWriter, r *http.Request) {
+		limit, err := parseLimit(r, defaultStatsLimit)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		stats := statusRunner.Current().(*StatusStatsProjection).GetStats(limit)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}).Methods("GET")
+
+	// Самые заказываемые товары (?limit=<N>)
+	r.HandleFunc("/stats/items", func(w http.ResponseWriter, r *http.Request) {
+		limit, err := parseLimit(r, defaultTopItemsLimit)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		items := itemRunner.Current().(*ItemPopularityProjection).GetTopItems(limit)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
 	}).Methods("GET")
 
 	// Добавляем маршрут для просмотра лога событий
 	r.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
-		// Получение всех событий
-		events := store.GetAllEvents()
+		// Чтение лога событий по курсору: ?after=<позиция>&limit=<N>&type=<тип>&order_id=<ID>
+		query, err := parseEventQuery(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrorCodeBadRequest, err.Error())
+			return
+		}
+		events, next, hasMore := store.ReadEvents(query)
+
+		if wantsJSON(r) {
+			page := EventsPage{
+				Events:    make([]EventDTO, 0, len(events)),
+				NextAfter: next,
+				HasMore:   hasMore,
+			}
+			for _, record := range events {
+				dto, err := store.EncodeRecorded(record)
+				if err != nil {
+					writeError(w, r, http.StatusInternalServerError, ErrorCodeInternal, err.Error())
+					return
+				}
+				page.Events = append(page.Events, dto)
+			}
+			writeJSON(w, http.StatusOK, page)
+			return
+		}
 
 		// Формируем ответ в текстовом формате
 		w.Header().Set("Content-Type", "text/plain")
 		fmt.Fprintln(w, "Лог событий:")
 
-		for i, event := range events {
-			fmt.Fprintf(w, "[%d] %s - OrderID: %d, Timestamp: %s\n",
-				i+1, event.GetType(), event.GetOrderID(), event.GetTimestamp())
+		for _, record := range events {
+			metadata := record.Event.GetMetadata()
+			fmt.Fprintf(w, "[%d] %s - OrderID: %s, Timestamp: %s, Source: %s, Actor: %s, CorrelationID: %s, CausationID: %s\n",
+				record.Position, record.Event.GetType(), record.Event.GetOrderID(), record.Event.GetTimestamp(),
+				metadata.Source, metadata.ActorID, metadata.CorrelationID, metadata.CausationID)
+		}
+		if hasMore {
+			fmt.Fprintf(w, "Следующая страница: after=%d\n", next)
+		}
+	}).Methods("GET")
+
+	// Мониторинг подписчиков: размер буфера, отставание, отброшенные события
+	r.HandleFunc("/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.Subscriptions())
+	}).Methods("GET")
+
+	// Заказы, ожидающие оплаты, и сроки их автоматической отмены
+	r.HandleFunc("/deadlines", func(w http.ResponseWriter, r *http.Request) {
+		deadlines := []PaymentDeadline{}
+		if paymentTimeouts != nil {
+			deadlines = paymentTimeouts.Deadlines()
+		}
+		writeJSON(w, http.StatusOK, deadlines)
+	}).Methods("GET")
+
+	// Состояние публикации событий во внешний брокер и отставание от лога
+	r.HandleFunc("/outbox", func(w http.ResponseWriter, r *http.Request) {
+		if outbox == nil {
+			writeJSONError(w, http.StatusNotFound, ErrorCodeNotFound, "публикация событий выключена (CQRS_OUTBOX_BROKER=none)")
+			return
 		}
+		writeJSON(w, http.StatusOK, outbox.Stats())
+	}).Methods("GET")
+
+	// Метрики команд: количество, ошибки, конфликты, время выполнения
+	r.HandleFunc("/metrics/commands", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, commandMetrics.Snapshot())
 	}).Methods("GET")
 
+	// Административный API проекций: состояние и перестроение без остановки сервера.
+	// С включенной авторизацией доступен только роли admin, как и ForgetCustomer.
+	admin := r.PathPrefix("/admin").Subrouter()
+	if config.Authorization {
+		admin.Use(requireRole("admin"))
+	}
+	admin.HandleFunc("/projections", projections.ServeList).Methods("GET")
+	admin.HandleFunc("/projections/{name}", projections.ServeStatus).Methods("GET")
+	admin.HandleFunc("/projections/{name}/rebuild", projections.ServeRebuild).Methods("POST")
+
+	// Потоковая выдача событий: история с позиции after, затем новые события
+	streamer := NewEventStreamer(store, config.StreamHeartbeat)
+	r.HandleFunc("/events/stream", streamer.ServeSSE).Methods("GET")
+	r.HandleFunc("/events/ws", streamer.ServeWebSocket).Methods("GET")
+
+	// Контекст запросов отменяется при остановке, чтобы завершить потоковые соединения
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        ":8081",
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
 	// Запуск сервера
-	log.Println("CQRS сервер запущен на http://localhost:8081")
-	log.Fatal(http.ListenAndServe(":8081", r))
+	go func() {
+		log.Println("CQRS сервер запущен на http://localhost:8081")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Ждем сигнала остановки
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Println("Остановка CQRS сервера...")
+
+	cancelRequests()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Ошибка при остановке HTTP сервера: %v", err)
+	}
+
+	// Останавливаем автоматическую отмену до закрытия хранилища, чтобы не отправлять команды в закрытый лог
+	if paymentTimeouts != nil {
+		paymentTimeouts.Close()
+	}
+
+	// Публикация событий останавливается до закрытия лога; неопубликованные события отправятся после запуска
+	if outbox != nil {
+		if err := outbox.Close(); err != nil {
+			log.Printf("Ошибка при закрытии соединения с брокером: %v", err)
+		}
+	}
+
+	// Закрываем лог (доставка событий проекциям завершается) и сохраняем контрольные точки
+	if err := store.Close(); err != nil {
+		log.Printf("Ошибка при закрытии хранилища событий: %v", err)
+	}
+	if err := projections.Close(); err != nil {
+		log.Printf("Ошибка при сохранении контрольной точки: %v", err)
+	}
+}
+
+// OrdersPage страница заказов для GET /orders
+type OrdersPage struct {
+	Orders     []OrderView `json:"orders"`                // Заказы страницы
+	NextCursor string      `json:"next_cursor,omitempty"` // Курсор для следующего запроса (cursor=)
+	HasMore    bool        `json:"has_more"`              // Есть ли еще заказы после страницы
+}
+
+// EventsPage страница событий для GET /events
+type EventsPage struct {
+	Events    []EventDTO `json:"events"`     // События страницы
+	NextAfter int64      `json:"next_after"` // Курсор для следующего запроса (after=)
+	HasMore   bool       `json:"has_more"`   // Есть ли еще события после страницы
+}
+
+const (
+	defaultEventsLimit = 100  // Размер страницы событий по умолчанию
+	maxEventsLimit     = 1000 // Максимальный размер страницы событий
+)
+
+// parseEventQuery разбирает параметры курсора и фильтров GET /events
+func parseEventQuery(r *http.Request) (EventQuery, error) {
+	values := r.URL.Query()
+	query := EventQuery{
+		Limit: defaultEventsLimit,
+		Type:  values.Get("type"),
+	}
+
+	if value := values.Get("after"); value != "" {
+		after, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || after < 0 {
+			return EventQuery{}, fmt.Errorf("некорректный параметр after: %q", value)
+		}
+		query.After = after
+	}
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxEventsLimit {
+			return EventQuery{}, fmt.Errorf("параметр limit должен быть от 1 до %d", maxEventsLimit)
+		}
+		query.Limit = limit
+	}
+	if value := values.Get("order_id"); value != "" {
+		orderID, err := ParseOrderID(value)
+		if err != nil {
+			return EventQuery{}, fmt.Errorf("некорректный параметр order_id: %q", value)
+		}
+		query.OrderID = orderID
+	}
+
+	return query, nil
+}
+
+const (
+	defaultStatsLimit    = 60 // Интервалов истории статусов по умолчанию
+	defaultTopItemsLimit = 10 // Товаров в рейтинге по умолчанию
+)
+
+// parseLimit разбирает параметр limit запроса к моделям чтения
+func parseLimit(r *http.Request, defaultLimit int) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxEventsLimit {
+		return 0, fmt.Errorf("параметр limit должен быть от 1 до %d", maxEventsLimit)
+	}
+	return limit, nil
 }
@@ -0,0 +1,155 @@
+// migrate.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// runMigrate переписывает лог событий в последнюю версию схемы.
+// Запускается командой: go run *.go migrate [директория лога]
+func runMigrate(args []string) {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Ошибка в настройках: %v", err)
+	}
+
+	logConfig := config.Store.Log
+	if len(args) > 0 {
+		logConfig.Dir = args[0]
+		logConfig.LegacyFile = ""
+	}
+
+	total, upgraded, err := migrateEventLog(logConfig, eventRegistry)
+	if err != nil {
+		log.Fatalf("Ошибка при миграции лога %s: %v", logConfig.Dir, err)
+	}
+
+	log.Printf("Лог %s переписан: событий %d, обновлено до текущей схемы %d, копия сохранена в %s.bak",
+		logConfig.Dir, total, upgraded, logConfig.Dir)
+}
+
+// migrateEventLog читает лог, приводит каждое событие к текущей версии схемы,
+// записывает результат в новую директорию .tmp и подменяет ею исходную,
+// оставляя копию исходного лога с суффиксом .bak. Повторный запуск безопасен:
+// прерванная между переименованиями миграция завершается, а уже переписанный лог не меняется.
+func migrateEventLog(config LogConfig, registry *EventRegistry) (total int, upgraded int, err error) {
+	backupDir := config.Dir + ".bak"
+	tmpDir := config.Dir + ".tmp"
+
+	// Сбой между переименованиями: исходный лог уже в .bak, а новый целиком записан в .tmp
+	if !dirExists(config.Dir) && dirExists(backupDir) && dirExists(tmpDir) {
+		log.Printf("Завершаем прерванную миграцию: %s переименовывается в %s", tmpDir, config.Dir)
+		if err := os.Rename(tmpDir, config.Dir); err != nil {
+			return 0, 0, err
+		}
+	}
+	backupExists := dirExists(backupDir)
+
+	source, _, err := OpenSegmentedLog(config)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer source.Close()
+
+	targetConfig := config
+	targetConfig.Dir = tmpDir
+	targetConfig.Fsync = FsyncNever
+	targetConfig.LegacyFile = ""
+	if err := os.RemoveAll(targetConfig.Dir); err != nil {
+		return 0, 0, err
+	}
+	target, _, err := OpenSegmentedLog(targetConfig)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.RemoveAll(targetConfig.Dir)
+	defer target.Close()
+
+	err = source.Replay(func(data []byte) error {
+		var dto EventDTO
+		if err := json.Unmarshal(data, &dto); err != nil {
+			return err
+		}
+
+		// Decode применяет цепочку преобразований, Encode записывает текущую версию
+		event, err := registry.Decode(dto)
+		if err != nil {
+			return fmt.Errorf("событие #%d: %w", total+1, err)
+		}
+		migrated, err := registry.Encode(event)
+		if err == nil {
+			migrated, err = registry.Seal(migrated)
+		}
+		if err != nil {
+			return fmt.Errorf("событие #%d: %w", total+1, err)
+		}
+
+		// Позиции и ID событий сохраняем, старым записям выдаем их явно
+		migrated.Position = int64(total + 1)
+		migrated.EventID = dto.EventID
+		if migrated.EventID == "" {
+			migrated.EventID = legacyEventID(migrated.Position)
+		}
+
+		line, err := json.Marshal(migrated)
+		if err != nil {
+			return err
+		}
+		if err := target.Append(line); err != nil {
+			return err
+		}
+
+		total++
+		if migrated.Version != dto.Version {
+			upgraded++
+		}
+		return nil
+	})
+	if err != nil {
+		return total, upgraded, err
+	}
+
+	if err := target.Close(); err != nil {
+		return total, upgraded, err
+	}
+
+	// Резерв ID заказов переносим в новый лог, чтобы выданные ID не повторились
+	reserved, err := os.ReadFile(filepath.Join(config.Dir, orderIDsFileName))
+	if err == nil {
+		err = os.WriteFile(filepath.Join(targetConfig.Dir, orderIDsFileName), reserved, 0644)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return total, upgraded, err
+	}
+
+	if err := source.Close(); err != nil {
+		return total, upgraded, err
+	}
+
+	// Лог уже в текущей схеме (например, миграция запущена повторно): оставляем его и копию как есть
+	if upgraded == 0 && backupExists {
+		return total, upgraded, nil
+	}
+	if backupExists {
+		return total, upgraded, fmt.Errorf("копия %s уже существует, удалите ее перед миграцией", backupDir)
+	}
+
+	// Сохраняем исходный лог и подменяем его новым
+	if err := os.Rename(config.Dir, backupDir); err != nil {
+		return total, upgraded, err
+	}
+	if err := os.Rename(targetConfig.Dir, config.Dir); err != nil {
+		return total, upgraded, err
+	}
+	return total, upgraded, syncDir(filepath.Dir(config.Dir))
+}
+
+// dirExists проверяет, что директория существует
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
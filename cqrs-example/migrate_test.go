@@ -0,0 +1,118 @@
+// migrate_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeV1Log записывает лог из событий, сделанных до версионирования схемы
+func writeV1Log(t *testing.T, config LogConfig) {
+	t.Helper()
+	l, _, err := OpenSegmentedLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{
+		`{"type":"OrderCreated","order_id":1,"timestamp":"2024-01-01T00:00:00Z","data":{"CustomerID":"user123","Items":["книга"]}}`,
+		`{"type":"OrderPaid","order_id":1,"timestamp":"2024-01-01T00:01:00Z","data":{}}`,
+	} {
+		if err := l.Append([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLogDir возвращает содержимое сегментов директории лога
+func readLogDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != segmentExt {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = string(data)
+	}
+	return files
+}
+
+func TestMigrateEventLogIsIdempotent(t *testing.T) {
+	tests := []struct {
+		name string
+		// interrupt меняет директории после первой миграции, как сбой на ее шагах
+		interrupt func(t *testing.T, config LogConfig)
+	}{
+		{
+			name:      "повторный запуск",
+			interrupt: func(t *testing.T, config LogConfig) {},
+		},
+		{
+			name: "сбой между переименованиями",
+			interrupt: func(t *testing.T, config LogConfig) {
+				// Исходный лог уже в .bak, новый еще не переименован из .tmp
+				if err := os.Rename(config.Dir, config.Dir+".tmp"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "сбой во время записи .tmp",
+			interrupt: func(t *testing.T, config LogConfig) {
+				if err := os.MkdirAll(config.Dir+".tmp", 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(config.Dir+".tmp", "00000001"+segmentExt), []byte("мусор"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := LogConfig{Dir: filepath.Join(t.TempDir(), "events"), SegmentMaxBytes: 1 << 20, Fsync: FsyncNever}
+			writeV1Log(t, config)
+			original := readLogDir(t, config.Dir)
+
+			total, upgraded, err := migrateEventLog(config, eventRegistry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != 2 || upgraded != 2 {
+				t.Fatalf("первая миграция: событий %d, обновлено %d; ожидалось 2 и 2", total, upgraded)
+			}
+			migrated := readLogDir(t, config.Dir)
+
+			test.interrupt(t, config)
+			total, upgraded, err = migrateEventLog(config, eventRegistry)
+			if err != nil {
+				t.Fatalf("повторная миграция: %v", err)
+			}
+			if total != 2 || upgraded != 0 {
+				t.Fatalf("повторная миграция: событий %d, обновлено %d; ожидалось 2 и 0", total, upgraded)
+			}
+
+			if got := readLogDir(t, config.Dir); len(got) != len(migrated) || got["00000001"+segmentExt] != migrated["00000001"+segmentExt] {
+				t.Fatal("повторная миграция изменила переписанный лог")
+			}
+			if got := readLogDir(t, config.Dir+".bak"); len(got) != len(original) || got["00000001"+segmentExt] != original["00000001"+segmentExt] {
+				t.Fatal("копия исходного лога изменилась")
+			}
+			if _, err := os.Stat(config.Dir + ".tmp"); !os.IsNotExist(err) {
+				t.Fatalf("временная директория осталась: %v", err)
+			}
+		})
+	}
+}
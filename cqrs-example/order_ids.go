@@ -0,0 +1,367 @@
+// order_ids.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	orderIDsFileName = "order_ids" // Файл резерва ID заказов в директории лога
+	orderIDBlock     = 100         // Сколько ID резервировать одной записью файла
+)
+
+// Стратегии выдачи ID заказов (CQRS_ORDER_IDS)
+const (
+	OrderIDSequence = "sequence" // Целые числа по порядку из распределителя хранилища
+	OrderIDULID     = "ulid"     // ULID: строки, упорядоченные по времени создания, без общего счетчика
+)
+
+// OrderID ID заказа: положительное десятичное число (стратегия sequence) или ULID (стратегия ulid).
+// Числовые ID сериализуются в JSON числом, поэтому логи, снимки и ответы API, записанные
+// до появления строковых ID, читаются без изменений. Пустой ID - заказ не задан.
+type OrderID string
+
+// OrderIDFromInt возвращает числовой ID заказа
+func OrderIDFromInt(id int) OrderID {
+	if id == 0 {
+		return ""
+	}
+	return OrderID(strconv.Itoa(id))
+}
+
+// ParseOrderID разбирает ID заказа из URL или параметра запроса
+func ParseOrderID(value string) (OrderID, error) {
+	id := OrderID(value)
+	if _, ok := id.Int(); ok || isULID(value) {
+		return id, nil
+	}
+	return "", fmt.Errorf("некорректный ID заказа: %q", value)
+}
+
+// Int возвращает числовое значение ID; ok - ID выдан стратегией sequence
+func (id OrderID) Int() (int, bool) {
+	if id == "" || id[0] == '0' || len(id) > 18 {
+		return 0, false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	value, err := strconv.Atoi(string(id))
+	return value, err == nil
+}
+
+// Less сравнивает ID в порядке выдачи: пустой ID, числа по значению, затем ULID по времени
+func (id OrderID) Less(other OrderID) bool {
+	a, aNumeric := id.Int()
+	b, bNumeric := other.Int()
+	switch {
+	case aNumeric && bNumeric:
+		return a < b
+	case id == "" || other == "":
+		return id == "" && other != ""
+	case aNumeric != bNumeric:
+		return aNumeric
+	}
+	return id < other
+}
+
+// MarshalJSON записывает числовой ID числом, ULID - строкой
+func (id OrderID) MarshalJSON() ([]byte, error) {
+	if id == "" {
+		return []byte("0"), nil
+	}
+	if _, ok := id.Int(); ok {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+// UnmarshalJSON читает ID из числа (записи до строковых ID) или строки
+func (id *OrderID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		*id = OrderID(value)
+		return nil
+	}
+	var value int
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("некорректный ID заказа: %s", data)
+	}
+	*id = OrderIDFromInt(value)
+	return nil
+}
+
+// OrderIDAllocator выдает ID новых заказов. Выданный ID не повторяется
+// ни после перезапуска, ни в другом процессе, работающем с тем же хранилищем.
+type OrderIDAllocator interface {
+	// Next возвращает следующий ID заказа
+	Next() (OrderID, error)
+	// Close освобождает ресурсы
+	Close() error
+}
+
+// NewOrderIDAllocator создает распределитель ID выбранной стратегии. Для стратегии
+// sequence распределитель зависит от типа хранилища событий, а выдаваемые ID больше
+// lastID - максимального числового ID заказа в логе.
+func NewOrderIDAllocator(config EventStoreConfig, lastID int) (OrderIDAllocator, error) {
+	switch config.OrderIDs {
+	case "", OrderIDSequence:
+	case OrderIDULID:
+		return NewULIDAllocator(), nil
+	default:
+		return nil, fmt.Errorf("неизвестная стратегия ID заказов: %q (ожидается sequence или ulid)", config.OrderIDs)
+	}
+
+	switch config.Backend {
+	case "", "file":
+		// Файл лежит в директории лога и защищен ее блокировкой
+		return OpenFileIDAllocator(filepath.Join(config.Log.Dir, orderIDsFileName), lastID)
+	case "memory":
+		return &MemoryIDAllocator{last: lastID}, nil
+	case "redis":
+		return NewRedisIDAllocator(config.RedisAddr, config.RedisStream+":order_id", lastID)
+	}
+	return nil, fmt.Errorf("неизвестное хранилище событий: %q (ожидается file, memory или redis)", config.Backend)
+}
+
+// MemoryIDAllocator счетчик ID в памяти процесса
+type MemoryIDAllocator struct {
+	last int
+	mu   sync.Mutex
+}
+
+// Next увеличивает счетчик
+func (a *MemoryIDAllocator) Next() (OrderID, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last++
+	return OrderIDFromInt(a.last), nil
+}
+
+// Close ничего не делает
+func (a *MemoryIDAllocator) Close() error {
+	return nil
+}
+
+// FileIDAllocator выдает ID блоками, записывая в файл верхнюю границу выданного блока.
+// После перезапуска выдача продолжается за границей, поэтому неиспользованный
+// остаток блока пропускается, но ID не повторяются, даже если процесс упал
+// до записи события с выданным ID.
+type FileIDAllocator struct {
+	path     string // Путь к файлу резерва
+	last     int    // Последний выданный ID
+	reserved int    // Верхняя граница зарезервированного блока
+	mu       sync.Mutex
+}
+
+// OpenFileIDAllocator читает границу резерва из файла
+func OpenFileIDAllocator(path string, lastID int) (*FileIDAllocator, error) {
+	allocator := &FileIDAllocator{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("ошибка при чтении резерва ID заказов: %w", err)
+	}
+	if err == nil {
+		if allocator.reserved, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return nil, fmt.Errorf("ошибка при разборе резерва ID заказов %s: %w", path, err)
+		}
+	}
+
+	// Лог мог быть записан без файла резерва (до его появления)
+	allocator.last = max(allocator.reserved, lastID)
+	allocator.reserved = allocator.last
+	return allocator, nil
+}
+
+// Next выдает следующий ID, резервируя новый блок при исчерпании текущего
+func (a *FileIDAllocator) Next() (OrderID, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.last >= a.reserved {
+		reserved := a.last + orderIDBlock
+		if err := a.persist(reserved); err != nil {
+			return "", fmt.Errorf("ошибка при резервировании ID заказов: %w", err)
+		}
+		a.reserved = reserved
+	}
+	a.last++
+	return OrderIDFromInt(a.last), nil
+}
+
+// Close ничего не делает: граница резерва записывается при каждом резервировании
+func (a *FileIDAllocator) Close() error {
+	return nil
+}
+
+// persist атомарно записывает границу резерва и сбрасывает ее на диск
+func (a *FileIDAllocator) persist(reserved int) error {
+	tmpPath := a.path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strconv.Itoa(reserved) + "\n")
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.path)
+}
+
+// redisSeedScript поднимает счетчик до ARGV[1], если он меньше (лог мог появиться раньше счетчика)
+var redisSeedScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+if current < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// RedisIDAllocator общий для всех процессов счетчик ID в Redis (INCR)
+type RedisIDAllocator struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisIDAllocator подключается к Redis и поднимает счетчик до lastID
+func NewRedisIDAllocator(addr string, key string, lastID int) (*RedisIDAllocator, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisJournalTimeout)
+	defer cancel()
+
+	if err := redisSeedScript.Run(ctx, client, []string{key}, lastID).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ошибка подключения к Redis: %w", err)
+	}
+	return &RedisIDAllocator{client: client, key: key}, nil
+}
+
+// Next атомарно увеличивает счетчик в Redis
+func (a *RedisIDAllocator) Next() (OrderID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisJournalTimeout)
+	defer cancel()
+
+	id, err := a.client.Incr(ctx, a.key).Result()
+	if err != nil {
+		return "", fmt.Errorf("ошибка при выдаче ID заказа: %w", err)
+	}
+	return OrderIDFromInt(int(id)), nil
+}
+
+// Close закрывает соединение с Redis
+func (a *RedisIDAllocator) Close() error {
+	return a.client.Close()
+}
+
+// ulidAlphabet алфавит Crockford Base32, которым кодируется ULID
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDAllocator выдает ULID: 48 бит времени в миллисекундах и 80 случайных бит.
+// Общий счетчик не нужен, поэтому ID уникальны и между процессами. В пределах одной
+// миллисекунды случайная часть увеличивается на единицу, и ID процесса строго растут.
+type ULIDAllocator struct {
+	lastTime uint64   // Время последнего ID в миллисекундах
+	entropy  [10]byte // Случайная часть последнего ID
+	mu       sync.Mutex
+}
+
+// NewULIDAllocator создает распределитель ULID
+func NewULIDAllocator() *ULIDAllocator {
+	return &ULIDAllocator{}
+}
+
+// Next выдает следующий ULID
+func (a *ULIDAllocator) Next() (OrderID, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := uint64(time.Now().UnixMilli())
+	if now > a.lastTime {
+		if _, err := rand.Read(a.entropy[:]); err != nil {
+			return "", fmt.Errorf("ошибка при выдаче ID заказа: %w", err)
+		}
+		a.lastTime = now
+	} else if !incrementEntropy(&a.entropy) {
+		// Случайная часть исчерпана в этой миллисекунде: переходим к следующей
+		a.lastTime++
+		if _, err := rand.Read(a.entropy[:]); err != nil {
+			return "", fmt.Errorf("ошибка при выдаче ID заказа: %w", err)
+		}
+	}
+	return OrderID(encodeULID(a.lastTime, a.entropy)), nil
+}
+
+// Close ничего не делает
+func (a *ULIDAllocator) Close() error {
+	return nil
+}
+
+// incrementEntropy увеличивает случайную часть на единицу; false - переполнение
+func incrementEntropy(entropy *[10]byte) bool {
+	for i := len(entropy) - 1; i >= 0; i-- {
+		entropy[i]++
+		if entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID кодирует время и случайную часть в 26 символов Crockford Base32
+func encodeULID(ms uint64, entropy [10]byte) string {
+	var data [16]byte
+	binary.BigEndian.PutUint16(data[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(data[2:6], uint32(ms))
+	copy(data[6:], entropy[:])
+
+	// 128 бит кодируются 26 символами по 5 бит, старший символ содержит 3 бита
+	high := binary.BigEndian.Uint64(data[0:8])
+	low := binary.BigEndian.Uint64(data[8:16])
+	var result [26]byte
+	for i := 25; i >= 0; i-- {
+		result[i] = ulidAlphabet[low&31]
+		low = low>>5 | high<<59
+		high >>= 5
+	}
+	return string(result[:])
+}
+
+// isULID проверяет, что строка - ULID в каноническом виде
+func isULID(value string) bool {
+	if len(value) != 26 || value[0] > '7' {
+		return false
+	}
+	for i := 0; i < len(value); i++ {
+		if strings.IndexByte(ulidAlphabet, value[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
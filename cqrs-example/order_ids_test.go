@@ -0,0 +1,103 @@
+// order_ids_test.go
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEncodeULID(t *testing.T) {
+	// Время из примера спецификации ULID: 01ARZ3NDEK...
+	id := encodeULID(1469922850259, [10]byte{})
+	if !strings.HasPrefix(id, "01ARZ3NDEK") || id[10:] != strings.Repeat("0", 16) {
+		t.Fatalf("encodeULID = %s", id)
+	}
+	if !isULID(id) {
+		t.Fatalf("%s не распознан как ULID", id)
+	}
+}
+
+func TestULIDAllocatorMonotonic(t *testing.T) {
+	allocator := NewULIDAllocator()
+	previous := OrderID("")
+	for i := 0; i < 1000; i++ {
+		id, err := allocator.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isULID(string(id)) {
+			t.Fatalf("выдан некорректный ULID %q", id)
+		}
+		if !previous.Less(id) {
+			t.Fatalf("ID не растут: %s после %s", id, previous)
+		}
+		previous = id
+	}
+}
+
+func TestParseOrderID(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"1", true},
+		{"42", true},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", true},
+		{"", false},
+		{"0", false},
+		{"007", false},
+		{"-1", false},
+		{"abc", false},
+		{"01arz3ndektsv4rrffq69g5fav", false}, // Только канонический регистр
+		{"81ARZ3NDEKTSV4RRFFQ69G5FAV", false}, // Больше 128 бит
+	}
+
+	for _, test := range tests {
+		_, err := ParseOrderID(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseOrderID(%q): ошибка %v, ожидалось ok=%v", test.value, err, test.ok)
+		}
+	}
+}
+
+func TestOrderIDJSON(t *testing.T) {
+	tests := []struct {
+		id   OrderID
+		json string
+	}{
+		{"", "0"},
+		{"7", "7"},
+		{"01ARZ3NDEKTSV4RRFFQ69G5FAV", `"01ARZ3NDEKTSV4RRFFQ69G5FAV"`},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.id)
+		if err != nil || string(data) != test.json {
+			t.Fatalf("Marshal(%q) = %s, %v; ожидалось %s", test.id, data, err, test.json)
+		}
+		var id OrderID
+		if err := json.Unmarshal(data, &id); err != nil || id != test.id {
+			t.Fatalf("Unmarshal(%s) = %q, %v", data, id, err)
+		}
+	}
+
+	// Ключи карт пишутся строками в обеих стратегиях, как и до строковых ID
+	data, _ := json.Marshal(map[OrderID]int{"7": 1})
+	if string(data) != `{"7":1}` {
+		t.Fatalf("ключ карты: %s", data)
+	}
+}
+
+func TestOrderIDLess(t *testing.T) {
+	ids := []OrderID{"01ARZ3NDEKTSV4RRFFQ69G5FAV", "10", "", "01ARZ3NDEK0000000000000000", "9"}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+
+	want := []OrderID{"", "9", "10", "01ARZ3NDEK0000000000000000", "01ARZ3NDEKTSV4RRFFQ69G5FAV"}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("порядок %v, ожидался %v", ids, want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// order_query.go
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultOrdersLimit размер страницы GET /orders по умолчанию
+const defaultOrdersLimit = 100
+
+// Поля сортировки заказов
+const (
+	OrderSortID      = "id"
+	OrderSortCreated = "created_at"
+	OrderSortUpdated = "updated_at"
+)
+
+// OrderQuery фильтры, сортировка и страница списка заказов
+type OrderQuery struct {
+	Status      string    // Фильтр по статусу
+	CustomerID  string    // Фильтр по клиенту
+	CreatedFrom time.Time // Созданы не раньше (нулевое - без ограничения)
+	CreatedTo   time.Time // Созданы раньше (нулевое - без ограничения)
+	Sort        string    // Поле сортировки: id, created_at или updated_at
+	Desc        bool      // Сортировка по убыванию
+	After       *orderKey // Курсор: ключ последнего заказа предыдущей страницы
+	Limit       int       // Размер страницы
+}
+
+// OrderPage страница списка заказов
+type OrderPage struct {
+	Orders     []*OrderState
+	NextCursor string // Курсор следующей страницы ("" - страниц больше нет)
+}
+
+// orderKey ключ заказа в отсортированном индексе: значение поля сортировки и ID
+type orderKey struct {
+	Value int64   `json:"v"`
+	ID    OrderID `json:"id"`
+}
+
+// less сравнивает ключи: сначала по значению, при равенстве - по ID
+func (k orderKey) less(other orderKey) bool {
+	if k.Value != other.Value {
+		return k.Value < other.Value
+	}
+	return k.ID.Less(other.ID)
+}
+
+// orderCursor содержимое курсора страницы
+type orderCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	orderKey
+}
+
+// sortKey возвращает ключ заказа для поля сортировки
+func sortKey(order *OrderState, field string) orderKey {
+	switch field {
+	case OrderSortCreated:
+		return orderKey{Value: order.CreateTime.UnixNano(), ID: order.ID}
+	case OrderSortUpdated:
+		return orderKey{Value: order.UpdateTime.UnixNano(), ID: order.ID}
+	}
+	// Для сортировки по ID порядок задает сам ID (числа, затем ULID)
+	return orderKey{ID: order.ID}
+}
+
+// ParseOrderQuery разбирает параметры GET /orders: status, customer_id,
+// created_from, created_to (RFC3339), sort (id, created_at, updated_at; "-" - по убыванию),
+// cursor и limit
+func ParseOrderQuery(r *http.Request) (OrderQuery, error) {
+	values := r.URL.Query()
+	query := OrderQuery{
+		Status:     values.Get("status"),
+		CustomerID: values.Get("customer_id"),
+		Sort:       OrderSortID,
+		Limit:      defaultOrdersLimit,
+	}
+
+	var err error
+	if value := values.Get("created_from"); value != "" {
+		if query.CreatedFrom, err = time.Parse(time.RFC3339, value); err != nil {
+			return OrderQuery{}, fmt.Errorf("параметр created_from должен быть временем RFC3339: %q", value)
+		}
+	}
+	if value := values.Get("created_to"); value != "" {
+		if query.CreatedTo, err = time.Parse(time.RFC3339, value); err != nil {
+			return OrderQuery{}, fmt.Errorf("параметр created_to должен быть временем RFC3339: %q", value)
+		}
+	}
+
+	if value := values.Get("sort"); value != "" {
+		query.Desc = strings.HasPrefix(value, "-")
+		query.Sort = strings.TrimPrefix(value, "-")
+		switch query.Sort {
+		case OrderSortID, OrderSortCreated, OrderSortUpdated:
+		default:
+			return OrderQuery{}, fmt.Errorf("неизвестная сортировка: %q (ожидается id, created_at или updated_at, \"-\" - по убыванию)", value)
+		}
+	}
+
+	if query.Limit, err = parseLimit(r, defaultOrdersLimit); err != nil {
+		return OrderQuery{}, err
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		cursor, err := decodeOrderCursor(value)
+		if err != nil {
+			return OrderQuery{}, err
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return OrderQuery{}, fmt.Errorf("курсор получен для другой сортировки, повторите запрос без cursor")
+		}
+		query.After = &cursor.orderKey
+	}
+	return query, nil
+}
+
+// Match проверяет, подходит ли заказ под фильтры запроса
+func (q OrderQuery) Match(order *OrderState) bool {
+	if q.Status != "" && order.Status != q.Status {
+		return false
+	}
+	if q.CustomerID != "" && order.CustomerID != q.CustomerID {
+		return false
+	}
+	if !q.CreatedFrom.IsZero() && order.CreateTime.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !order.CreateTime.Before(q.CreatedTo) {
+		return false
+	}
+	return true
+}
+
+// afterCursor проверяет, идет ли ключ после курсора в порядке сортировки
+func (q OrderQuery) afterCursor(key orderKey) bool {
+	if q.After == nil {
+		return true
+	}
+	if q.Desc {
+		return key.less(*q.After)
+	}
+	return q.After.less(key)
+}
+
+// page собирает страницу из заказов, уже отсортированных в порядке запроса и прошедших курсор.
+// Передавайте не больше Limit+1 заказов: лишний означает, что есть следующая страница.
+func (q OrderQuery) page(orders []*OrderState) OrderPage {
+	if len(orders) <= q.Limit {
+		return OrderPage{Orders: orders}
+	}
+
+	orders = orders[:q.Limit]
+	last := orders[len(orders)-1]
+	return OrderPage{
+		Orders:     orders,
+		NextCursor: encodeOrderCursor(orderCursor{Sort: q.Sort, Desc: q.Desc, orderKey: sortKey(last, q.Sort)}),
+	}
+}
+
+// FilterOrders применяет запрос к списку заказов полным просмотром,
+// например к заказам, восстановленным на момент as_of
+func FilterOrders(orders []*OrderState, query OrderQuery) OrderPage {
+	matched := make([]*OrderState, 0, len(orders))
+	for _, order := range orders {
+		if query.Match(order) && query.afterCursor(sortKey(order, query.Sort)) {
+			matched = append(matched, order)
+		}
+	}
+	sortOrders(matched, query)
+
+	return query.page(matched[:min(len(matched), query.Limit+1)])
+}
+
+// sortOrders сортирует заказы в порядке запроса
+func sortOrders(orders []*OrderState, query OrderQuery) {
+	sort.Slice(orders, func(i, j int) bool {
+		if query.Desc {
+			return sortKey(orders[j], query.Sort).less(sortKey(orders[i], query.Sort))
+		}
+		return sortKey(orders[i], query.Sort).less(sortKey(orders[j], query.Sort))
+	})
+}
+
+// encodeOrderCursor кодирует курсор страницы в непрозрачную строку
+func encodeOrderCursor(cursor orderCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeOrderCursor разбирает курсор, выданный encodeOrderCursor
+func decodeOrderCursor(value string) (orderCursor, error) {
+	var cursor orderCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		return orderCursor{}, fmt.Errorf("некорректный курсор: %q", value)
+	}
+	return cursor, nil
+}
+
+// orderIndex отсортированный индекс заказов по ключу
+type orderIndex []orderKey
+
+// search возвращает позицию первого ключа не меньше key
+func (idx orderIndex) search(key orderKey) int {
+	return sort.Search(len(idx), func(i int) bool {
+		return !idx[i].less(key)
+	})
+}
+
+// insert добавляет ключ, сохраняя порядок
+func (idx *orderIndex) insert(key orderKey) {
+	i := idx.search(key)
+	*idx = append(*idx, orderKey{})
+	copy((*idx)[i+1:], (*idx)[i:])
+	(*idx)[i] = key
+}
+
+// remove удаляет ключ, если он есть в индексе
+func (idx *orderIndex) remove(key orderKey) {
+	i := idx.search(key)
+	if i < len(*idx) && (*idx)[i] == key {
+		*idx = append((*idx)[:i], (*idx)[i+1:]...)
+	}
+}
@@ -0,0 +1,179 @@
+// order_query_test.go
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queryTestTime время создания тестового заказа: 10:00 плюс minute минут
+func queryTestTime(minute int) time.Time {
+	return time.Date(2025, 1, 1, 10, minute, 0, 0, time.UTC)
+}
+
+// createTestOrder добавляет в проекцию заказ, созданный в 10:00 плюс minute минут
+func createTestOrder(p *OrderProjection, id OrderID, minute int) {
+	p.UpdateProjection(OrderCreatedEvent{
+		BaseEvent:  BaseEvent{OrderID: id, Timestamp: queryTestTime(minute)},
+		CustomerID: "alice",
+	})
+}
+
+// orderIDs возвращает ID заказов страницы
+func orderIDs(orders []*OrderState) []OrderID {
+	ids := make([]OrderID, 0, len(orders))
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+	}
+	return ids
+}
+
+// nextPage разбирает курсор страницы так же, как ParseOrderQuery
+func nextPage(t *testing.T, query OrderQuery, page OrderPage) OrderQuery {
+	t.Helper()
+	cursor, err := decodeOrderCursor(page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query.After = &cursor.orderKey
+	return query
+}
+
+func TestOrderQueryCursorStableAcrossInserts(t *testing.T) {
+	tests := []struct {
+		name  string
+		query OrderQuery
+		// Первая страница и все остальные, прочитанные после вставки заказов #2 (10:15) и #7 (10:02):
+		// новые заказы после курсора попадают в выдачу, до курсора - нет
+		first []OrderID
+		rest  []OrderID
+	}{
+		{
+			name:  "по ID, индекс",
+			query: OrderQuery{Sort: OrderSortID, Limit: 2},
+			first: []OrderID{"1", "3"},
+			rest:  []OrderID{"4", "5", "7"},
+		},
+		{
+			name:  "по ID по убыванию, индекс",
+			query: OrderQuery{Sort: OrderSortID, Desc: true, Limit: 2},
+			first: []OrderID{"5", "4"},
+			rest:  []OrderID{"3", "2", "1"},
+		},
+		{
+			name:  "по времени создания, индекс",
+			query: OrderQuery{Sort: OrderSortCreated, Limit: 2},
+			first: []OrderID{"1", "3"},
+			rest:  []OrderID{"4", "2", "5"},
+		},
+		{
+			name:  "по времени создания, фильтр по клиенту",
+			query: OrderQuery{Sort: OrderSortCreated, CustomerID: "alice", Limit: 2},
+			first: []OrderID{"1", "3"},
+			rest:  []OrderID{"4", "2", "5"},
+		},
+		{
+			name:  "по времени создания по убыванию, фильтр по статусу",
+			query: OrderQuery{Sort: OrderSortCreated, Desc: true, Status: StatusCreated, Limit: 2},
+			first: []OrderID{"5", "4"},
+			rest:  []OrderID{"3", "7", "1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewOrderProjection()
+			createTestOrder(p, "1", 0)
+			createTestOrder(p, "3", 5)
+			createTestOrder(p, "4", 10)
+			createTestOrder(p, "5", 20)
+
+			page := p.Query(test.query)
+			if got := orderIDs(page.Orders); !reflect.DeepEqual(got, test.first) {
+				t.Fatalf("первая страница %v, ожидалась %v", got, test.first)
+			}
+			if page.NextCursor == "" {
+				t.Fatal("нет курсора следующей страницы")
+			}
+
+			// Между страницами добавлены заказы до и после курсора: уже выданные
+			// не повторяются, ранее существовавшие не пропускаются
+			createTestOrder(p, "2", 15)
+			createTestOrder(p, "7", 2)
+
+			query := test.query
+			rest := []OrderID{}
+			for page.NextCursor != "" && len(rest) < 10 {
+				query = nextPage(t, query, page)
+				page = p.Query(query)
+				rest = append(rest, orderIDs(page.Orders)...)
+			}
+			if !reflect.DeepEqual(rest, test.rest) {
+				t.Fatalf("следующие страницы %v, ожидались %v", rest, test.rest)
+			}
+		})
+	}
+}
+
+func TestOrderQueryCreatedRangeOnIndex(t *testing.T) {
+	p := NewOrderProjection()
+	createTestOrder(p, "1", 0)
+	createTestOrder(p, "2", 10)
+	createTestOrder(p, "3", 10)
+	createTestOrder(p, "4", 20)
+	createTestOrder(p, "5", 30)
+
+	all := make([]*OrderState, 0, 5)
+	for _, id := range []OrderID{"1", "2", "3", "4", "5"} {
+		all = append(all, p.GetOrder(id))
+	}
+
+	tests := []struct {
+		name string
+		from time.Time
+		to   time.Time
+		want []OrderID // По возрастанию времени создания
+	}{
+		{"created_to исключает заказы на границе", time.Time{}, queryTestTime(10), []OrderID{"1"}},
+		{"created_to между заказами", time.Time{}, queryTestTime(15), []OrderID{"1", "2", "3"}},
+		{"created_from включает заказы на границе", queryTestTime(10), time.Time{}, []OrderID{"2", "3", "4", "5"}},
+		{"диапазон по границам заказов", queryTestTime(10), queryTestTime(30), []OrderID{"2", "3", "4"}},
+		{"created_to раньше всех заказов", time.Time{}, queryTestTime(0), []OrderID{}},
+		{"created_from позже всех заказов", queryTestTime(31), time.Time{}, []OrderID{}},
+		{"пустой диапазон", queryTestTime(20), queryTestTime(10), []OrderID{}},
+	}
+
+	for _, test := range tests {
+		for _, desc := range []bool{false, true} {
+			want := test.want
+			if desc {
+				want = make([]OrderID, len(test.want))
+				for i, id := range test.want {
+					want[len(want)-1-i] = id
+				}
+			}
+
+			// Читаем постранично по одному заказу, чтобы проверить и курсор на границах
+			query := OrderQuery{Sort: OrderSortCreated, Desc: desc, CreatedFrom: test.from, CreatedTo: test.to, Limit: 1}
+			got := []OrderID{}
+			for range 10 {
+				page := p.Query(query)
+				got = append(got, orderIDs(page.Orders)...)
+				if page.NextCursor == "" {
+					break
+				}
+				query = nextPage(t, query, page)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s (desc=%v): заказы %v, ожидались %v", test.name, desc, got, want)
+			}
+
+			// Индекс дает тот же результат, что и полный просмотр
+			query.After, query.Limit = nil, 10
+			if scanned := orderIDs(FilterOrders(all, query).Orders); !reflect.DeepEqual(scanned, want) {
+				t.Errorf("%s (desc=%v): полный просмотр %v, ожидалось %v", test.name, desc, scanned, want)
+			}
+		}
+	}
+}
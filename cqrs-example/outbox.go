@@ -0,0 +1,408 @@
+// outbox.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	outboxBatchSize     = 100                    // Сколько событий публиковать за раз
+	outboxMinBackoff    = 100 * time.Millisecond // Первая пауза перед повтором публикации
+	outboxMaxBackoff    = 30 * time.Second       // Максимальная пауза перед повтором
+	outboxPublishTimout = 10 * time.Second       // Таймаут одной публикации
+)
+
+// OutboxMessage событие лога, подготовленное к публикации во внешний брокер
+type OutboxMessage struct {
+	Key      string // Ключ сообщения (ID заказа): события одного заказа попадают в одну партицию
+	Type     string // Тип события
+	EventID  string // Уникальный ID события для дедупликации у получателя
+	Position int64  // Глобальная позиция события
+	Data     []byte // Событие в формате EventDTO
+
+	Metadata EventMetadata // Происхождение события: передается в заголовках для трассировки
+}
+
+// metadataHeaders возвращает заголовки с метаданными происхождения события (только заданные)
+func (m OutboxMessage) metadataHeaders() map[string]string {
+	headers := make(map[string]string)
+	for key, value := range map[string]string{
+		"correlation_id": m.Metadata.CorrelationID,
+		"causation_id":   m.Metadata.CausationID,
+		"source":         m.Metadata.Source,
+	} {
+		if value != "" {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// Publisher публикует события во внешний брокер
+type Publisher interface {
+	// Publish публикует пачку событий; при ошибке пачка будет отправлена повторно
+	Publish(ctx context.Context, messages []OutboxMessage) error
+	Close() error
+}
+
+// OutboxConfig настройки публикации событий во внешний брокер
+type OutboxConfig struct {
+	Broker       string   // none, log, kafka или nats
+	KafkaBrokers []string // Адреса брокеров Kafka
+	KafkaTopic   string   // Топик Kafka
+	NATSURL      string   // Адрес NATS
+	NATSSubject  string   // Префикс темы NATS; тема события - <префикс>.<тип события>
+}
+
+// NewPublisher создает публикатор для брокера из настроек
+func NewPublisher(config OutboxConfig) (Publisher, error) {
+	switch config.Broker {
+	case "log":
+		return LogPublisher{}, nil
+	case "kafka":
+		return NewKafkaPublisher(config.KafkaBrokers, config.KafkaTopic), nil
+	case "nats":
+		return NewNATSPublisher(config.NATSURL, config.NATSSubject)
+	}
+	return nil, fmt.Errorf("неизвестный брокер для публикации событий: %q (ожидается none, log, kafka или nats)", config.Broker)
+}
+
+// LogPublisher пишет события в журнал сервера; удобен для проверки без брокера
+type LogPublisher struct{}
+
+// Publish пишет события в журнал
+func (LogPublisher) Publish(ctx context.Context, messages []OutboxMessage) error {
+	for _, message := range messages {
+		log.Printf("Outbox: [%d] %s %s", message.Position, message.Type, message.Data)
+	}
+	return nil
+}
+
+// Close ничего не делает
+func (LogPublisher) Close() error {
+	return nil
+}
+
+// KafkaPublisher публикует события в топик Kafka с заголовком event_type
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher создает публикатор Kafka
+func NewKafkaPublisher(brokers []string, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:  kafka.TCP(brokers...),
+			Topic: topic,
+			// Ключ - ID заказа, поэтому события заказа сохраняют порядок внутри партиции
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+// Publish синхронно записывает пачку событий в Kafka
+func (p *KafkaPublisher) Publish(ctx context.Context, messages []OutboxMessage) error {
+	batch := make([]kafka.Message, 0, len(messages))
+	for _, message := range messages {
+		headers := []kafka.Header{
+			{Key: "event_type", Value: []byte(message.Type)},
+			{Key: "event_id", Value: []byte(message.EventID)},
+			{Key: "position", Value: []byte(strconv.FormatInt(message.Position, 10))},
+		}
+		for key, value := range message.metadataHeaders() {
+			headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+		}
+		batch = append(batch, kafka.Message{
+			Key:     []byte(message.Key),
+			Value:   message.Data,
+			Headers: headers,
+		})
+	}
+	return p.writer.WriteMessages(ctx, batch...)
+}
+
+// Close закрывает соединения с Kafka
+func (p *KafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// NATSPublisher публикует события в темы NATS вида <префикс>.<тип события>
+type NATSPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATSPublisher подключается к NATS
+func NewNATSPublisher(url string, subject string) (*NATSPublisher, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к NATS: %w", err)
+	}
+	return &NATSPublisher{conn: conn, subject: subject}, nil
+}
+
+// Publish публикует пачку событий и ждет, пока сервер NATS их примет
+func (p *NATSPublisher) Publish(ctx context.Context, messages []OutboxMessage) error {
+	for _, message := range messages {
+		msg := nats.NewMsg(p.subject + "." + message.Type)
+		msg.Data = message.Data
+		// Nats-Msg-Id позволяет JetStream отбросить повтор при публикации "хотя бы один раз"
+		msg.Header.Set(nats.MsgIdHdr, message.EventID)
+		msg.Header.Set("event_type", message.Type)
+		msg.Header.Set("position", strconv.FormatInt(message.Position, 10))
+		for key, value := range message.metadataHeaders() {
+			msg.Header.Set(key, value)
+		}
+		if err := p.conn.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+// Close закрывает соединение с NATS
+func (p *NATSPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
+
+// OutboxStats состояние публикации событий
+type OutboxStats struct {
+	Broker          string     `json:"broker"`
+	Position        int64      `json:"position"`      // Последнее опубликованное событие
+	LastPosition    int64      `json:"last_position"` // Последнее событие лога
+	Lag             int64      `json:"lag"`           // Сколько событий еще не опубликовано
+	Published       int64      `json:"published"`     // Опубликовано с момента запуска
+	Failures        int64      `json:"failures"`      // Неудачных попыток с момента запуска
+	Retrying        bool       `json:"retrying"`      // Публикация повторяется после ошибки
+	LastError       string     `json:"last_error,omitempty"`
+	LastPublishedAt *time.Time `json:"last_published_at,omitempty"`
+}
+
+// OutboxRelay читает лог событий с сохраненной позиции и публикует каждое событие
+// во внешний брокер хотя бы один раз: позиция сохраняется только после успешной публикации,
+// поэтому после сбоя или перезапуска неподтвержденные события отправляются повторно
+type OutboxRelay struct {
+	store       *EventStore
+	publisher   Publisher
+	checkpoints CheckpointStore
+	name        string // Имя контрольной точки
+
+	mu    sync.Mutex
+	stats OutboxStats
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartOutboxRelay восстанавливает позицию публикации и запускает публикацию событий
+func StartOutboxRelay(store *EventStore, broker string, publisher Publisher, checkpoints CheckpointStore) (*OutboxRelay, error) {
+	name := "outbox-" + broker
+	checkpoint, err := checkpoints.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var position int64
+	if checkpoint != nil {
+		position = min(checkpoint.Position, store.LastPosition())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	relay := &OutboxRelay{
+		store:       store,
+		publisher:   publisher,
+		checkpoints: checkpoints,
+		name:        name,
+		stats:       OutboxStats{Broker: broker, Position: position},
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+	log.Printf("Публикация событий в %s продолжается с позиции %d", broker, position)
+
+	go relay.run(position)
+	return relay, nil
+}
+
+// Stats возвращает состояние публикации и отставание от конца лога
+func (r *OutboxRelay) Stats() OutboxStats {
+	r.mu.Lock()
+	stats := r.stats
+	r.mu.Unlock()
+
+	stats.LastPosition = r.store.LastPosition()
+	stats.Lag = max(stats.LastPosition-stats.Position, 0)
+	return stats
+}
+
+// Close останавливает публикацию и закрывает соединение с брокером
+func (r *OutboxRelay) Close() error {
+	r.cancel()
+	<-r.done
+	return r.publisher.Close()
+}
+
+// run публикует события пачками, ожидая новых событий в конце лога
+func (r *OutboxRelay) run(position int64) {
+	defer close(r.done)
+
+	for {
+		// Канал ожидания берем до чтения, чтобы не пропустить запись между ними
+		changed := r.store.Changed()
+
+		records, next, _ := r.store.ReadEvents(EventQuery{After: position, Limit: outboxBatchSize})
+		if len(records) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-r.ctx.Done():
+				return
+			}
+		}
+
+		messages, err := r.encode(records)
+		if err != nil {
+			// Событие, которое нельзя закодировать, не опубликуется и при повторе
+			log.Printf("Outbox: ошибка при кодировании событий после позиции %d: %v", position, err)
+			r.recordFailure(err)
+			if !r.sleep(outboxMaxBackoff) {
+				return
+			}
+			continue
+		}
+
+		if !r.publish(messages) {
+			return
+		}
+		position = next
+		r.saveCheckpoint(position)
+	}
+}
+
+// encode преобразует записи лога в сообщения для брокера
+func (r *OutboxRelay) encode(records []RecordedEvent) ([]OutboxMessage, error) {
+	messages := make([]OutboxMessage, 0, len(records))
+	for _, record := range records {
+		// Персональные данные уходят в брокер зашифрованными: удаление ключа клиента
+		// делает нечитаемыми и уже опубликованные события
+		dto, err := r.store.EncodeRecorded(record)
+		if err == nil {
+			dto, err = eventRegistry.Seal(dto)
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(dto)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, OutboxMessage{
+			Key:      string(dto.OrderID),
+			Type:     dto.Type,
+			EventID:  dto.EventID,
+			Position: dto.Position,
+			Data:     data,
+			Metadata: record.Event.GetMetadata(),
+		})
+	}
+	return messages, nil
+}
+
+// publish публикует пачку, повторяя попытки с экспоненциальной паузой.
+// Возвращает false, если публикация прервана остановкой.
+func (r *OutboxRelay) publish(messages []OutboxMessage) bool {
+	backoff := outboxMinBackoff
+	for {
+		ctx, cancel := context.WithTimeout(r.ctx, outboxPublishTimout)
+		err := r.publisher.Publish(ctx, messages)
+		cancel()
+		if err == nil {
+			r.recordSuccess(messages)
+			return true
+		}
+		if r.ctx.Err() != nil {
+			return false
+		}
+
+		log.Printf("Outbox: ошибка публикации событий %d-%d, повтор через %s: %v",
+			messages[0].Position, messages[len(messages)-1].Position, backoff, err)
+		r.recordFailure(err)
+		if !r.sleep(backoff) {
+			return false
+		}
+		backoff = min(backoff*2, outboxMaxBackoff)
+	}
+}
+
+// sleep ждет паузу; возвращает false, если ожидание прервано остановкой
+func (r *OutboxRelay) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// recordSuccess учитывает успешную публикацию
+func (r *OutboxRelay) recordSuccess(messages []OutboxMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.stats.Position = messages[len(messages)-1].Position
+	r.stats.Published += int64(len(messages))
+	r.stats.Retrying = false
+	r.stats.LastError = ""
+	r.stats.LastPublishedAt = &now
+}
+
+// recordFailure учитывает неудачную попытку публикации
+func (r *OutboxRelay) recordFailure(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Failures++
+	r.stats.Retrying = true
+	r.stats.LastError = err.Error()
+}
+
+// saveCheckpoint сохраняет позицию последнего опубликованного события
+func (r *OutboxRelay) saveCheckpoint(position int64) {
+	err := r.checkpoints.Save(ProjectionCheckpoint{
+		Name:     r.name,
+		Position: position,
+		SavedAt:  time.Now(),
+	})
+	if err != nil {
+		// Позиция будет сохранена со следующей пачкой; при сбое события опубликуются повторно
+		log.Printf("Outbox: ошибка при сохранении позиции %d: %v", position, err)
+	}
+}
+
+// splitList разбирает список значений через запятую
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,315 @@
+// payment_timeout.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	paymentTimeoutReason     = "payment timeout" // Причина автоматической отмены
+	paymentTimeoutRetryDelay = 5 * time.Second   // Пауза перед повтором неудавшейся отмены
+)
+
+// paymentTimeoutActor инициатор автоматической отмены неоплаченных заказов
+var paymentTimeoutActor = Actor{ID: "payment-timeout", Roles: []string{"admin"}}
+
+// PaymentDeadline срок оплаты заказа
+type PaymentDeadline struct {
+	OrderID   OrderID   `json:"order_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Deadline  time.Time `json:"deadline"`  // Когда заказ будет отменен
+	Attempts  int       `json:"attempts"`  // Неудачных попыток отмены
+	Remaining string    `json:"remaining"` // Сколько осталось до отмены
+
+	createdEventID string // ID события OrderCreated - причина отмены
+	correlationID  string // Цепочка, в которой был создан заказ
+}
+
+// PaymentTimeoutManager процесс-менеджер, который отменяет заказы, не оплаченные за отведенное время.
+// Сроки оплаты строятся из лога событий: при старте менеджер читает лог с начала,
+// поэтому после перезапуска сроки восстанавливаются, а просроченные заказы отменяются сразу.
+// Отслеживаются только заказы, созданные после включения автоотмены: заказы, созданные
+// раньше, не отменяются массово при первом запуске с CQRS_PAYMENT_TIMEOUT.
+type PaymentTimeoutManager struct {
+	store     *EventStore
+	bus       *CommandBus
+	timeout   time.Duration
+	since     time.Time                    // Когда автоотмена была включена
+	deadlines map[OrderID]*PaymentDeadline // Заказы в статусе created и сроки их оплаты
+	mu        sync.Mutex
+	wake      chan struct{} // Сигнал планировщику пересчитать ближайший срок
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// StartPaymentTimeoutManager подписывает менеджер на события и запускает планировщик отмен.
+// Время включения автоотмены хранится в файле sincePath ("" - только в памяти).
+func StartPaymentTimeoutManager(store *EventStore, bus *CommandBus, timeout time.Duration, sincePath string, options SubscriptionOptions) (*PaymentTimeoutManager, error) {
+	since, err := loadPaymentTimeoutSince(sincePath)
+	if err != nil {
+		return nil, err
+	}
+
+	manager := &PaymentTimeoutManager{
+		store:     store,
+		bus:       bus,
+		timeout:   timeout,
+		since:     since,
+		deadlines: make(map[OrderID]*PaymentDeadline),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	// Подписка с начала лога восстанавливает сроки; при потере событий состояние строится заново
+	options.Rebuild = manager.rebuild
+	store.Subscribe("PaymentTimeoutManager", 0, options, manager.apply)
+
+	go manager.run()
+	return manager, nil
+}
+
+// paymentTimeoutState содержимое файла автоотмены
+type paymentTimeoutState struct {
+	EnabledSince time.Time `json:"enabled_since"`
+}
+
+// loadPaymentTimeoutSince возвращает время включения автоотмены.
+// При первом включении запоминает текущее время.
+func loadPaymentTimeoutSince(path string) (time.Time, error) {
+	now := time.Now()
+	if path == "" {
+		return now, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var state paymentTimeoutState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return time.Time{}, fmt.Errorf("ошибка при разборе %s: %w", path, err)
+		}
+		return state.EnabledSince, nil
+	}
+	if !os.IsNotExist(err) {
+		return time.Time{}, fmt.Errorf("ошибка при чтении %s: %w", path, err)
+	}
+
+	data, err = json.Marshal(paymentTimeoutState{EnabledSince: now})
+	if err != nil {
+		return time.Time{}, err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return time.Time{}, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return time.Time{}, err
+	}
+	log.Printf("Автоотмена неоплаченных заказов включена: отслеживаются заказы, созданные после %s", now.Format(time.RFC3339))
+	return now, nil
+}
+
+// ResetPaymentTimeoutSince забывает время включения автоотмены, когда она выключена:
+// после повторного включения заказы, созданные до него, снова не отменяются
+func ResetPaymentTimeoutSince(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close останавливает планировщик; вызывается до закрытия хранилища событий
+func (m *PaymentTimeoutManager) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+// Deadlines возвращает ожидающие оплаты заказы, отсортированные по сроку
+func (m *PaymentTimeoutManager) Deadlines() []PaymentDeadline {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	result := make([]PaymentDeadline, 0, len(m.deadlines))
+	for _, deadline := range m.deadlines {
+		item := *deadline
+		item.Remaining = max(item.Deadline.Sub(now), 0).Round(time.Second).String()
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Deadline.Before(result[j].Deadline)
+	})
+	return result
+}
+
+// apply запускает отсчет при создании заказа и снимает его, когда заказ покидает статус created
+func (m *PaymentTimeoutManager) apply(record RecordedEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.applyLocked(record)
+}
+
+// applyLocked применяет событие к срокам оплаты (вызывается под блокировкой)
+func (m *PaymentTimeoutManager) applyLocked(record RecordedEvent) {
+	event := record.Event
+	orderID := event.GetOrderID()
+	if created, ok := event.(OrderCreatedEvent); ok {
+		if created.Timestamp.Before(m.since) {
+			// Заказ создан до включения автоотмены
+			return
+		}
+		m.deadlines[orderID] = &PaymentDeadline{
+			OrderID:        orderID,
+			CreatedAt:      created.Timestamp,
+			Deadline:       created.Timestamp.Add(m.timeout),
+			createdEventID: record.EventID,
+			correlationID:  created.Metadata.CorrelationID,
+		}
+		m.notify()
+		return
+	}
+
+	if status, found := orderStateMachine.StatusAfter(event.GetType()); found && status != StatusCreated {
+		delete(m.deadlines, orderID)
+	}
+}
+
+// rebuild строит сроки оплаты заново по всему логу и возвращает позицию последнего события
+func (m *PaymentTimeoutManager) rebuild() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deadlines = make(map[OrderID]*PaymentDeadline)
+	var position int64
+	for {
+		records, next, hasMore := m.store.ReadEvents(EventQuery{After: position, Limit: maxEventsLimit})
+		for _, record := range records {
+			m.applyLocked(record)
+		}
+		position = next
+		if !hasMore {
+			break
+		}
+	}
+	m.notify()
+	return position
+}
+
+// notify будит планировщик, не блокируясь
+func (m *PaymentTimeoutManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run ждет ближайшего срока оплаты и отменяет просроченные заказы
+func (m *PaymentTimeoutManager) run() {
+	defer close(m.done)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.wake:
+		case <-timer.C:
+			m.cancelExpired()
+		}
+
+		timer.Stop()
+		if next, found := m.nextDeadline(); found {
+			timer.Reset(max(time.Until(next), 0))
+		}
+	}
+}
+
+// nextDeadline возвращает ближайший срок оплаты
+func (m *PaymentTimeoutManager) nextDeadline() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var next time.Time
+	for _, deadline := range m.deadlines {
+		if next.IsZero() || deadline.Deadline.Before(next) {
+			next = deadline.Deadline
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// cancelExpired отправляет CancelOrderCommand для каждого просроченного заказа
+func (m *PaymentTimeoutManager) cancelExpired() {
+	now := time.Now()
+
+	m.mu.Lock()
+	var expired []PaymentDeadline
+	for _, deadline := range m.deadlines {
+		if !deadline.Deadline.After(now) {
+			expired = append(expired, *deadline)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].OrderID < expired[j].OrderID
+	})
+
+	for _, deadline := range expired {
+		orderID := deadline.OrderID
+
+		// Отмена продолжает цепочку, в которой был создан заказ, и вызвана его созданием
+		ctx := WithEventMetadata(WithActor(context.Background(), paymentTimeoutActor), EventMetadata{
+			CorrelationID: deadline.correlationID,
+			CausationID:   deadline.createdEventID,
+			Source:        SourcePaymentTimeout,
+		})
+		_, err := m.bus.Dispatch(ctx, CancelOrderCommand{OrderID: orderID, Reason: paymentTimeoutReason})
+
+		var transition *TransitionError
+		switch {
+		case err == nil:
+			log.Printf("Заказ #%s не оплачен за %s и отменен", orderID, m.timeout)
+			m.remove(orderID)
+		case errors.As(err, &transition), errors.Is(err, ErrOrderNotFound):
+			// Заказ уже оплачен или отменен, событие еще не дошло до менеджера
+			m.remove(orderID)
+		default:
+			log.Printf("Ошибка при отмене неоплаченного заказа #%s, повтор через %s: %v",
+				orderID, paymentTimeoutRetryDelay, err)
+			m.postpone(orderID, now.Add(paymentTimeoutRetryDelay))
+		}
+	}
+}
+
+// remove снимает срок оплаты заказа
+func (m *PaymentTimeoutManager) remove(orderID OrderID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.deadlines, orderID)
+}
+
+// postpone откладывает повтор отмены заказа
+func (m *PaymentTimeoutManager) postpone(orderID OrderID, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if deadline, found := m.deadlines[orderID]; found {
+		deadline.Deadline = until
+		deadline.Attempts++
+	}
+}
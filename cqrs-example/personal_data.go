@@ -0,0 +1,350 @@
+// personal_data.go
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RedactedValue подставляется вместо персональных данных удаленного клиента
+	RedactedValue = "[redacted]"
+	// sealedPrefix префикс зашифрованного значения: pii:v1:<ID ключа>:<base64(nonce|шифротекст)>
+	sealedPrefix = "pii:v1:"
+)
+
+// PersonalDataCipher шифрует персональные данные событий ключом их владельца
+type PersonalDataCipher interface {
+	// Encrypt шифрует значение ключом владельца данных, создавая ключ при необходимости
+	Encrypt(subject string, value string) (string, error)
+	// Decrypt расшифровывает значение; erased - ключ удален и данные недоступны
+	Decrypt(sealed string) (value string, erased bool, err error)
+	// IsForgotten проверяет, удалены ли данные владельца (для записей, сделанных без шифрования)
+	IsForgotten(subject string) bool
+	// HasKey проверяет, что у владельца уже есть ключ (он известен как клиент)
+	HasKey(subject string) bool
+}
+
+// SubjectKey ключ шифрования персональных данных одного клиента
+type SubjectKey struct {
+	ID        string    `json:"id"`
+	Subject   string    `json:"subject"` // ID клиента
+	Key       []byte    `json:"key"`     // Ключ AES-256
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// keyStoreFile содержимое файла ключей
+type keyStoreFile struct {
+	Keys            []SubjectKey `json:"keys"`
+	Secret          []byte       `json:"secret,omitempty"`           // Ключ HMAC для списка удаленных клиентов
+	Forgotten       []string     `json:"forgotten"`                  // HMAC-SHA256 ID удаленных клиентов
+	LegacyForgotten []string     `json:"legacy_forgotten,omitempty"` // SHA-256 ID клиентов, удаленных до появления Secret
+	LastErasure     time.Time    `json:"last_erasure"`               // Время последнего удаления данных
+}
+
+// KeyStore хранит ключи шифрования персональных данных отдельно от лога событий.
+// Удаление ключа делает зашифрованные им данные в логе нечитаемыми (crypto-shredding).
+type KeyStore struct {
+	path        string                 // Путь к файлу ключей ("" - только в памяти)
+	bySubject   map[string]*SubjectKey // Ключи по ID клиента
+	byID        map[string]*SubjectKey // Ключи по ID ключа
+	secret      []byte                 // Ключ HMAC для списка удаленных клиентов
+	forgotten   map[string]bool        // HMAC-SHA256 ID удаленных клиентов
+	legacy      map[string]bool        // SHA-256 ID клиентов, удаленных до появления secret
+	lastErasure time.Time
+	mu          sync.RWMutex
+}
+
+// NewKeyStore создает хранилище ключей и загружает ключи из файла.
+// С пустым путем ключи хранятся только в памяти.
+func NewKeyStore(path string) (*KeyStore, error) {
+	store := &KeyStore{
+		path:      path,
+		bySubject: make(map[string]*SubjectKey),
+		byID:      make(map[string]*SubjectKey),
+		forgotten: make(map[string]bool),
+		legacy:    make(map[string]bool),
+	}
+	if path == "" {
+		return store, store.newSecret()
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, store.newSecret()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при чтении ключей персональных данных: %w", err)
+	}
+
+	var file keyStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("ошибка при разборе ключей персональных данных: %w", err)
+	}
+	for i := range file.Keys {
+		key := &file.Keys[i]
+		store.bySubject[key.Subject] = key
+		store.byID[key.ID] = key
+	}
+	for _, hash := range file.LegacyForgotten {
+		store.legacy[hash] = true
+	}
+	store.lastErasure = file.LastErasure
+
+	if len(file.Secret) > 0 {
+		store.secret = file.Secret
+		for _, hash := range file.Forgotten {
+			store.forgotten[hash] = true
+		}
+		return store, nil
+	}
+
+	// Файл записан до появления секрета: в списке удаленных простые SHA-256 ID.
+	// Они переводятся в HMAC, когда ID клиента встретится в логе (см. IsForgotten).
+	for _, hash := range file.Forgotten {
+		store.legacy[hash] = true
+	}
+	if err := store.newSecret(); err != nil {
+		return nil, err
+	}
+	if err := store.persist(); err != nil {
+		return nil, fmt.Errorf("ошибка при сохранении ключей персональных данных: %w", err)
+	}
+	return store, nil
+}
+
+// newSecret создает ключ HMAC для списка удаленных клиентов
+func (s *KeyStore) newSecret() error {
+	s.secret = make([]byte, 32)
+	_, err := rand.Read(s.secret)
+	return err
+}
+
+// Encrypt шифрует значение ключом клиента subject
+func (s *KeyStore) Encrypt(subject string, value string) (string, error) {
+	key, err := s.subjectKey(subject)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newKeyCipher(key.Key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(key.ID))
+	return sealedPrefix + key.ID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt расшифровывает значение, зашифрованное Encrypt
+func (s *KeyStore) Decrypt(sealed string) (string, bool, error) {
+	keyID, payload, ok := strings.Cut(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	if !ok {
+		return "", false, errors.New("некорректное зашифрованное значение")
+	}
+
+	s.mu.RLock()
+	key, found := s.byID[keyID]
+	s.mu.RUnlock()
+	if !found {
+		return "", true, nil
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false, fmt.Errorf("некорректное зашифрованное значение: %w", err)
+	}
+	aead, err := newKeyCipher(key.Key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(data) < aead.NonceSize() {
+		return "", false, errors.New("некорректное зашифрованное значение")
+	}
+	value, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return "", false, fmt.Errorf("ошибка расшифровки ключом %s: %w", keyID, err)
+	}
+	return string(value), false, nil
+}
+
+// IsForgotten проверяет, удалены ли данные клиента. Клиент из старого списка
+// (SHA-256 без секрета) при первой проверке переносится в список HMAC.
+func (s *KeyStore) IsForgotten(subject string) bool {
+	s.mu.RLock()
+	forgotten := s.forgotten[s.subjectMAC(subject)]
+	legacy := !forgotten && len(s.legacy) > 0 && s.legacy[legacySubjectHash(subject)]
+	s.mu.RUnlock()
+	if !legacy {
+		return forgotten
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forgotten[s.subjectMAC(subject)] = true
+	delete(s.legacy, legacySubjectHash(subject))
+	if err := s.persist(); err != nil {
+		// Запись останется в старом списке до следующего сохранения файла ключей
+		log.Printf("Ошибка при переносе удаленного клиента в список HMAC: %v", err)
+	}
+	return true
+}
+
+// HasKey проверяет, что у клиента есть ключ
+func (s *KeyStore) HasKey(subject string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, found := s.bySubject[subject]
+	return found
+}
+
+// Forget удаляет ключ клиента и запоминает HMAC его ID, чтобы скрывать
+// и его данные, записанные до включения шифрования. Сам ID клиента не сохраняется,
+// а без секрета из файла ключей по HMAC нельзя проверить, удален ли известный клиент.
+func (s *KeyStore) Forget(subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, found := s.bySubject[subject]; found {
+		delete(s.byID, key.ID)
+		delete(s.bySubject, subject)
+	}
+	s.forgotten[s.subjectMAC(subject)] = true
+	delete(s.legacy, legacySubjectHash(subject))
+	s.lastErasure = time.Now()
+	return s.persist()
+}
+
+// LastErasure возвращает время последнего удаления данных клиента
+func (s *KeyStore) LastErasure() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastErasure
+}
+
+// subjectKey возвращает ключ клиента, создавая и сохраняя новый при первом обращении
+func (s *KeyStore) subjectKey(subject string) (*SubjectKey, error) {
+	s.mu.RLock()
+	key, found := s.bySubject[subject]
+	s.mu.RUnlock()
+	if found {
+		return key, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, found := s.bySubject[subject]; found {
+		return key, nil
+	}
+
+	id, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+	key = &SubjectKey{ID: id, Subject: subject, Key: make([]byte, 32), CreatedAt: time.Now()}
+	if _, err := rand.Read(key.Key); err != nil {
+		return nil, err
+	}
+	s.bySubject[subject] = key
+	s.byID[id] = key
+
+	// Ключ должен быть сохранен до записи зашифрованного им события
+	if err := s.persist(); err != nil {
+		delete(s.bySubject, subject)
+		delete(s.byID, id)
+		return nil, err
+	}
+	return key, nil
+}
+
+// persist атомарно перезаписывает файл ключей (вызывается под блокировкой)
+func (s *KeyStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+
+	file := keyStoreFile{
+		Keys:        make([]SubjectKey, 0, len(s.bySubject)),
+		Secret:      s.secret,
+		Forgotten:   make([]string, 0, len(s.forgotten)),
+		LastErasure: s.lastErasure,
+	}
+	for _, key := range s.bySubject {
+		file.Keys = append(file.Keys, *key)
+	}
+	for hash := range s.forgotten {
+		file.Forgotten = append(file.Forgotten, hash)
+	}
+	for hash := range s.legacy {
+		file.LegacyForgotten = append(file.LegacyForgotten, hash)
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	// Пишем во временный файл и переименовываем, чтобы не оставить файл наполовину записанным.
+	// Ключ должен пережить сбой питания раньше, чем в лог попадет зашифрованное им событие,
+	// а удаление ключа - раньше, чем клиенту ответят, что его данные удалены.
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// newKeyCipher создает AES-GCM для ключа клиента
+func newKeyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// subjectMAC возвращает HMAC-SHA256 ID клиента для списка удаленных
+func (s *KeyStore) subjectMAC(subject string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(subject))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// legacySubjectHash возвращает SHA-256 ID клиента, которым список удаленных
+// заполнялся до появления секрета
+func legacySubjectHash(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,86 @@
+// personal_data_test.go
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestKeyStoreForgottenIsKeyed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	file := readKeyStoreFile(t, path)
+	if len(file.Secret) == 0 {
+		t.Fatal("секрет HMAC не сохранен")
+	}
+	if slices.Contains(file.Forgotten, legacySubjectHash("alice")) {
+		t.Fatal("в списке удаленных хранится SHA-256 ID клиента без секрета")
+	}
+
+	reopened, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.IsForgotten("alice") || reopened.IsForgotten("bob") {
+		t.Fatal("после перезапуска список удаленных клиентов изменился")
+	}
+}
+
+func TestKeyStoreMigratesLegacyForgotten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	legacy, _ := json.Marshal(keyStoreFile{Forgotten: []string{legacySubjectHash("alice")}})
+	if err := os.WriteFile(path, legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := readKeyStoreFile(t, path); len(file.Secret) == 0 || len(file.LegacyForgotten) != 1 {
+		t.Fatalf("старый файл не переведен на секрет: %+v", file)
+	}
+	if store.IsForgotten("bob") {
+		t.Fatal("bob не удалялся")
+	}
+	if !store.IsForgotten("alice") {
+		t.Fatal("удаленный до появления секрета клиент снова виден")
+	}
+
+	// Встреченный клиент переносится в список HMAC и исчезает из старого списка
+	file := readKeyStoreFile(t, path)
+	if len(file.LegacyForgotten) != 0 || len(file.Forgotten) != 1 {
+		t.Fatalf("клиент не перенесен в список HMAC: %+v", file)
+	}
+	reopened, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reopened.IsForgotten("alice") {
+		t.Fatal("после перезапуска клиент снова виден")
+	}
+}
+
+// readKeyStoreFile читает файл ключей как есть
+func readKeyStoreFile(t *testing.T, path string) keyStoreFile {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file keyStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
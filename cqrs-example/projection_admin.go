@@ -0,0 +1,104 @@
+// projection_admin.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// ProjectionAdmin административный API проекций: состояние и фоновое перестроение
+type ProjectionAdmin struct {
+	runners map[string]*ProjectionRunner // Запущенные проекции по имени
+}
+
+// NewProjectionAdmin создает административный API для запущенных проекций
+func NewProjectionAdmin(runners ...*ProjectionRunner) *ProjectionAdmin {
+	admin := &ProjectionAdmin{
+		runners: make(map[string]*ProjectionRunner),
+	}
+	for _, runner := range runners {
+		admin.runners[runner.Name()] = runner
+	}
+	return admin
+}
+
+// Close останавливает все проекции и сохраняет их контрольные точки
+func (a *ProjectionAdmin) Close() error {
+	var errs []error
+	for _, runner := range a.runners {
+		errs = append(errs, runner.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// RebuildAll запускает фоновое перестроение всех проекций.
+// Уже идущие перестроения начинаются заново: они могли прочитать устаревшие события.
+func (a *ProjectionAdmin) RebuildAll() {
+	for name, runner := range a.runners {
+		if _, err := runner.RestartRebuild(); err != nil {
+			log.Printf("Проекция %s не перестроена: %v", name, err)
+		}
+	}
+}
+
+// ServeList отдает состояние всех проекций
+func (a *ProjectionAdmin) ServeList(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]ProjectionStatus, 0, len(a.runners))
+	for _, runner := range a.runners {
+		statuses = append(statuses, runner.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// ServeStatus отдает состояние проекции и ход ее перестроения
+func (a *ProjectionAdmin) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	runner, ok := a.runner(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runner.Status())
+}
+
+// ServeRebuild запускает фоновое перестроение проекции.
+// Отвечает 202 Accepted сразу, ход перестроения доступен через ServeStatus.
+func (a *ProjectionAdmin) ServeRebuild(w http.ResponseWriter, r *http.Request) {
+	runner, ok := a.runner(w, r)
+	if !ok {
+		return
+	}
+
+	if _, err := runner.RebuildAsync(); err != nil {
+		status, code := http.StatusServiceUnavailable, ErrorCodeUnavailable
+		if errors.Is(err, ErrRebuildInProgress) {
+			status, code = http.StatusConflict, ErrorCodeRebuildInProgress
+		}
+		writeJSONError(w, status, code, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(runner.Status())
+}
+
+// runner находит проекцию по имени из URL или отвечает 404
+func (a *ProjectionAdmin) runner(w http.ResponseWriter, r *http.Request) (*ProjectionRunner, bool) {
+	name := mux.Vars(r)["name"]
+	runner, found := a.runners[name]
+	if !found {
+		writeJSONError(w, http.StatusNotFound, ErrorCodeNotFound, "Проекция не найдена")
+	}
+	return runner, found
+}
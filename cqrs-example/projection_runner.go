@@ -0,0 +1,428 @@
+// projection_runner.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Projection модель чтения, которая строится из событий лога
+type Projection interface {
+	Name() string                        // Имя проекции (ключ контрольной точки)
+	Version() int                        // Версия кода; при изменении проекция перестраивается
+	Apply(record RecordedEvent)          // Применяет событие
+	Snapshot() (json.RawMessage, error)  // Сериализует состояние для контрольной точки
+	Restore(state json.RawMessage) error // Восстанавливает состояние из контрольной точки
+	Reset()                              // Очищает состояние перед перестроением
+}
+
+// ProjectionOptions настройки запуска проекции
+type ProjectionOptions struct {
+	Subscription    SubscriptionOptions // Доставка событий
+	CheckpointEvery int                 // Сохранять контрольную точку каждые N событий (0 - только при остановке)
+	// DiscardBefore контрольные точки, сохраненные раньше, не используются: например,
+	// после удаления персональных данных клиента они могут содержать эти данные
+	DiscardBefore time.Time
+}
+
+// ErrRebuildInProgress возвращается при попытке запустить перестроение, которое уже идет
+var ErrRebuildInProgress = errors.New("перестроение проекции уже выполняется")
+
+// RebuildState состояние фонового перестроения проекции
+type RebuildState string
+
+const (
+	RebuildIdle      RebuildState = "idle"      // Перестроение не запускалось
+	RebuildRunning   RebuildState = "running"   // Новый экземпляр догоняет лог
+	RebuildCompleted RebuildState = "completed" // Новый экземпляр подменил старый
+	RebuildCanceled  RebuildState = "canceled"  // Перестроение прервано остановкой сервера
+)
+
+// RebuildStatus ход фонового перестроения проекции
+type RebuildStatus struct {
+	State      RebuildState `json:"state"`
+	Position   int64        `json:"position"`              // Позиция, до которой дошел новый экземпляр
+	Target     int64        `json:"target"`                // Позиция, которую нужно догнать
+	StartedAt  *time.Time   `json:"started_at,omitempty"`  // Начало перестроения
+	FinishedAt *time.Time   `json:"finished_at,omitempty"` // Окончание перестроения
+	Duration   string       `json:"duration,omitempty"`    // Длительность (текущая, если перестроение идет)
+}
+
+// ProjectionStatus состояние проекции для административного API
+type ProjectionStatus struct {
+	Name     string        `json:"name"`
+	Version  int           `json:"version"`  // Версия кода проекции
+	Position int64         `json:"position"` // Позиция последнего учтенного события
+	Rebuild  RebuildStatus `json:"rebuild"`  // Последнее фоновое перестроение
+}
+
+// ProjectionRunner держит проекцию в актуальном состоянии: восстанавливает ее из контрольной
+// точки, догоняет лог, применяет новые события и периодически сохраняет контрольную точку.
+// Запросы обслуживает текущий экземпляр проекции (Current), который можно перестроить
+// в фоне и подменить без остановки сервера (RebuildAsync).
+type ProjectionRunner struct {
+	store         *EventStore
+	newProjection func() Projection // Создает пустой экземпляр проекции
+	checkpoints   CheckpointStore
+	options       ProjectionOptions
+	active        atomic.Value // Текущий экземпляр Projection, обслуживающий запросы
+	position      atomic.Int64 // Позиция последнего учтенного события
+	mu            sync.Mutex   // Сериализует применение событий, сохранение и подмену экземпляра
+	savedPosition int64        // Позиция последней сохраненной контрольной точки
+
+	rebuildMu     sync.Mutex    // Защищает состояние фонового перестроения
+	rebuildStatus RebuildStatus // Ход последнего фонового перестроения
+	restart       bool          // Идущее перестроение нужно начать заново с начала лога
+	stop          chan struct{} // Закрывается при остановке, прерывает фоновое перестроение
+	rebuilding    sync.WaitGroup
+}
+
+// StartProjection восстанавливает проекцию и подписывает ее на события
+func StartProjection(store *EventStore, newProjection func() Projection, checkpoints CheckpointStore, options ProjectionOptions) (*ProjectionRunner, error) {
+	runner := &ProjectionRunner{
+		store:         store,
+		newProjection: newProjection,
+		checkpoints:   checkpoints,
+		options:       options,
+		rebuildStatus: RebuildStatus{State: RebuildIdle},
+		stop:          make(chan struct{}),
+	}
+	projection := newProjection()
+	runner.active.Store(projection)
+
+	position, err := runner.restore()
+	if err != nil {
+		return nil, err
+	}
+
+	// При потере событий (политика drop) проекция перестраивается из лога
+	subscription := options.Subscription
+	subscription.Rebuild = runner.rebuild
+	store.Subscribe(projection.Name(), position, subscription, runner.apply)
+
+	return runner, nil
+}
+
+// Name возвращает имя проекции
+func (r *ProjectionRunner) Name() string {
+	return r.Current().Name()
+}
+
+// Current возвращает экземпляр проекции, который сейчас обслуживает запросы
+func (r *ProjectionRunner) Current() Projection {
+	return r.active.Load().(Projection)
+}
+
+// Position возвращает позицию последнего учтенного проекцией события
+func (r *ProjectionRunner) Position() int64 {
+	return r.position.Load()
+}
+
+// Status возвращает состояние проекции и ход последнего фонового перестроения
+func (r *ProjectionRunner) Status() ProjectionStatus {
+	r.rebuildMu.Lock()
+	rebuild := r.rebuildStatus
+	r.rebuildMu.Unlock()
+
+	if rebuild.StartedAt != nil {
+		finished := time.Now()
+		if rebuild.FinishedAt != nil {
+			finished = *rebuild.FinishedAt
+		}
+		rebuild.Duration = finished.Sub(*rebuild.StartedAt).Round(time.Millisecond).String()
+	}
+
+	projection := r.Current()
+	return ProjectionStatus{
+		Name:     projection.Name(),
+		Version:  projection.Version(),
+		Position: r.Position(),
+		Rebuild:  rebuild,
+	}
+}
+
+// Close прерывает фоновое перестроение и сохраняет итоговую контрольную точку.
+// Вызывается после закрытия хранилища событий, когда доставка событий остановлена.
+func (r *ProjectionRunner) Close() error {
+	close(r.stop)
+	r.rebuilding.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.saveCheckpoint()
+}
+
+// restore загружает контрольную точку и возвращает позицию, с которой нужно продолжить.
+// Если точки нет, версия кода изменилась или точка опережает лог, проекция перестраивается.
+func (r *ProjectionRunner) restore() (int64, error) {
+	projection := r.Current()
+	name := projection.Name()
+
+	checkpoint, err := r.checkpoints.Load(name)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case checkpoint == nil:
+		log.Printf("Проекция %s: контрольной точки нет, перестраиваем из лога", name)
+		return r.rebuild(), nil
+	case checkpoint.CodeVersion != projection.Version():
+		log.Printf("Проекция %s: версия кода изменилась (%d -> %d), перестраиваем из лога",
+			name, checkpoint.CodeVersion, projection.Version())
+		return r.rebuild(), nil
+	case checkpoint.SavedAt.Before(r.options.DiscardBefore):
+		log.Printf("Проекция %s: контрольная точка сохранена до удаления персональных данных, перестраиваем из лога", name)
+		return r.rebuild(), nil
+	case checkpoint.Position > r.store.LastPosition():
+		log.Printf("Проекция %s: контрольная точка (позиция %d) опережает лог, перестраиваем из лога",
+			name, checkpoint.Position)
+		return r.rebuild(), nil
+	}
+
+	if err := projection.Restore(checkpoint.State); err != nil {
+		log.Printf("Проекция %s: ошибка при восстановлении состояния (%v), перестраиваем из лога", name, err)
+		return r.rebuild(), nil
+	}
+
+	r.position.Store(checkpoint.Position)
+	r.savedPosition = checkpoint.Position
+	log.Printf("Проекция %s восстановлена из контрольной точки на позиции %d", name, checkpoint.Position)
+	return checkpoint.Position, nil
+}
+
+// rebuild перестраивает текущий экземпляр проекции по всему логу на месте
+// и возвращает позицию последнего учтенного события
+func (r *ProjectionRunner) rebuild() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	projection := r.Current()
+	projection.Reset()
+	position := r.catchUp(projection, 0, -1)
+
+	r.position.Store(position)
+	if err := r.saveCheckpoint(); err != nil {
+		log.Printf("Проекция %s: ошибка при сохранении контрольной точки: %v", projection.Name(), err)
+	}
+	return position
+}
+
+// catchUp применяет к проекции события с позицией больше after, но не больше until
+// (until < 0 - до конца лога), и возвращает позицию последнего примененного события
+func (r *ProjectionRunner) catchUp(projection Projection, after int64, until int64) int64 {
+	for {
+		limit := maxEventsLimit
+		if until >= 0 {
+			if after >= until {
+				return after
+			}
+			limit = int(min(until-after, int64(maxEventsLimit)))
+		}
+
+		records, next, hasMore := r.store.ReadEvents(EventQuery{After: after, Limit: limit})
+		for _, record := range records {
+			projection.Apply(record)
+		}
+		after = next
+		if !hasMore {
+			return after
+		}
+	}
+}
+
+// RebuildAsync запускает перестроение проекции в новый экземпляр в фоне.
+// Пока новый экземпляр догоняет лог, запросы обслуживает старый; после того как новый
+// догонит текущую позицию, он атомарно подменяет старый.
+func (r *ProjectionRunner) RebuildAsync() (RebuildStatus, error) {
+	return r.startRebuild(false)
+}
+
+// RestartRebuild запускает фоновое перестроение, а уже идущее начинает заново с начала лога.
+// Нужен, когда события в логе изменились (удаление персональных данных): экземпляр,
+// построенный из прочитанных раньше событий, не должен подменить текущий.
+func (r *ProjectionRunner) RestartRebuild() (RebuildStatus, error) {
+	return r.startRebuild(true)
+}
+
+// startRebuild запускает фоновое перестроение; restart - начать заново уже идущее
+func (r *ProjectionRunner) startRebuild(restart bool) (RebuildStatus, error) {
+	r.rebuildMu.Lock()
+	defer r.rebuildMu.Unlock()
+
+	if r.rebuildStatus.State == RebuildRunning {
+		if restart {
+			r.restart = true
+			return r.rebuildStatus, nil
+		}
+		return r.rebuildStatus, ErrRebuildInProgress
+	}
+	select {
+	case <-r.stop:
+		return r.rebuildStatus, errors.New("проекция остановлена")
+	default:
+	}
+
+	startedAt := time.Now()
+	r.rebuildStatus = RebuildStatus{
+		State:     RebuildRunning,
+		Target:    r.store.LastPosition(),
+		StartedAt: &startedAt,
+	}
+
+	r.rebuilding.Add(1)
+	go r.rebuildInBackground()
+
+	return r.rebuildStatus, nil
+}
+
+// rebuildInBackground строит новый экземпляр проекции и подменяет им текущий
+func (r *ProjectionRunner) rebuildInBackground() {
+	defer r.rebuilding.Done()
+
+	projection := r.newProjection()
+	name := projection.Name()
+	log.Printf("Проекция %s: начато фоновое перестроение", name)
+
+	// Догоняем лог пачками, не блокируя применение новых событий к старому экземпляру
+	var position int64
+	for {
+		select {
+		case <-r.stop:
+			r.finishRebuild(RebuildCanceled, position)
+			log.Printf("Проекция %s: фоновое перестроение прервано на позиции %d", name, position)
+			return
+		default:
+		}
+
+		if r.takeRestart() {
+			log.Printf("Проекция %s: перестроение начато заново с начала лога", name)
+			projection, position = r.newProjection(), 0
+		}
+
+		target := r.store.LastPosition()
+		r.updateRebuild(position, target)
+		if position >= target {
+			// Дочитываем события, примененные к старому экземпляру за время перестроения,
+			// и подменяем экземпляр, пока новые события не применяются. Если новый экземпляр
+			// опередил отстающую подписку, события до его позиции будут пропущены в apply.
+			r.mu.Lock()
+			if r.restartPending() {
+				r.mu.Unlock()
+				continue
+			}
+			break
+		}
+		position = r.catchUp(projection, position, min(position+maxEventsLimit, target))
+	}
+
+	position = r.catchUp(projection, position, r.position.Load())
+	r.active.Store(projection)
+	r.position.Store(position)
+	if err := r.saveCheckpoint(); err != nil {
+		log.Printf("Проекция %s: ошибка при сохранении контрольной точки: %v", name, err)
+	}
+	r.mu.Unlock()
+
+	restart := r.finishRebuild(RebuildCompleted, position)
+	status := r.Status()
+	log.Printf("Проекция %s: новый экземпляр подменил старый на позиции %d за %s", name, position, status.Rebuild.Duration)
+
+	// Перезапуск, запрошенный во время подмены, выполняем новым перестроением
+	if restart {
+		log.Printf("Проекция %s: перестроение начато заново с начала лога", name)
+		if _, err := r.RebuildAsync(); err != nil {
+			log.Printf("Проекция %s не перестроена: %v", name, err)
+		}
+	}
+}
+
+// takeRestart сбрасывает и возвращает запрос начать перестроение заново
+func (r *ProjectionRunner) takeRestart() bool {
+	r.rebuildMu.Lock()
+	defer r.rebuildMu.Unlock()
+
+	restart := r.restart
+	r.restart = false
+	return restart
+}
+
+// restartPending проверяет, запрошено ли начать перестроение заново
+func (r *ProjectionRunner) restartPending() bool {
+	r.rebuildMu.Lock()
+	defer r.rebuildMu.Unlock()
+	return r.restart
+}
+
+// updateRebuild обновляет ход фонового перестроения
+func (r *ProjectionRunner) updateRebuild(position int64, target int64) {
+	r.rebuildMu.Lock()
+	defer r.rebuildMu.Unlock()
+
+	r.rebuildStatus.Position = position
+	r.rebuildStatus.Target = target
+}
+
+// finishRebuild фиксирует завершение фонового перестроения и возвращает,
+// был ли запрошен перезапуск, который это перестроение уже не учло
+func (r *ProjectionRunner) finishRebuild(state RebuildState, position int64) bool {
+	r.rebuildMu.Lock()
+	defer r.rebuildMu.Unlock()
+
+	restart := r.restart
+	r.restart = false
+	finishedAt := time.Now()
+	r.rebuildStatus.State = state
+	r.rebuildStatus.Position = position
+	r.rebuildStatus.FinishedAt = &finishedAt
+	return restart
+}
+
+// apply применяет событие и при необходимости сохраняет контрольную точку
+func (r *ProjectionRunner) apply(record RecordedEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Событие уже учтено экземпляром, построенным фоновым перестроением
+	if record.Position <= r.position.Load() {
+		return
+	}
+
+	r.Current().Apply(record)
+	r.position.Store(record.Position)
+
+	if r.options.CheckpointEvery > 0 && record.Position-r.savedPosition >= int64(r.options.CheckpointEvery) {
+		if err := r.saveCheckpoint(); err != nil {
+			log.Printf("Проекция %s: ошибка при сохранении контрольной точки: %v", r.Name(), err)
+		}
+	}
+}
+
+// saveCheckpoint сохраняет состояние текущего экземпляра проекции вместе с позицией.
+// Вызывается под r.mu, поэтому состояние соответствует позиции.
+func (r *ProjectionRunner) saveCheckpoint() error {
+	projection := r.Current()
+	state, err := projection.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	position := r.position.Load()
+	err = r.checkpoints.Save(ProjectionCheckpoint{
+		Name:        projection.Name(),
+		CodeVersion: projection.Version(),
+		Position:    position,
+		State:       state,
+		SavedAt:     time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	r.savedPosition = position
+	return nil
+}
@@ -2,77 +2,86 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
 )
 
+// orderProjectionVersion версия кода OrderProjection.
+// Увеличивайте ее при изменении логики применения событий: сохраненные
+// контрольные точки будут отброшены, а проекция перестроена из лога.
+const orderProjectionVersion = 2
+
 // OrderProjection проекция для заказов
 type OrderProjection struct {
-	store    *EventStore             // Хранилище событий
-	orders   map[int]*OrderState     // Кэш состояний заказов
-	mu       sync.RWMutex            // Мьютекс для безопасного доступа
+	orders map[OrderID]*OrderState // Кэш состояний заказов
+	mu     sync.RWMutex            // Мьютекс для безопасного доступа
+
+	// Вторичные индексы для запросов списка заказов
+	byStatus   map[string]map[OrderID]struct{} // ID заказов по статусу
+	byCustomer map[string]map[OrderID]struct{} // ID заказов по клиенту
+	byID       orderIndex                      // Заказы, отсортированные по ID
+	byCreated  orderIndex                      // Заказы, отсортированные по времени создания
+	byUpdated  orderIndex                      // Заказы, отсортированные по времени обновления
 }
 
-// NewOrderProjection создает новую проекцию заказов
-func NewOrderProjection(store *EventStore) *OrderProjection {
-	projection := &OrderProjection{
-		store:  store,
-		orders: make(map[int]*OrderState),
-	}
+// NewOrderProjection создает пустую проекцию заказов; заполняет ее ProjectionRunner
+func NewOrderProjection() *OrderProjection {
+	projection := &OrderProjection{}
+	projection.setOrders(make(map[OrderID]*OrderState))
+	return projection
+}
 
-	// Обрабатываем все существующие события
-	projection.rebuildProjection()
+// Name возвращает имя проекции
+func (p *OrderProjection) Name() string {
+	return "OrderProjection"
+}
 
-	// Подписываемся на новые события
-	store.queue.Subscribe(func(event Event) {
-		projection.UpdateProjection(event)
-	})
+// Version возвращает версию кода проекции
+func (p *OrderProjection) Version() int {
+	return orderProjectionVersion
+}
 
-	return projection
+// Apply применяет записанное событие к проекции
+func (p *OrderProjection) Apply(record RecordedEvent) {
+	p.UpdateProjection(record.Event)
 }
 
-// rebuildProjection пересоздает проекцию на основе всех событий
-func (p *OrderProjection) rebuildProjection() {
+// Reset очищает проекцию перед перестроением
+func (p *OrderProjection) Reset() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Очищаем текущее состояние
-	p.orders = make(map[int]*OrderState)
+	p.setOrders(make(map[OrderID]*OrderState))
+}
 
-	// Получаем все события
-	events := p.store.GetAllEvents()
+// Snapshot сериализует состояния заказов для контрольной точки
+func (p *OrderProjection) Snapshot() (json.RawMessage, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
 
-	// Группируем события по заказам
-	orderEvents := make(map[int][]Event)
-	for _, event := range events {
-		orderID := event.GetOrderID()
-		orderEvents[orderID] = append(orderEvents[orderID], event)
-	}
+	return json.Marshal(p.orders)
+}
 
-	// Строим состояние для каждого заказа
-	for orderID, events := range orderEvents {
-		p.orders[orderID] = buildOrderState(events)
+// Restore восстанавливает состояния заказов из контрольной точки
+func (p *OrderProjection) Restore(state json.RawMessage) error {
+	orders := make(map[OrderID]*OrderState)
+	if err := json.Unmarshal(state, &orders); err != nil {
+		return err
 	}
-}
 
-// GetOrder возвращает состояние заказа по ID
-func (p *OrderProjection) GetOrder(orderID int) *OrderState {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	return p.orders[orderID]
+	p.setOrders(orders)
+	return nil
 }
 
-// GetAllOrders возвращает все заказы
-func (p *OrderProjection) GetAllOrders() []*OrderState {
+// GetOrder возвращает состояние заказа по ID
+func (p *OrderProjection) GetOrder(orderID OrderID) *OrderState {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	result := make([]*OrderState, 0, len(p.orders))
-	for _, order := range p.orders {
-		result = append(result, order)
-	}
-
-	return result
+	return p.orders[orderID]
 }
 
 // UpdateProjection обновляет проекцию на основе новых событий
@@ -87,10 +96,11 @@ func (p *OrderProjection) UpdateProjection(event Event) {
 	existingState, found := p.orders[orderID]
 	if found {
 		state = existingState
+		p.unindex(state)
 	} else {
 		state = &OrderState{
 			ID:     orderID,
-			Status: "unknown",
+			Status: StatusUnknown,
 		}
 	}
 
@@ -99,4 +109,134 @@ func (p *OrderProjection) UpdateProjection(event Event) {
 
 	// Сохраняем обновленное состояние
 	p.orders[orderID] = state
+	p.index(state)
+}
+
+// Query возвращает страницу заказов по фильтрам и сортировке запроса.
+// Фильтр по статусу или клиенту берет заказы из индекса, иначе заказы читаются
+// по индексу сортировки с позиции курсора и до заполнения страницы.
+func (p *OrderProjection) Query(query OrderQuery) OrderPage {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if candidates, found := p.candidates(query); found {
+		matched := make([]*OrderState, 0, len(candidates))
+		for id := range candidates {
+			order := p.orders[id]
+			if query.Match(order) && query.afterCursor(sortKey(order, query.Sort)) {
+				matched = append(matched, order)
+			}
+		}
+		sortOrders(matched, query)
+		return query.page(matched[:min(len(matched), query.Limit+1)])
+	}
+
+	index := p.sortedIndex(query.Sort)
+	low, high := 0, len(index)
+
+	// Диапазон времени создания при сортировке по нему сужает просмотр индекса
+	if query.Sort == OrderSortCreated {
+		if !query.CreatedFrom.IsZero() {
+			low = index.search(orderKey{Value: query.CreatedFrom.UnixNano()})
+		}
+		if !query.CreatedTo.IsZero() {
+			high = index.search(orderKey{Value: query.CreatedTo.UnixNano()})
+		}
+	}
+	if query.After != nil {
+		position := index.search(*query.After)
+		if query.Desc {
+			high = min(high, position)
+		} else {
+			if position < len(index) && index[position] == *query.After {
+				position++
+			}
+			low = max(low, position)
+		}
+	}
+
+	orders := make([]*OrderState, 0, min(query.Limit+1, max(high-low, 0)))
+	for i := 0; i < high-low && len(orders) <= query.Limit; i++ {
+		key := index[low+i]
+		if query.Desc {
+			key = index[high-1-i]
+		}
+		if order := p.orders[key.ID]; query.Match(order) {
+			orders = append(orders, order)
+		}
+	}
+	return query.page(orders)
+}
+
+// candidates возвращает ID заказов из индекса статуса или клиента (меньший из подходящих)
+func (p *OrderProjection) candidates(query OrderQuery) (map[OrderID]struct{}, bool) {
+	var result map[OrderID]struct{}
+	found := false
+	if query.Status != "" {
+		result, found = p.byStatus[query.Status], true
+	}
+	if query.CustomerID != "" {
+		if byCustomer := p.byCustomer[query.CustomerID]; !found || len(byCustomer) < len(result) {
+			result, found = byCustomer, true
+		}
+	}
+	return result, found
+}
+
+// sortedIndex возвращает индекс для поля сортировки
+func (p *OrderProjection) sortedIndex(field string) orderIndex {
+	switch field {
+	case OrderSortCreated:
+		return p.byCreated
+	case OrderSortUpdated:
+		return p.byUpdated
+	}
+	return p.byID
+}
+
+// setOrders заменяет состояния заказов и перестраивает индексы (вызывается под блокировкой)
+func (p *OrderProjection) setOrders(orders map[OrderID]*OrderState) {
+	p.orders = orders
+	p.byStatus = make(map[string]map[OrderID]struct{})
+	p.byCustomer = make(map[string]map[OrderID]struct{})
+	p.byID, p.byCreated, p.byUpdated = nil, nil, nil
+	for _, order := range orders {
+		p.index(order)
+	}
+}
+
+// index добавляет заказ во вторичные индексы (вызывается под блокировкой)
+func (p *OrderProjection) index(order *OrderState) {
+	addToSet(p.byStatus, order.Status, order.ID)
+	addToSet(p.byCustomer, order.CustomerID, order.ID)
+	p.byID.insert(sortKey(order, OrderSortID))
+	p.byCreated.insert(sortKey(order, OrderSortCreated))
+	p.byUpdated.insert(sortKey(order, OrderSortUpdated))
+}
+
+// unindex удаляет заказ из вторичных индексов до изменения его состояния (вызывается под блокировкой)
+func (p *OrderProjection) unindex(order *OrderState) {
+	removeFromSet(p.byStatus, order.Status, order.ID)
+	removeFromSet(p.byCustomer, order.CustomerID, order.ID)
+	p.byID.remove(sortKey(order, OrderSortID))
+	p.byCreated.remove(sortKey(order, OrderSortCreated))
+	p.byUpdated.remove(sortKey(order, OrderSortUpdated))
+}
+
+// addToSet добавляет ID заказа в множество по ключу
+func addToSet(sets map[string]map[OrderID]struct{}, key string, id OrderID) {
+	set, found := sets[key]
+	if !found {
+		set = make(map[OrderID]struct{})
+		sets[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+// removeFromSet удаляет ID заказа из множества по ключу
+func removeFromSet(sets map[string]map[OrderID]struct{}, key string, id OrderID) {
+	delete(sets[key], id)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
 }
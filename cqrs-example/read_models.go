@@ -0,0 +1,430 @@
+// read_models.go
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Версии кода дополнительных моделей чтения; увеличивайте при изменении логики Apply
+const (
+	customerSummaryProjectionVersion = 1
+	statusStatsProjectionVersion     = 1
+	itemPopularityProjectionVersion  = 1
+)
+
+// statusBucketSize размер интервала временного ряда статусов
+const statusBucketSize = time.Minute
+
+// nextStatus возвращает статус заказа после применения события
+func nextStatus(status string, event Event) string {
+	if next, found := orderStateMachine.StatusAfter(event.GetType()); found {
+		return next
+	}
+	return status
+}
+
+// eventTime возвращает время события (нулевое, если его не удалось разобрать)
+func eventTime(event Event) time.Time {
+	timestamp, _ := time.Parse(time.RFC3339, event.GetTimestamp())
+	return timestamp
+}
+
+// orderRef статус заказа и его клиент, нужны для переноса счетчиков при смене статуса
+type orderRef struct {
+	CustomerID string `json:"customer_id"`
+	Status     string `json:"status"`
+}
+
+// CustomerSummary сводка по заказам клиента
+type CustomerSummary struct {
+	CustomerID string         `json:"customer_id"`
+	Orders     int            `json:"orders"`      // Всего заказов
+	ByStatus   map[string]int `json:"by_status"`   // Заказов в каждом статусе
+	Items      int            `json:"items"`       // Всего заказано единиц товара
+	LastUpdate time.Time      `json:"last_update"` // Время последнего события по заказам клиента
+}
+
+// CustomerSummaryProjection проекция заказов по клиентам с разбивкой по статусам
+type CustomerSummaryProjection struct {
+	state customerSummaryState
+	mu    sync.RWMutex
+}
+
+// customerSummaryState состояние проекции, сохраняемое в контрольной точке
+type customerSummaryState struct {
+	Customers map[string]*CustomerSummary `json:"customers"`
+	Orders    map[OrderID]orderRef        `json:"orders"`
+}
+
+// NewCustomerSummaryProjection создает пустую проекцию сводок по клиентам
+func NewCustomerSummaryProjection() *CustomerSummaryProjection {
+	p := &CustomerSummaryProjection{}
+	p.Reset()
+	return p
+}
+
+// Name возвращает имя проекции
+func (p *CustomerSummaryProjection) Name() string {
+	return "CustomerSummaryProjection"
+}
+
+// Version возвращает версию кода проекции
+func (p *CustomerSummaryProjection) Version() int {
+	return customerSummaryProjectionVersion
+}
+
+// Apply учитывает событие в сводке клиента
+func (p *CustomerSummaryProjection) Apply(record RecordedEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	event := record.Event
+	order, found := p.state.Orders[event.GetOrderID()]
+	if created, ok := event.(OrderCreatedEvent); ok {
+		order = orderRef{CustomerID: created.CustomerID}
+		summary := p.customer(created.CustomerID)
+		summary.Orders++
+		for _, item := range created.Items {
+			summary.Items += item.Quantity
+		}
+	} else if !found {
+		// Событие заказа, созданного до начала лога или неизвестного типа
+		return
+	}
+
+	summary := p.customer(order.CustomerID)
+	status := nextStatus(order.Status, event)
+	if status != order.Status {
+		if order.Status != "" {
+			summary.ByStatus[order.Status]--
+		}
+		summary.ByStatus[status]++
+		order.Status = status
+	}
+	summary.LastUpdate = eventTime(event)
+	p.state.Orders[event.GetOrderID()] = order
+}
+
+// customer возвращает сводку клиента, создавая ее при необходимости (вызывается под блокировкой)
+func (p *CustomerSummaryProjection) customer(customerID string) *CustomerSummary {
+	summary, found := p.state.Customers[customerID]
+	if !found {
+		summary = &CustomerSummary{CustomerID: customerID, ByStatus: make(map[string]int)}
+		p.state.Customers[customerID] = summary
+	}
+	return summary
+}
+
+// Reset очищает проекцию перед перестроением
+func (p *CustomerSummaryProjection) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = customerSummaryState{
+		Customers: make(map[string]*CustomerSummary),
+		Orders:    make(map[OrderID]orderRef),
+	}
+}
+
+// Snapshot сериализует состояние для контрольной точки
+func (p *CustomerSummaryProjection) Snapshot() (json.RawMessage, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return json.Marshal(p.state)
+}
+
+// Restore восстанавливает состояние из контрольной точки
+func (p *CustomerSummaryProjection) Restore(data json.RawMessage) error {
+	var state customerSummaryState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = state
+	return nil
+}
+
+// GetCustomer возвращает копию сводки клиента или nil, если заказов у клиента нет
+func (p *CustomerSummaryProjection) GetCustomer(customerID string) *CustomerSummary {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	summary, found := p.state.Customers[customerID]
+	if !found {
+		return nil
+	}
+	return cloneCustomerSummary(summary)
+}
+
+// GetAllCustomers возвращает сводки всех клиентов, отсортированные по идентификатору
+func (p *CustomerSummaryProjection) GetAllCustomers() []*CustomerSummary {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	result := make([]*CustomerSummary, 0, len(p.state.Customers))
+	for _, summary := range p.state.Customers {
+		result = append(result, cloneCustomerSummary(summary))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CustomerID < result[j].CustomerID
+	})
+	return result
+}
+
+// cloneCustomerSummary возвращает копию сводки клиента
+func cloneCustomerSummary(summary *CustomerSummary) *CustomerSummary {
+	clone := *summary
+	clone.ByStatus = make(map[string]int, len(summary.ByStatus))
+	for status, count := range summary.ByStatus {
+		if count > 0 {
+			clone.ByStatus[status] = count
+		}
+	}
+	return &clone
+}
+
+// StatusBucket количество заказов в каждом статусе на конец интервала
+type StatusBucket struct {
+	Start  time.Time      `json:"start"`  // Начало интервала
+	Counts map[string]int `json:"counts"` // Заказов в статусе на конец интервала
+}
+
+// StatusStats текущие счетчики статусов и их история по интервалам
+type StatusStats struct {
+	Current  map[string]int `json:"current"`
+	Interval string         `json:"interval"`
+	Timeline []StatusBucket `json:"timeline"`
+}
+
+// StatusStatsProjection проекция счетчиков заказов по статусам во времени
+type StatusStatsProjection struct {
+	state statusStatsState
+	mu    sync.RWMutex
+}
+
+// statusStatsState состояние проекции, сохраняемое в контрольной точке
+type statusStatsState struct {
+	Current  map[string]int     `json:"current"`
+	Timeline []StatusBucket     `json:"timeline"`
+	Orders   map[OrderID]string `json:"orders"` // Текущий статус каждого заказа
+}
+
+// NewStatusStatsProjection создает пустую проекцию счетчиков статусов
+func NewStatusStatsProjection() *StatusStatsProjection {
+	p := &StatusStatsProjection{}
+	p.Reset()
+	return p
+}
+
+// Name возвращает имя проекции
+func (p *StatusStatsProjection) Name() string {
+	return "StatusStatsProjection"
+}
+
+// Version возвращает версию кода проекции
+func (p *StatusStatsProjection) Version() int {
+	return statusStatsProjectionVersion
+}
+
+// Apply переносит заказ между счетчиками статусов и обновляет интервал времени события
+func (p *StatusStatsProjection) Apply(record RecordedEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	event := record.Event
+	orderID := event.GetOrderID()
+	previous := p.state.Orders[orderID]
+	status := nextStatus(previous, event)
+	if status == previous {
+		return
+	}
+	if previous != "" {
+		p.state.Current[previous]--
+	}
+	p.state.Current[status]++
+	p.state.Orders[orderID] = status
+
+	// События приходят по порядку позиций, поэтому время интервалов не убывает;
+	// событие с более ранним временем учитывается в последнем интервале
+	start := eventTime(event).Truncate(statusBucketSize)
+	last := len(p.state.Timeline) - 1
+	if last < 0 || start.After(p.state.Timeline[last].Start) {
+		p.state.Timeline = append(p.state.Timeline, StatusBucket{Start: start})
+		last++
+	}
+	p.state.Timeline[last].Counts = copyCounts(p.state.Current)
+}
+
+// Reset очищает проекцию перед перестроением
+func (p *StatusStatsProjection) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = statusStatsState{
+		Current: make(map[string]int),
+		Orders:  make(map[OrderID]string),
+	}
+}
+
+// Snapshot сериализует состояние для контрольной точки
+func (p *StatusStatsProjection) Snapshot() (json.RawMessage, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return json.Marshal(p.state)
+}
+
+// Restore восстанавливает состояние из контрольной точки
+func (p *StatusStatsProjection) Restore(data json.RawMessage) error {
+	var state statusStatsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = state
+	return nil
+}
+
+// GetStats возвращает текущие счетчики и последние limit интервалов истории
+func (p *StatusStatsProjection) GetStats(limit int) StatusStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	timeline := p.state.Timeline
+	if limit > 0 && len(timeline) > limit {
+		timeline = timeline[len(timeline)-limit:]
+	}
+
+	stats := StatusStats{
+		Current:  copyCounts(p.state.Current),
+		Interval: statusBucketSize.String(),
+		Timeline: make([]StatusBucket, 0, len(timeline)),
+	}
+	for _, bucket := range timeline {
+		stats.Timeline = append(stats.Timeline, StatusBucket{Start: bucket.Start, Counts: copyCounts(bucket.Counts)})
+	}
+	return stats
+}
+
+// copyCounts возвращает копию счетчиков без нулевых значений
+func copyCounts(counts map[string]int) map[string]int {
+	result := make(map[string]int, len(counts))
+	for key, count := range counts {
+		if count > 0 {
+			result[key] = count
+		}
+	}
+	return result
+}
+
+// ItemPopularity популярность товара
+type ItemPopularity struct {
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"` // Всего заказано единиц
+	Orders   int    `json:"orders"`   // Заказов с этим товаром
+}
+
+// ItemPopularityProjection проекция самых заказываемых товаров
+type ItemPopularityProjection struct {
+	items map[string]*ItemPopularity
+	mu    sync.RWMutex
+}
+
+// NewItemPopularityProjection создает пустую проекцию популярности товаров
+func NewItemPopularityProjection() *ItemPopularityProjection {
+	return &ItemPopularityProjection{
+		items: make(map[string]*ItemPopularity),
+	}
+}
+
+// Name возвращает имя проекции
+func (p *ItemPopularityProjection) Name() string {
+	return "ItemPopularityProjection"
+}
+
+// Version возвращает версию кода проекции
+func (p *ItemPopularityProjection) Version() int {
+	return itemPopularityProjectionVersion
+}
+
+// Apply учитывает товары созданного заказа
+func (p *ItemPopularityProjection) Apply(record RecordedEvent) {
+	created, ok := record.Event.(OrderCreatedEvent)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, item := range created.Items {
+		popularity, found := p.items[item.Name]
+		if !found {
+			popularity = &ItemPopularity{Name: item.Name}
+			p.items[item.Name] = popularity
+		}
+		popularity.Quantity += item.Quantity
+		popularity.Orders++
+	}
+}
+
+// Reset очищает проекцию перед перестроением
+func (p *ItemPopularityProjection) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.items = make(map[string]*ItemPopularity)
+}
+
+// Snapshot сериализует состояние для контрольной точки
+func (p *ItemPopularityProjection) Snapshot() (json.RawMessage, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return json.Marshal(p.items)
+}
+
+// Restore восстанавливает состояние из контрольной точки
+func (p *ItemPopularityProjection) Restore(data json.RawMessage) error {
+	items := make(map[string]*ItemPopularity)
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.items = items
+	return nil
+}
+
+// GetTopItems возвращает limit самых заказываемых товаров по количеству единиц
+func (p *ItemPopularityProjection) GetTopItems(limit int) []ItemPopularity {
+	p.mu.RLock()
+	result := make([]ItemPopularity, 0, len(p.items))
+	for _, item := range p.items {
+		result = append(result, *item)
+	}
+	p.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Quantity != result[j].Quantity {
+			return result[i].Quantity > result[j].Quantity
+		}
+		return result[i].Name < result[j].Name
+	})
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
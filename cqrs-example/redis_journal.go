@@ -0,0 +1,149 @@
+// redis_journal.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisJournalTimeout   = 5 * time.Second // Таймаут операций с Redis
+	redisJournalReadBatch = 1000            // Сколько записей читать из потока за раз
+)
+
+// redisAppendScript дописывает пачку записей в поток Redis, если его последняя позиция
+// совпадает с ожидаемой (ARGV[1]). ID записи - "<позиция>-0", поэтому позиции
+// в потоке совпадают с позициями лога, а запись другого процесса обнаруживается до XADD.
+var redisAppendScript = redis.NewScript(`
+local last = redis.call('XREVRANGE', KEYS[1], '+', '-', 'COUNT', 1)
+local position = 0
+if #last > 0 then
+	position = tonumber(string.match(last[1][1], '^(%d+)'))
+end
+if position ~= tonumber(ARGV[1]) then
+	return redis.error_reply('POSITION ' .. position)
+end
+for i = 2, #ARGV do
+	position = position + 1
+	redis.call('XADD', KEYS[1], position .. '-0', 'data', ARGV[i])
+end
+return position
+`)
+
+// RedisStreamJournal журнал событий в потоке Redis Streams: запись потока - одно событие
+type RedisStreamJournal struct {
+	client   *redis.Client // Клиент Redis
+	stream   string        // Ключ потока
+	position int64         // Позиция последней записи в потоке, известная этому процессу
+}
+
+// NewRedisEventQueue создает очередь событий поверх потока Redis
+func NewRedisEventQueue(addr string, stream string) (*EventQueue, error) {
+	journal, err := OpenRedisStreamJournal(addr, stream)
+	if err != nil {
+		return nil, err
+	}
+	return newEventQueue(journal)
+}
+
+// OpenRedisStreamJournal подключается к Redis. Позиция конца потока определяется
+// при чтении журнала (Replay).
+func OpenRedisStreamJournal(addr string, stream string) (*RedisStreamJournal, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: addr,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisJournalTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ошибка подключения к Redis: %w", err)
+	}
+	return &RedisStreamJournal{client: client, stream: stream}, nil
+}
+
+// AppendBatch атомарно дописывает пачку записей в поток.
+// Если поток изменил другой процесс, пачка не записывается. После любой ошибки
+// (в том числе таймаута, когда скрипт мог выполниться) очередь дочитывает поток через ReadAfter.
+func (j *RedisStreamJournal) AppendBatch(records [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisJournalTimeout)
+	defer cancel()
+
+	args := make([]interface{}, 0, len(records)+1)
+	args = append(args, j.position)
+	for _, record := range records {
+		args = append(args, record)
+	}
+
+	position, err := redisAppendScript.Run(ctx, j.client, []string{j.stream}, args...).Int64()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "POSITION ") {
+			return fmt.Errorf("поток %s изменен другим процессом: ожидалась позиция %d, в потоке %s",
+				j.stream, j.position, strings.TrimPrefix(err.Error(), "POSITION "))
+		}
+		return err
+	}
+	j.position = position
+	return nil
+}
+
+// Replay читает поток от начала пачками и передает записи обработчику
+func (j *RedisStreamJournal) Replay(handler func(data []byte) error) error {
+	return j.ReadAfter(0, handler)
+}
+
+// ReadAfter читает записи потока после позиции position и запоминает последнюю
+// прочитанную позицию: следующая пачка будет дописана после нее
+func (j *RedisStreamJournal) ReadAfter(position int64, handler func(data []byte) error) error {
+	start := strconv.FormatInt(position+1, 10) + "-0"
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), redisJournalTimeout)
+		messages, err := j.client.XRangeN(ctx, j.stream, start, "+", redisJournalReadBatch).Result()
+		cancel()
+		if err != nil {
+			return fmt.Errorf("ошибка чтения потока %s: %w", j.stream, err)
+		}
+
+		for _, message := range messages {
+			data, ok := message.Values["data"].(string)
+			if !ok {
+				return fmt.Errorf("запись %s потока %s не содержит данных события", message.ID, j.stream)
+			}
+			if err := handler([]byte(data)); err != nil {
+				return err
+			}
+		}
+		if len(messages) > 0 {
+			if position, err = redisStreamPosition(messages[len(messages)-1].ID); err != nil {
+				return err
+			}
+		}
+		if len(messages) < redisJournalReadBatch {
+			j.position = position
+			return nil
+		}
+
+		// Следующая пачка начинается после последней прочитанной записи
+		start = strconv.FormatInt(position+1, 10) + "-0"
+	}
+}
+
+// Close закрывает соединение с Redis
+func (j *RedisStreamJournal) Close() error {
+	return j.client.Close()
+}
+
+// redisStreamPosition извлекает позицию лога из ID записи потока "<позиция>-0"
+func redisStreamPosition(id string) (int64, error) {
+	position, _, _ := strings.Cut(id, "-")
+	value, err := strconv.ParseInt(position, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("некорректный ID записи потока: %q", id)
+	}
+	return value, nil
+}
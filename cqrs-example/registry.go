@@ -0,0 +1,433 @@
+// registry.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventCodec сериализует и десериализует данные события одного типа
+type EventCodec interface {
+	// Encode преобразует событие в данные для лога
+	Encode(event Event) (json.RawMessage, error)
+	// Decode создает событие из данных лога; base содержит поля из конверта записи
+	Decode(data json.RawMessage, base BaseEvent) (Event, error)
+}
+
+// Upcaster преобразует данные события из версии схемы N в версию N+1
+type Upcaster func(data json.RawMessage) (json.RawMessage, error)
+
+// EventType описание зарегистрированного типа события
+type EventType struct {
+	Name      string     // Имя типа, под которым событие хранится в логе
+	Codec     EventCodec // Кодек данных события текущей версии
+	Upcasters []Upcaster // Цепочка преобразований: Upcasters[i] переводит версию i+1 в i+2
+}
+
+// Version возвращает текущую версию схемы данных события
+func (t EventType) Version() int {
+	return len(t.Upcasters) + 1
+}
+
+// upcast приводит данные события версии version к текущей версии схемы
+func (t EventType) upcast(data json.RawMessage, version int) (json.RawMessage, error) {
+	if version > t.Version() {
+		return nil, fmt.Errorf("версия %d события %s новее поддерживаемой (%d)", version, t.Name, t.Version())
+	}
+
+	var err error
+	for v := version; v < t.Version(); v++ {
+		data, err = t.Upcasters[v-1](data)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка при преобразовании события %s из версии %d: %w", t.Name, v, err)
+		}
+	}
+	return data, nil
+}
+
+// personalFields поля события с персональными данными
+type personalFields struct {
+	Subject string   // Поле с ID владельца данных, его ключом шифруются все поля
+	Fields  []string // Поля с персональными данными, включая Subject
+}
+
+// EventRegistry реестр типов событий, через который очередь сериализует события
+type EventRegistry struct {
+	types    map[string]EventType      // Зарегистрированные типы по имени
+	personal map[string]personalFields // Персональные данные по типу события
+	cipher   PersonalDataCipher        // Шифрование персональных данных (nil - хранятся как есть)
+	mu       sync.RWMutex              // Мьютекс для безопасного доступа
+}
+
+// eventRegistry реестр типов событий по умолчанию
+var eventRegistry = NewEventRegistry()
+
+// NewEventRegistry создает пустой реестр типов событий
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{
+		types:    make(map[string]EventType),
+		personal: make(map[string]personalFields),
+	}
+}
+
+// Register регистрирует тип события
+func (r *EventRegistry) Register(eventType EventType) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if eventType.Name == "" || eventType.Codec == nil {
+		return fmt.Errorf("некорректное описание типа события: %+v", eventType)
+	}
+	if _, exists := r.types[eventType.Name]; exists {
+		return fmt.Errorf("тип события %s уже зарегистрирован", eventType.Name)
+	}
+
+	r.types[eventType.Name] = eventType
+	return nil
+}
+
+// MarkPersonalData отмечает поля события с персональными данными.
+// subjectField - строковое поле с ID владельца данных (например, клиента):
+// все отмеченные поля шифруются его ключом и скрываются после удаления ключа.
+func (r *EventRegistry) MarkPersonalData(eventType string, subjectField string, fields ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.types[eventType]; !exists {
+		return fmt.Errorf("тип события %s не зарегистрирован", eventType)
+	}
+	r.personal[eventType] = personalFields{
+		Subject: subjectField,
+		Fields:  append([]string{subjectField}, fields...),
+	}
+	return nil
+}
+
+// SetCipher включает шифрование персональных данных при записи и расшифровку при чтении
+func (r *EventRegistry) SetCipher(cipher PersonalDataCipher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cipher = cipher
+}
+
+// Seal шифрует персональные данные в DTO перед записью в лог ключом их владельца
+func (r *EventRegistry) Seal(dto EventDTO) (EventDTO, error) {
+	r.mu.RLock()
+	personal, found := r.personal[dto.Type]
+	cipher := r.cipher
+	r.mu.RUnlock()
+	if cipher == nil {
+		return dto, nil
+	}
+
+	if found {
+		fields, subject, err := personalValues(dto.Data, personal)
+		if err != nil {
+			return EventDTO{}, err
+		}
+		if subject != "" && subject != RedactedValue && !strings.HasPrefix(subject, sealedPrefix) {
+			for _, name := range personal.Fields {
+				value, ok := stringField(fields, name)
+				if !ok || value == "" || strings.HasPrefix(value, sealedPrefix) {
+					continue
+				}
+				sealed, err := cipher.Encrypt(subject, value)
+				if err != nil {
+					return EventDTO{}, fmt.Errorf("ошибка шифрования персональных данных: %w", err)
+				}
+				setStringField(fields, name, sealed)
+			}
+			if dto.Data, err = json.Marshal(fields); err != nil {
+				return EventDTO{}, err
+			}
+		}
+	}
+
+	// Инициатором команды может быть клиент: его ID шифруется его же ключом. ID остальных
+	// инициаторов (сотрудников, сервисов) не персональные данные клиентов и ключей не получают,
+	// иначе каждый новый X-Actor-ID добавлял бы ключ и перезаписывал файл ключей.
+	if dto.Metadata != nil && isPlainPersonalValue(dto.Metadata.ActorID) && cipher.HasKey(dto.Metadata.ActorID) {
+		metadata := *dto.Metadata
+		sealed, err := cipher.Encrypt(metadata.ActorID, metadata.ActorID)
+		if err != nil {
+			return EventDTO{}, fmt.Errorf("ошибка шифрования персональных данных: %w", err)
+		}
+		metadata.ActorID = sealed
+		dto.Metadata = &metadata
+	}
+	return dto, nil
+}
+
+// unseal расшифровывает персональные данные события; данные удаленных владельцев
+// заменяются на RedactedValue
+func (r *EventRegistry) unseal(eventType string, data json.RawMessage) (json.RawMessage, error) {
+	r.mu.RLock()
+	personal, found := r.personal[eventType]
+	cipher := r.cipher
+	r.mu.RUnlock()
+	if !found || cipher == nil {
+		return data, nil
+	}
+
+	fields, subject, err := personalValues(data, personal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Данные, записанные без шифрования, скрываем по списку удаленных владельцев
+	forgotten := subject != "" && !strings.HasPrefix(subject, sealedPrefix) && cipher.IsForgotten(subject)
+	for _, name := range personal.Fields {
+		value, ok := stringField(fields, name)
+		switch {
+		case !ok:
+			continue
+		case forgotten:
+			setStringField(fields, name, RedactedValue)
+		case strings.HasPrefix(value, sealedPrefix):
+			plaintext, erased, err := cipher.Decrypt(value)
+			if err != nil {
+				return nil, err
+			}
+			if erased {
+				plaintext = RedactedValue
+			}
+			setStringField(fields, name, plaintext)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// unsealActor расшифровывает ID инициатора из метаданных события; ID удаленного
+// клиента заменяется на RedactedValue
+func (r *EventRegistry) unsealActor(actorID string) (string, error) {
+	r.mu.RLock()
+	cipher := r.cipher
+	r.mu.RUnlock()
+
+	switch {
+	case cipher == nil || actorID == "":
+		return actorID, nil
+	case strings.HasPrefix(actorID, sealedPrefix):
+		plaintext, erased, err := cipher.Decrypt(actorID)
+		if erased {
+			plaintext = RedactedValue
+		}
+		return plaintext, err
+	case cipher.IsForgotten(actorID):
+		return RedactedValue, nil
+	}
+	return actorID, nil
+}
+
+// isPlainPersonalValue проверяет, что значение задано и еще не зашифровано или скрыто
+func isPlainPersonalValue(value string) bool {
+	return value != "" && value != RedactedValue && !strings.HasPrefix(value, sealedPrefix)
+}
+
+// Redact заменяет персональные данные события и ID инициатора в его метаданных
+// на RedactedValue, если их владелец - subject. Возвращает новое событие и признак замены.
+func (r *EventRegistry) Redact(event Event, subject string) (Event, bool, error) {
+	r.mu.RLock()
+	personal, found := r.personal[event.GetType()]
+	eventType, registered := r.types[event.GetType()]
+	r.mu.RUnlock()
+
+	metadata := event.GetMetadata()
+	changed := metadata.ActorID == subject
+	if !registered || (!found && !changed) {
+		return event, false, nil
+	}
+
+	data, err := eventType.Codec.Encode(event)
+	if err != nil {
+		return nil, false, err
+	}
+	if found {
+		fields, value, err := personalValues(data, personal)
+		if err != nil {
+			return nil, false, err
+		}
+		if value == subject {
+			for _, name := range personal.Fields {
+				if _, ok := stringField(fields, name); ok {
+					setStringField(fields, name, RedactedValue)
+				}
+			}
+			if data, err = json.Marshal(fields); err != nil {
+				return nil, false, err
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return event, false, nil
+	}
+
+	if metadata.ActorID == subject {
+		metadata.ActorID = RedactedValue
+	}
+	redacted, err := eventType.Codec.Decode(data, BaseEvent{OrderID: event.GetOrderID(), Metadata: metadata})
+	return redacted, err == nil, err
+}
+
+// personalValues разбирает данные события и возвращает их вместе с ID владельца
+func personalValues(data json.RawMessage, personal personalFields) (map[string]json.RawMessage, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, "", err
+	}
+	subject, _ := stringField(fields, personal.Subject)
+	return fields, subject, nil
+}
+
+// stringField возвращает строковое поле данных события
+func stringField(fields map[string]json.RawMessage, name string) (string, bool) {
+	var value string
+	if err := json.Unmarshal(fields[name], &value); err != nil {
+		return "", false
+	}
+	return value, true
+}
+
+// setStringField записывает строковое поле данных события
+func setStringField(fields map[string]json.RawMessage, name string, value string) {
+	fields[name], _ = json.Marshal(value)
+}
+
+// Encode сериализует событие в DTO для записи в лог
+func (r *EventRegistry) Encode(event Event) (EventDTO, error) {
+	var data json.RawMessage
+	var err error
+	version := 1
+
+	// Непрочитанные события сохраняем как есть
+	if raw, ok := event.(RawEvent); ok {
+		data = raw.Data
+		version = raw.Version
+	} else {
+		r.mu.RLock()
+		eventType, found := r.types[event.GetType()]
+		r.mu.RUnlock()
+		if !found {
+			return EventDTO{}, fmt.Errorf("неизвестный тип события: %s", event.GetType())
+		}
+
+		data, err = eventType.Codec.Encode(event)
+		if err != nil {
+			return EventDTO{}, err
+		}
+		version = eventType.Version()
+	}
+
+	dto := EventDTO{
+		Type:      event.GetType(),
+		Version:   version,
+		OrderID:   event.GetOrderID(),
+		Timestamp: event.GetTimestamp(),
+		Data:      data,
+	}
+	if metadata := event.GetMetadata(); metadata != (EventMetadata{}) {
+		dto.Metadata = &metadata
+	}
+	return dto, nil
+}
+
+// Decode восстанавливает событие из DTO, приводя данные к текущей версии схемы.
+// События незарегистрированных типов возвращаются как RawEvent.
+func (r *EventRegistry) Decode(dto EventDTO) (Event, error) {
+	// Восстанавливаем время из строки
+	timestamp, err := time.Parse(time.RFC3339, dto.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	base := BaseEvent{
+		OrderID:   dto.OrderID,
+		Timestamp: timestamp,
+	}
+	if dto.Metadata != nil {
+		base.Metadata = *dto.Metadata
+		if base.Metadata.ActorID, err = r.unsealActor(base.Metadata.ActorID); err != nil {
+			return nil, fmt.Errorf("ошибка при чтении инициатора события %s: %w", dto.Type, err)
+		}
+	}
+
+	// Записи без версии были сделаны до введения версионирования
+	version := dto.Version
+	if version == 0 {
+		version = 1
+	}
+
+	r.mu.RLock()
+	eventType, found := r.types[dto.Type]
+	r.mu.RUnlock()
+	if !found {
+		return RawEvent{BaseEvent: base, Type: dto.Type, Version: version, Data: dto.Data}, nil
+	}
+
+	data, err := eventType.upcast(dto.Data, version)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = r.unseal(dto.Type, data); err != nil {
+		return nil, fmt.Errorf("ошибка при чтении персональных данных события %s: %w", dto.Type, err)
+	}
+	return eventType.Codec.Decode(data, base)
+}
+
+// eventPointer ограничение для указателя на событие со встроенным BaseEvent
+type eventPointer[T any] interface {
+	*T
+	restoreBase(base BaseEvent)
+}
+
+// jsonEventCodec кодек, хранящий событие в виде JSON структуры T
+type jsonEventCodec[T Event, P eventPointer[T]] struct{}
+
+// Encode сериализует событие в JSON
+func (jsonEventCodec[T, P]) Encode(event Event) (json.RawMessage, error) {
+	return json.Marshal(event)
+}
+
+// Decode десериализует событие из JSON
+func (jsonEventCodec[T, P]) Decode(data json.RawMessage, base BaseEvent) (Event, error) {
+	var event T
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	P(&event).restoreBase(base)
+	return event, nil
+}
+
+// RegisterJSONEvent регистрирует тип события T с JSON кодеком.
+// Имя типа берется из T.GetType(), версия схемы равна len(upcasters)+1.
+func RegisterJSONEvent[T Event, P eventPointer[T]](registry *EventRegistry, upcasters ...Upcaster) error {
+	var zero T
+	return registry.Register(EventType{
+		Name:      zero.GetType(),
+		Codec:     jsonEventCodec[T, P]{},
+		Upcasters: upcasters,
+	})
+}
+
+// mustRegister прерывает запуск, если тип события не удалось зарегистрировать
+func mustRegister(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RawEvent событие неизвестного типа, сохраненное без разбора
+type RawEvent struct {
+	BaseEvent
+	Type    string          // Имя типа из лога
+	Version int             // Версия схемы из лога
+	Data    json.RawMessage // Исходные данные события
+}
+
+// GetType возвращает тип события из лога
+func (e RawEvent) GetType() string {
+	return e.Type
+}
@@ -0,0 +1,559 @@
+// segment_log.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy определяет, когда данные лога сбрасываются на диск
+type FsyncPolicy string
+
+const (
+	FsyncAlways   FsyncPolicy = "always"   // fsync после каждой записи
+	FsyncInterval FsyncPolicy = "interval" // fsync раз в FsyncInterval
+	FsyncNever    FsyncPolicy = "never"    // fsync оставляется операционной системе
+)
+
+// ParseFsyncPolicy разбирает политику fsync из строки
+func ParseFsyncPolicy(value string) (FsyncPolicy, error) {
+	switch policy := FsyncPolicy(value); policy {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("неизвестная политика fsync: %q (ожидается always, interval или never)", value)
+}
+
+const (
+	segmentExt      = ".log" // Расширение файлов сегментов
+	crcPrefixLength = 9      // 8 шестнадцатеричных цифр CRC и пробел
+)
+
+// crcTable таблица CRC-32C для контрольных сумм записей
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// LogConfig настройки сегментированного лога
+type LogConfig struct {
+	Dir             string        // Директория сегментов
+	SegmentMaxBytes int64         // Максимальный размер сегмента
+	Fsync           FsyncPolicy   // Политика fsync
+	FsyncInterval   time.Duration // Период fsync для политики interval
+	LegacyFile      string        // Старый однофайловый лог для импорта при первом запуске
+	AllowUnlocked   bool          // Открывать лог без блокировки, если платформа ее не поддерживает
+}
+
+// RecoveryReport описывает данные, отброшенные при восстановлении лога
+type RecoveryReport struct {
+	Segment        string // Сегмент с оборванным хвостом
+	Offset         int64  // Смещение, по которому сегмент был обрезан
+	DiscardedBytes int64  // Количество отброшенных байт
+	DiscardedTail  string // Начало отброшенных данных
+}
+
+// SegmentedLog журнал записей в сегментах ограниченного размера.
+// Каждая запись - строка "<crc32c в hex> <данные>\n".
+type SegmentedLog struct {
+	config   LogConfig
+	segments []string      // Имена файлов сегментов по порядку
+	active   *os.File      // Текущий сегмент для записи
+	size     int64         // Размер текущего сегмента
+	dirty    bool          // Есть данные, не сброшенные на диск
+	failed   error         // Ошибка записи, после которой лог не принимает записи
+	mu       sync.Mutex    // Мьютекс для безопасного доступа
+	stop     chan struct{} // Остановка фонового fsync
+	done     chan struct{} // Фоновый fsync завершен
+	lock     *DirLock      // Эксклюзивная блокировка директории: пишет только один процесс
+}
+
+// OpenSegmentedLog открывает лог, восстанавливает оборванный хвост последнего сегмента
+// и при необходимости импортирует старый однофайловый лог. Директория блокируется до Close;
+// если ее держит другой процесс, возвращается *DirLockedError.
+func OpenSegmentedLog(config LogConfig) (_ *SegmentedLog, _ *RecoveryReport, err error) {
+	if config.SegmentMaxBytes <= 0 {
+		return nil, nil, errors.New("размер сегмента должен быть положительным")
+	}
+	if config.Fsync == FsyncInterval && config.FsyncInterval <= 0 {
+		return nil, nil, errors.New("для политики interval нужен положительный FsyncInterval")
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	// Блокируем директорию до чтения сегментов: второй писатель не должен даже восстанавливать хвост
+	lock, err := LockDir(config.Dir)
+	if errors.Is(err, errLockUnsupported) && config.AllowUnlocked {
+		log.Printf("Блокировка %s не поддерживается на этой платформе, лог открыт без нее: не запускайте несколько писателей", config.Dir)
+		lock, err = nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.Release()
+		}
+	}()
+
+	l := &SegmentedLog{config: config, lock: lock}
+
+	segments, err := l.listSegments()
+	if err != nil {
+		return nil, nil, err
+	}
+	l.segments = segments
+
+	// Первый запуск: переносим записи из старого лога
+	if len(l.segments) == 0 && config.LegacyFile != "" {
+		if err := l.importLegacy(config.LegacyFile); err != nil {
+			return nil, nil, fmt.Errorf("ошибка при импорте лога %s: %w", config.LegacyFile, err)
+		}
+	}
+
+	var report *RecoveryReport
+	switch {
+	case len(l.segments) == 0:
+		if err := l.roll(); err != nil {
+			return nil, nil, err
+		}
+	default:
+		report, err = l.recoverTail()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := l.openActive(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if config.Fsync == FsyncInterval {
+		l.stop = make(chan struct{})
+		l.done = make(chan struct{})
+		go l.syncLoop()
+	}
+
+	return l, report, nil
+}
+
+// Append добавляет запись в лог, при необходимости открывая новый сегмент
+func (l *SegmentedLog) Append(data []byte) error {
+	return l.AppendBatch([][]byte{data})
+}
+
+// AppendBatch добавляет пачку записей одной операцией записи на сегмент
+// и выполняет один fsync для всей пачки (при политике always).
+// После ошибки записи лог перестает принимать записи: на диске мог остаться
+// оборванный хвост, который будет обрезан при следующем запуске.
+func (l *SegmentedLog) AppendBatch(records [][]byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.failed != nil {
+		return fmt.Errorf("лог недоступен после ошибки записи: %w", l.failed)
+	}
+
+	err := l.write(records)
+	if err == nil && l.config.Fsync == FsyncAlways {
+		err = l.syncActive()
+	}
+	if err != nil {
+		l.failed = err
+	}
+	return err
+}
+
+// write записывает записи без fsync, открывая новые сегменты по мере заполнения (вызывается под блокировкой)
+func (l *SegmentedLog) write(records [][]byte) error {
+	if l.active == nil {
+		return errors.New("лог закрыт")
+	}
+
+	buffer := make([]byte, 0)
+	for _, data := range records {
+		if bytes.IndexByte(data, '\n') >= 0 {
+			return errors.New("запись лога не может содержать перевод строки")
+		}
+
+		record := encodeRecord(data)
+		pending := l.size + int64(len(buffer))
+		if pending > 0 && pending+int64(len(record)) > l.config.SegmentMaxBytes {
+			// Сегмент заполнен: дописываем накопленное и открываем следующий
+			if err := l.flush(buffer); err != nil {
+				return err
+			}
+			buffer = buffer[:0]
+			if err := l.roll(); err != nil {
+				return err
+			}
+		}
+		buffer = append(buffer, record...)
+	}
+
+	return l.flush(buffer)
+}
+
+// flush записывает подготовленные записи в текущий сегмент (вызывается под блокировкой)
+func (l *SegmentedLog) flush(buffer []byte) error {
+	if len(buffer) == 0 {
+		return nil
+	}
+	n, err := l.active.Write(buffer)
+	l.size += int64(n)
+	l.dirty = true
+	return err
+}
+
+// Replay последовательно передает все записи лога в handler
+func (l *SegmentedLog) Replay(handler func(data []byte) error) error {
+	l.mu.Lock()
+	segments := append([]string(nil), l.segments...)
+	l.mu.Unlock()
+
+	for _, segment := range segments {
+		if err := l.replaySegment(segment, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync сбрасывает текущий сегмент на диск
+func (l *SegmentedLog) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncActive()
+}
+
+// Close останавливает фоновый fsync, сбрасывает данные и закрывает лог
+func (l *SegmentedLog) Close() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+	err := l.syncActive()
+	if closeErr := l.active.Close(); err == nil {
+		err = closeErr
+	}
+	l.active = nil
+	if unlockErr := l.lock.Release(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// syncLoop периодически сбрасывает данные на диск (политика interval)
+func (l *SegmentedLog) syncLoop() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.config.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.Sync(); err != nil {
+				log.Printf("Ошибка fsync лога событий: %v", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// syncActive выполняет fsync текущего сегмента, если есть новые данные (вызывается под блокировкой)
+func (l *SegmentedLog) syncActive() error {
+	if !l.dirty || l.active == nil {
+		return nil
+	}
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// roll закрывает текущий сегмент и создает следующий (вызывается под блокировкой)
+func (l *SegmentedLog) roll() error {
+	if l.active != nil {
+		if err := l.syncActive(); err != nil {
+			return err
+		}
+		if err := l.active.Close(); err != nil {
+			return err
+		}
+		l.active = nil
+	}
+
+	next := 1
+	if len(l.segments) > 0 {
+		last, _ := strconv.Atoi(strings.TrimSuffix(l.segments[len(l.segments)-1], segmentExt))
+		next = last + 1
+	}
+	name := fmt.Sprintf("%08d%s", next, segmentExt)
+	file, err := os.OpenFile(filepath.Join(l.config.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(l.config.Dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.segments = append(l.segments, name)
+	l.active = file
+	l.size = 0
+	return nil
+}
+
+// openActive открывает последний сегмент для дозаписи
+func (l *SegmentedLog) openActive() error {
+	path := filepath.Join(l.config.Dir, l.segments[len(l.segments)-1])
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.active = file
+	l.size = info.Size()
+	return nil
+}
+
+// listSegments возвращает имена сегментов в директории лога по порядку
+func (l *SegmentedLog) listSegments() ([]string, error) {
+	entries, err := os.ReadDir(l.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt)); err != nil {
+			continue
+		}
+		segments = append(segments, name)
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// replaySegment читает записи одного сегмента, проверяя контрольные суммы
+func (l *SegmentedLog) replaySegment(segment string, handler func(data []byte) error) error {
+	file, err := os.Open(filepath.Join(l.config.Dir, segment))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		data, ok := decodeRecord(line)
+		if !ok {
+			return fmt.Errorf("повреждена запись в сегменте %s по смещению %d", segment, offset)
+		}
+		if err := handler(data); err != nil {
+			return fmt.Errorf("сегмент %s, смещение %d: %w", segment, offset, err)
+		}
+		offset += int64(len(line))
+	}
+}
+
+// recoverTail находит последнюю целую запись в последнем сегменте и обрезает все после нее.
+// Поврежденными считаются только записи в хвосте: повреждение в середине лога
+// обнаружится при чтении и остановит запуск.
+func (l *SegmentedLog) recoverTail() (*RecoveryReport, error) {
+	segment := l.segments[len(l.segments)-1]
+	path := filepath.Join(l.config.Dir, segment)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ищем конец последней подряд идущей целой записи
+	var validEnd int64
+	for validEnd < int64(len(content)) {
+		rest := content[validEnd:]
+		newline := bytes.IndexByte(rest, '\n')
+		if newline < 0 {
+			break
+		}
+		if _, ok := decodeRecord(rest[:newline+1]); !ok {
+			break
+		}
+		validEnd += int64(newline + 1)
+	}
+
+	if validEnd == int64(len(content)) {
+		return nil, nil
+	}
+
+	// Если после поврежденной записи есть целые, это не оборванная запись, а порча данных
+	if hasValidRecordAfter(content[validEnd:]) {
+		return nil, fmt.Errorf("повреждена запись в сегменте %s по смещению %d", segment, validEnd)
+	}
+
+	tail := content[validEnd:]
+	report := &RecoveryReport{
+		Segment:        segment,
+		Offset:         validEnd,
+		DiscardedBytes: int64(len(tail)),
+		DiscardedTail:  string(tail[:min(len(tail), 200)]),
+	}
+
+	if err := os.Truncate(path, validEnd); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// hasValidRecordAfter проверяет, есть ли целые записи после первой поврежденной строки
+func hasValidRecordAfter(tail []byte) bool {
+	newline := bytes.IndexByte(tail, '\n')
+	if newline < 0 {
+		return false
+	}
+	for _, line := range bytes.SplitAfter(tail[newline+1:], []byte("\n")) {
+		if _, ok := decodeRecord(line); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// importLegacy переносит записи старого однофайлового лога в новый сегмент.
+// Оборванная последняя строка старого лога отбрасывается.
+func (l *SegmentedLog) importLegacy(legacyFile string) error {
+	content, err := os.ReadFile(legacyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Импорт пишется во временный файл и становится первым сегментом только целиком:
+	// после сбоя посреди импорта сегментов нет, и импорт повторяется при следующем запуске
+	name := fmt.Sprintf("%08d%s", 1, segmentExt)
+	tmpPath := filepath.Join(l.config.Dir, name+".import")
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	imported, err := writeLegacyRecords(file, content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(l.config.Dir, name))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := syncDir(l.config.Dir); err != nil {
+		return err
+	}
+
+	l.segments = []string{name}
+	log.Printf("Импортировано %d событий из %s в %s", imported, legacyFile, l.config.Dir)
+	return nil
+}
+
+// writeLegacyRecords переписывает строки старого лога в формат сегмента с контрольными суммами
+func writeLegacyRecords(file *os.File, content []byte) (int, error) {
+	writer := bufio.NewWriter(file)
+	imported := 0
+	lines := bytes.Split(content, []byte("\n"))
+	for i, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			if i == len(lines)-1 {
+				log.Printf("Отброшена оборванная последняя строка старого лога: %q", line)
+				break
+			}
+			return imported, fmt.Errorf("некорректная строка %d", i+1)
+		}
+		if _, err := writer.Write(encodeRecord(line)); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, writer.Flush()
+}
+
+// encodeRecord формирует строку записи с контрольной суммой
+func encodeRecord(data []byte) []byte {
+	record := make([]byte, 0, crcPrefixLength+len(data)+1)
+	record = fmt.Appendf(record, "%08x ", crc32.Checksum(data, crcTable))
+	record = append(record, data...)
+	return append(record, '\n')
+}
+
+// decodeRecord проверяет строку записи и возвращает ее данные
+func decodeRecord(line []byte) ([]byte, bool) {
+	if len(line) < crcPrefixLength+1 || line[len(line)-1] != '\n' || line[crcPrefixLength-1] != ' ' {
+		return nil, false
+	}
+	checksum, err := strconv.ParseUint(string(line[:crcPrefixLength-1]), 16, 32)
+	if err != nil {
+		return nil, false
+	}
+	data := line[crcPrefixLength : len(line)-1]
+	if crc32.Checksum(data, crcTable) != uint32(checksum) {
+		return nil, false
+	}
+	return data, true
+}
+
+// syncDir выполняет fsync директории, чтобы создание файла пережило сбой
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,149 @@
+// segment_log_test.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testLogConfig настройки лога во временной директории
+func testLogConfig(t *testing.T) LogConfig {
+	return LogConfig{Dir: t.TempDir(), SegmentMaxBytes: 1 << 20, Fsync: FsyncNever}
+}
+
+// writeTestLog записывает в лог записи {"n":1}..{"n":count} и закрывает его
+func writeTestLog(t *testing.T, config LogConfig, count int) {
+	t.Helper()
+	l, _, err := OpenSegmentedLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= count; i++ {
+		if err := l.Append([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replayTestLog открывает лог и возвращает его записи и отчет о восстановлении
+func replayTestLog(t *testing.T, config LogConfig) ([]string, *RecoveryReport) {
+	t.Helper()
+	l, report, err := OpenSegmentedLog(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var records []string
+	if err := l.Replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return records, report
+}
+
+// firstSegment возвращает путь к первому сегменту лога
+func firstSegment(config LogConfig) string {
+	return filepath.Join(config.Dir, fmt.Sprintf("%08d%s", 1, segmentExt))
+}
+
+func TestSegmentedLogTruncatesTornLastRecord(t *testing.T) {
+	config := testLogConfig(t)
+	writeTestLog(t, config, 3)
+
+	// Сбой посреди записи: последняя запись оборвана без перевода строки
+	path := firstSegment(config)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := encodeRecord([]byte(`{"n":4}`))
+	if err := os.WriteFile(path, append(content, torn[:len(torn)/2]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, report := replayTestLog(t, config)
+	if len(records) != 3 || records[2] != `{"n":3}` {
+		t.Fatalf("после восстановления записи %v, ожидались три целые", records)
+	}
+	if report == nil || report.Offset != int64(len(content)) || report.DiscardedBytes != int64(len(torn)/2) {
+		t.Fatalf("отчет о восстановлении %+v, ожидалось обрезание по смещению %d", report, len(content))
+	}
+	if info, _ := os.Stat(path); info.Size() != int64(len(content)) {
+		t.Fatalf("размер сегмента %d, ожидался %d", info.Size(), len(content))
+	}
+}
+
+func TestSegmentedLogRejectsCorruptedRecordMidSegment(t *testing.T) {
+	config := testLogConfig(t)
+	writeTestLog(t, config, 3)
+
+	// Портим контрольную сумму второй записи: после нее есть целая третья
+	path := firstSegment(config)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := strings.Index(string(content), "\n") + 1
+	corrupted := append([]byte(nil), content...)
+	if corrupted[second] == '0' {
+		corrupted[second] = '1'
+	} else {
+		corrupted[second] = '0'
+	}
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, _, err := OpenSegmentedLog(config); err == nil {
+		l.Close()
+		t.Fatal("лог с поврежденной записью в середине открылся")
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(corrupted) {
+		t.Fatal("сегмент с поврежденной записью в середине обрезан")
+	}
+}
+
+func TestSegmentedLogRetriesInterruptedLegacyImport(t *testing.T) {
+	config := testLogConfig(t)
+	config.LegacyFile = filepath.Join(t.TempDir(), "event_log.json")
+	legacy := "{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"
+	if err := os.WriteFile(config.LegacyFile, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Сбой посреди импорта: временный файл записан наполовину, сегментов еще нет
+	partial := encodeRecord([]byte(`{"n":1}`))
+	tmpPath := firstSegment(config) + ".import"
+	if err := os.WriteFile(tmpPath, partial[:len(partial)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	records, report := replayTestLog(t, config)
+	if report != nil {
+		t.Fatalf("повторный импорт не должен ничего обрезать: %+v", report)
+	}
+	if strings.Join(records, "\n")+"\n" != legacy {
+		t.Fatalf("после повторного импорта записи %v", records)
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatalf("временный файл импорта остался: %v", err)
+	}
+
+	// Импорт выполняется один раз: при следующем открытии записи не дублируются
+	if records, _ := replayTestLog(t, config); len(records) != 3 {
+		t.Fatalf("после повторного открытия записей %d, ожидалось 3", len(records))
+	}
+}
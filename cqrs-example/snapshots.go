@@ -0,0 +1,169 @@
+// snapshots.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// orderStateSchemaVersion версия структуры OrderState в снимках.
+// Увеличивайте ее при любом изменении OrderState или applyEvent:
+// снимки со старой версией будут отброшены, а состояние восстановлено из событий.
+const orderStateSchemaVersion = 3
+
+// OrderSnapshot снимок состояния заказа на определенной версии его потока
+type OrderSnapshot struct {
+	SchemaVersion int        `json:"schema_version"` // Версия структуры OrderState
+	Version       int        `json:"version"`        // Версия потока, на которой сделан снимок
+	State         OrderState `json:"state"`          // Состояние заказа
+}
+
+// SnapshotStore хранилище снимков состояний заказов
+type SnapshotStore struct {
+	path      string                    // Путь к файлу снимков
+	snapshots map[OrderID]OrderSnapshot // Последний снимок каждого заказа
+	mu        sync.RWMutex              // Мьютекс для безопасного доступа
+}
+
+// NewSnapshotStore создает хранилище снимков и загружает снимки из файла.
+// С пустым путем снимки хранятся только в памяти.
+func NewSnapshotStore(path string) (*SnapshotStore, error) {
+	store := &SnapshotStore{
+		path:      path,
+		snapshots: make(map[OrderID]OrderSnapshot),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при чтении снимков: %w", err)
+	}
+
+	// Состояние разбираем только после проверки версии схемы:
+	// снимок старой версии может не соответствовать текущей структуре OrderState
+	var records []struct {
+		SchemaVersion int             `json:"schema_version"`
+		Version       int             `json:"version"`
+		State         json.RawMessage `json:"state"`
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("ошибка при разборе снимков: %w", err)
+	}
+
+	// Снимки устаревшей версии схемы игнорируем
+	discarded := 0
+	for _, record := range records {
+		if record.SchemaVersion != orderStateSchemaVersion {
+			discarded++
+			continue
+		}
+		snapshot := OrderSnapshot{SchemaVersion: record.SchemaVersion, Version: record.Version}
+		if err := json.Unmarshal(record.State, &snapshot.State); err != nil {
+			return nil, fmt.Errorf("ошибка при разборе снимка: %w", err)
+		}
+		store.snapshots[snapshot.State.ID] = snapshot
+	}
+	if discarded > 0 {
+		log.Printf("Отброшено %d снимков устаревшей версии схемы", discarded)
+	}
+
+	return store, nil
+}
+
+// Get возвращает последний снимок заказа
+func (s *SnapshotStore) Get(orderID OrderID) (OrderSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot, found := s.snapshots[orderID]
+	if found {
+		snapshot.State = *cloneOrderState(&snapshot.State)
+	}
+	return snapshot, found
+}
+
+// Delete удаляет снимок заказа, например если он опережает лог событий
+func (s *SnapshotStore) Delete(orderID OrderID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.snapshots[orderID]; !found {
+		return nil
+	}
+	delete(s.snapshots, orderID)
+	return s.persist()
+}
+
+// DeleteCustomer удаляет снимки заказов клиента, например после удаления его персональных данных
+func (s *SnapshotStore) DeleteCustomer(customerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for orderID, snapshot := range s.snapshots {
+		if snapshot.State.CustomerID == customerID {
+			delete(s.snapshots, orderID)
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return nil
+	}
+	return s.persist()
+}
+
+// Save сохраняет снимок, если он новее уже сохраненного
+func (s *SnapshotStore) Save(snapshot OrderSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	orderID := snapshot.State.ID
+	if existing, found := s.snapshots[orderID]; found && existing.Version >= snapshot.Version {
+		return nil
+	}
+
+	snapshot.SchemaVersion = orderStateSchemaVersion
+	snapshot.State = *cloneOrderState(&snapshot.State)
+	s.snapshots[orderID] = snapshot
+
+	return s.persist()
+}
+
+// persist атомарно перезаписывает файл снимков (вызывается под блокировкой)
+func (s *SnapshotStore) persist() error {
+	if s.path == "" {
+		return nil
+	}
+
+	snapshots := make([]OrderSnapshot, 0, len(s.snapshots))
+	for _, snapshot := range s.snapshots {
+		snapshots = append(snapshots, snapshot)
+	}
+
+	data, err := json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+
+	// Пишем во временный файл и переименовываем, чтобы не оставить файл наполовину записанным
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// cloneOrderState возвращает копию состояния заказа
+func cloneOrderState(state *OrderState) *OrderState {
+	clone := *state
+	clone.Items = append([]OrderItem(nil), state.Items...)
+	return &clone
+}
@@ -0,0 +1,197 @@
+// state_machine.go
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Статусы заказа
+const (
+	StatusUnknown   = "unknown"   // Заказ еще не создан
+	StatusCreated   = "created"   // Создан, ожидает оплаты
+	StatusPaid      = "paid"      // Оплачен
+	StatusShipped   = "shipped"   // Отправлен
+	StatusDelivered = "delivered" // Доставлен
+	StatusCancelled = "cancelled" // Отменен
+	StatusRefunded  = "refunded"  // Оплата возвращена
+)
+
+// Имена команд заказа
+const (
+	CommandCreateOrder  = "CreateOrder"
+	CommandPayOrder     = "PayOrder"
+	CommandShipOrder    = "ShipOrder"
+	CommandDeliverOrder = "DeliverOrder"
+	CommandCancelOrder  = "CancelOrder"
+	CommandRefundOrder  = "RefundOrder"
+)
+
+// Transition переход конечного автомата заказа: команда, допустимая в статусах From,
+// порождает событие Event и переводит заказ в статус To
+type Transition struct {
+	Command string   `json:"command"`
+	Action  string   `json:"-"` // Действие для сообщения об ошибке: "невозможно <Action> заказ в статусе ..."
+	From    []string `json:"from"`
+	Event   string   `json:"event"`
+	To      string   `json:"to"`
+}
+
+// TransitionError возвращается, если команда недопустима в текущем статусе заказа
+type TransitionError struct {
+	Command string // Команда
+	Action  string // Действие для сообщения
+	Status  string // Текущий статус заказа
+}
+
+// Error возвращает описание недопустимого перехода
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("невозможно %s заказ в статусе %s", e.Action, e.Status)
+}
+
+// StateMachine конечный автомат жизненного цикла заказа
+type StateMachine struct {
+	transitions []Transition
+	byCommand   map[string]Transition
+	byEvent     map[string]Transition
+}
+
+// orderStateMachine таблица переходов заказа; ее используют и команды, и applyEvent
+var orderStateMachine = NewStateMachine(
+	Transition{Command: CommandCreateOrder, Action: "создать", From: []string{StatusUnknown}, Event: "OrderCreated", To: StatusCreated},
+	Transition{Command: CommandPayOrder, Action: "оплатить", From: []string{StatusCreated}, Event: "OrderPaid", To: StatusPaid},
+	Transition{Command: CommandShipOrder, Action: "отправить", From: []string{StatusPaid}, Event: "OrderShipped", To: StatusShipped},
+	Transition{Command: CommandDeliverOrder, Action: "доставить", From: []string{StatusShipped}, Event: "OrderDelivered", To: StatusDelivered},
+	Transition{Command: CommandCancelOrder, Action: "отменить", From: []string{StatusCreated, StatusPaid}, Event: "OrderCancelled", To: StatusCancelled},
+	Transition{Command: CommandRefundOrder, Action: "вернуть оплату за", From: []string{StatusPaid, StatusShipped, StatusDelivered}, Event: "OrderRefunded", To: StatusRefunded},
+)
+
+// NewStateMachine создает конечный автомат из таблицы переходов.
+// Каждая команда и каждое событие должны встречаться в таблице один раз.
+func NewStateMachine(transitions ...Transition) *StateMachine {
+	machine := &StateMachine{
+		transitions: transitions,
+		byCommand:   make(map[string]Transition),
+		byEvent:     make(map[string]Transition),
+	}
+	for _, transition := range transitions {
+		if _, found := machine.byCommand[transition.Command]; found {
+			panic(fmt.Sprintf("команда %s встречается в таблице переходов дважды", transition.Command))
+		}
+		if _, found := machine.byEvent[transition.Event]; found {
+			panic(fmt.Sprintf("событие %s встречается в таблице переходов дважды", transition.Event))
+		}
+		machine.byCommand[transition.Command] = transition
+		machine.byEvent[transition.Event] = transition
+	}
+	return machine
+}
+
+// Transitions возвращает таблицу переходов
+func (m *StateMachine) Transitions() []Transition {
+	return append([]Transition(nil), m.transitions...)
+}
+
+// Check проверяет, допустима ли команда в статусе status, и возвращает ее переход
+func (m *StateMachine) Check(command string, status string) (Transition, error) {
+	transition, found := m.byCommand[command]
+	if !found {
+		return Transition{}, fmt.Errorf("неизвестная команда: %s", command)
+	}
+	for _, from := range transition.From {
+		if from == status {
+			return transition, nil
+		}
+	}
+	return Transition{}, &TransitionError{Command: command, Action: transition.Action, Status: status}
+}
+
+// Transition возвращает переход команды
+func (m *StateMachine) Transition(command string) (Transition, bool) {
+	transition, found := m.byCommand[command]
+	return transition, found
+}
+
+// StatusAfter возвращает статус заказа после события указанного типа.
+// Событие - уже свершившийся факт, поэтому исходный статус не проверяется.
+func (m *StateMachine) StatusAfter(eventType string) (string, bool) {
+	transition, found := m.byEvent[eventType]
+	return transition.To, found
+}
+
+// statuses возвращает все статусы автомата в порядке первого появления в таблице
+func (m *StateMachine) statuses() []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(status string) {
+		if !seen[status] {
+			seen[status] = true
+			result = append(result, status)
+		}
+	}
+	for _, transition := range m.transitions {
+		for _, from := range transition.From {
+			add(from)
+		}
+		add(transition.To)
+	}
+	return result
+}
+
+// finalStatuses возвращает статусы, из которых нет переходов
+func (m *StateMachine) finalStatuses() []string {
+	outgoing := make(map[string]bool)
+	for _, transition := range m.transitions {
+		for _, from := range transition.From {
+			outgoing[from] = true
+		}
+	}
+
+	var result []string
+	for _, status := range m.statuses() {
+		if !outgoing[status] {
+			result = append(result, status)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Mermaid возвращает диаграмму автомата в формате Mermaid (stateDiagram-v2)
+func (m *StateMachine) Mermaid() string {
+	var b strings.Builder
+	b.WriteString("stateDiagram-v2\n")
+	for _, transition := range m.transitions {
+		for _, from := range transition.From {
+			if from == StatusUnknown {
+				from = "[*]"
+			}
+			fmt.Fprintf(&b, "    %s --> %s : %s / %s\n", from, transition.To, transition.Command, transition.Event)
+		}
+	}
+	for _, status := range m.finalStatuses() {
+		fmt.Fprintf(&b, "    %s --> [*]\n", status)
+	}
+	return b.String()
+}
+
+// Graphviz возвращает диаграмму автомата в формате Graphviz DOT
+func (m *StateMachine) Graphviz() string {
+	var b strings.Builder
+	b.WriteString("digraph OrderStateMachine {\n")
+	b.WriteString("    rankdir=LR;\n")
+	b.WriteString("    node [shape=ellipse];\n")
+	fmt.Fprintf(&b, "    %q [shape=point];\n", StatusUnknown)
+	for _, status := range m.finalStatuses() {
+		fmt.Fprintf(&b, "    %q [shape=doublecircle];\n", status)
+	}
+	for _, transition := range m.transitions {
+		for _, from := range transition.From {
+			fmt.Fprintf(&b, "    %q -> %q [label=%q];\n", from, transition.To,
+				transition.Command+" / "+transition.Event)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
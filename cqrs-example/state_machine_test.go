@@ -0,0 +1,96 @@
+// state_machine_test.go
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderStateMachineCheck(t *testing.T) {
+	// Полная таблица: для каждого статуса - разрешенные команды и статус после них.
+	// Все остальные команды в этом статусе запрещены.
+	tests := []struct {
+		status  string
+		allowed map[string]string
+	}{
+		{StatusUnknown, map[string]string{
+			CommandCreateOrder: StatusCreated,
+		}},
+		{StatusCreated, map[string]string{
+			CommandPayOrder:    StatusPaid,
+			CommandCancelOrder: StatusCancelled,
+		}},
+		{StatusPaid, map[string]string{
+			CommandShipOrder:   StatusShipped,
+			CommandCancelOrder: StatusCancelled,
+			CommandRefundOrder: StatusRefunded,
+		}},
+		{StatusShipped, map[string]string{
+			CommandDeliverOrder: StatusDelivered,
+			CommandRefundOrder:  StatusRefunded,
+		}},
+		{StatusDelivered, map[string]string{
+			CommandRefundOrder: StatusRefunded,
+		}},
+		{StatusCancelled, map[string]string{}},
+		{StatusRefunded, map[string]string{}},
+	}
+	commands := []string{
+		CommandCreateOrder, CommandPayOrder, CommandShipOrder,
+		CommandDeliverOrder, CommandCancelOrder, CommandRefundOrder,
+	}
+
+	listed := make(map[string]bool)
+	for _, test := range tests {
+		listed[test.status] = true
+		for _, command := range commands {
+			transition, err := orderStateMachine.Check(command, test.status)
+			to, allowed := test.allowed[command]
+
+			if allowed {
+				if err != nil {
+					t.Errorf("%s в статусе %s: %v, ожидался переход в %s", command, test.status, err, to)
+				} else if transition.To != to {
+					t.Errorf("%s в статусе %s: переход в %s, ожидался в %s", command, test.status, transition.To, to)
+				} else if after, _ := orderStateMachine.StatusAfter(transition.Event); after != to {
+					t.Errorf("событие %s переводит в %s, команда %s - в %s", transition.Event, after, command, to)
+				}
+				continue
+			}
+
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) {
+				t.Errorf("%s в статусе %s: ошибка %v, ожидался запрет перехода", command, test.status, err)
+				continue
+			}
+			if transitionErr.Command != command || transitionErr.Status != test.status {
+				t.Errorf("%s в статусе %s: в ошибке команда %s и статус %s",
+					command, test.status, transitionErr.Command, transitionErr.Status)
+			}
+		}
+	}
+
+	// Таблица теста покрывает все статусы автомата
+	for _, status := range orderStateMachine.statuses() {
+		if !listed[status] {
+			t.Errorf("статус %s отсутствует в таблице теста", status)
+		}
+	}
+	for _, transition := range orderStateMachine.Transitions() {
+		found := false
+		for _, command := range commands {
+			found = found || command == transition.Command
+		}
+		if !found {
+			t.Errorf("команда %s отсутствует в таблице теста", transition.Command)
+		}
+	}
+}
+
+func TestOrderStateMachineUnknownCommand(t *testing.T) {
+	_, err := orderStateMachine.Check("ArchiveOrder", StatusCreated)
+	var transitionErr *TransitionError
+	if err == nil || errors.As(err, &transitionErr) {
+		t.Fatalf("неизвестная команда: ошибка %v, ожидалась ошибка неизвестной команды", err)
+	}
+}
@@ -2,67 +2,258 @@
 package main
 
 import (
+	"fmt"
 	"log"
-	"sync"
+	"time"
 )
 
+// EventStoreConfig настройки хранилища событий
+type EventStoreConfig struct {
+	Backend          string    // Хранилище событий: file, memory или redis
+	Log              LogConfig // Настройки журнала событий в файлах
+	RedisAddr        string    // Адрес Redis для хранилища redis
+	RedisStream      string    // Ключ потока Redis Streams с событиями
+	SnapshotFilePath string    // Путь к файлу снимков состояний заказов ("" - только в памяти)
+	KeysFilePath     string    // Путь к файлу ключей персональных данных ("" - только в памяти)
+	SnapshotEvery    int       // Делать снимок каждые N событий заказа (0 - только по запросу)
+	OrderIDs         string    // Стратегия ID заказов: sequence или ulid
+}
+
 // EventStore хранилище событий
 type EventStore struct {
-	queue    *EventQueue     // Очередь событий
-	orderID  int             // Счетчик ID заказов
-	mu       sync.RWMutex    // Мьютекс для безопасного доступа
+	backend       EventBackend     // Хранилище событий
+	snapshots     *SnapshotStore   // Снимки состояний заказов
+	keys          *KeyStore        // Ключи шифрования персональных данных
+	orderIDs      OrderIDAllocator // Распределитель ID заказов
+	snapshotEvery int              // Периодичность снимков в событиях
 }
 
 // NewEventStore создает новое хранилище событий
-func NewEventStore(logFilePath string) (*EventStore, error) {
-	// Создаем очередь событий
-	queue, err := NewEventQueue(logFilePath)
+func NewEventStore(config EventStoreConfig) (*EventStore, error) {
+	// Ключи нужны до загрузки событий, чтобы расшифровать персональные данные
+	keys, err := NewKeyStore(config.KeysFilePath)
+	if err != nil {
+		return nil, err
+	}
+	eventRegistry.SetCipher(keys)
+
+	// Открываем хранилище событий выбранного типа
+	backend, err := NewEventBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Загружаем снимки состояний
+	snapshots, err := NewSnapshotStore(config.SnapshotFilePath)
 	if err != nil {
+		backend.Close()
 		return nil, err
 	}
 
 	store := &EventStore{
-		queue:   queue,
-		orderID: 0,
+		backend:       backend,
+		snapshots:     snapshots,
+		keys:          keys,
+		snapshotEvery: config.SnapshotEvery,
 	}
 
 	// Определяем максимальный orderID из загруженных событий
-	events := queue.GetAll()
-	for _, event := range events {
-		if event.GetOrderID() > store.orderID {
-			store.orderID = event.GetOrderID()
+	lastID := 0
+	records, _, _ := backend.ReadAll(EventQuery{})
+	for _, record := range records {
+		if id, ok := record.Event.GetOrderID().Int(); ok {
+			lastID = max(lastID, id)
 		}
 	}
 
+	// ID выдаются не меньше максимального в логе и не повторяются после перезапуска
+	store.orderIDs, err = NewOrderIDAllocator(config, lastID)
+	if err != nil {
+		backend.Close()
+		return nil, err
+	}
+
 	return store, nil
 }
 
-// NextOrderID генерирует следующий ID заказа
-func (s *EventStore) NextOrderID() int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.orderID++
-	return s.orderID
+// Close закрывает хранилище событий
+func (s *EventStore) Close() error {
+	err := s.backend.Close()
+	if closeErr := s.orderIDs.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// NextOrderID выдает ID нового заказа
+func (s *EventStore) NextOrderID() (OrderID, error) {
+	return s.orderIDs.Next()
 }
 
-// SaveEvent сохраняет событие в хранилище
-func (s *EventStore) SaveEvent(event Event) error {
+// SaveEvent сохраняет событие в хранилище.
+// expectedVersion задает версию потока заказа, на основе которой было создано событие;
+// при несовпадении возвращается *ConcurrencyError. AnyVersion отключает проверку.
+func (s *EventStore) SaveEvent(event Event, expectedVersion int) error {
 	// Добавляем событие в очередь
-	err := s.queue.Enqueue(event)
+	err := s.backend.Append(event, expectedVersion)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Событие сохранено: %s для заказа #%d", event.GetType(), event.GetOrderID())
+	log.Printf("Событие сохранено: %s для заказа #%s", event.GetType(), event.GetOrderID())
+
+	// Делаем снимок, если с предыдущего накопилось достаточно событий
+	s.maybeSnapshot(event.GetOrderID())
 	return nil
 }
 
+// LoadOrderState восстанавливает состояние заказа из последнего снимка и
+// событий, добавленных после него. Возвращает nil, если заказ не найден.
+func (s *EventStore) LoadOrderState(orderID OrderID) (*OrderState, int) {
+	var state *OrderState
+	fromVersion := 0
+
+	snapshot, found := s.snapshots.Get(orderID)
+	if found {
+		state = &snapshot.State
+		fromVersion = snapshot.Version
+	}
+
+	events, version := s.backend.ReadStream(orderID, fromVersion)
+	if version < fromVersion {
+		// Снимок опережает лог событий: доверять ему нельзя
+		log.Printf("Снимок заказа #%s (версия %d) новее лога (версия %d), удаляем его",
+			orderID, fromVersion, version)
+		if err := s.snapshots.Delete(orderID); err != nil {
+			log.Printf("Ошибка при удалении снимка заказа #%s: %v", orderID, err)
+		}
+		state = nil
+		events, version = s.backend.ReadStream(orderID, 0)
+	}
+
+	if state == nil {
+		state = buildOrderState(events)
+		return state, version
+	}
+
+	for _, event := range events {
+		applyEvent(state, event)
+	}
+	return state, version
+}
+
+// ForgetCustomer удаляет ключ персональных данных клиента: его данные в логе становятся
+// нечитаемыми и во всех событиях заменяются на RedactedValue. Возвращает количество скрытых событий.
+// Проекции, построенные по старым данным, нужно перестроить.
+func (s *EventStore) ForgetCustomer(customerID string) (int, error) {
+	if err := s.keys.Forget(customerID); err != nil {
+		return 0, fmt.Errorf("ошибка при удалении ключа клиента: %w", err)
+	}
+
+	redacted, err := s.backend.Redact(customerID)
+	if err != nil {
+		return redacted, err
+	}
+	if err := s.snapshots.DeleteCustomer(customerID); err != nil {
+		return redacted, fmt.Errorf("ошибка при удалении снимков заказов клиента: %w", err)
+	}
+
+	log.Printf("Персональные данные клиента удалены, скрыто событий: %d", redacted)
+	return redacted, nil
+}
+
+// LastErasure возвращает время последнего удаления персональных данных клиента
+func (s *EventStore) LastErasure() time.Time {
+	return s.keys.LastErasure()
+}
+
+// TakeSnapshot сохраняет снимок текущего состояния заказа
+func (s *EventStore) TakeSnapshot(orderID OrderID) (OrderSnapshot, error) {
+	state, version := s.LoadOrderState(orderID)
+	if state == nil {
+		return OrderSnapshot{}, ErrOrderNotFound
+	}
+
+	snapshot := OrderSnapshot{
+		SchemaVersion: orderStateSchemaVersion,
+		Version:       version,
+		State:         *state,
+	}
+	if err := s.snapshots.Save(snapshot); err != nil {
+		return OrderSnapshot{}, err
+	}
+
+	log.Printf("Снимок заказа #%s сохранен на версии %d", orderID, version)
+	return snapshot, nil
+}
+
+// maybeSnapshot делает снимок заказа каждые snapshotEvery событий
+func (s *EventStore) maybeSnapshot(orderID OrderID) {
+	if s.snapshotEvery <= 0 {
+		return
+	}
+
+	snapshotVersion := 0
+	if snapshot, found := s.snapshots.Get(orderID); found {
+		snapshotVersion = snapshot.Version
+	}
+	if s.backend.StreamVersion(orderID)-snapshotVersion < s.snapshotEvery {
+		return
+	}
+
+	if _, err := s.TakeSnapshot(orderID); err != nil {
+		log.Printf("Ошибка при создании снимка заказа #%s: %v", orderID, err)
+	}
+}
+
 // GetEventsForOrder возвращает все события для указанного заказа
-func (s *EventStore) GetEventsForOrder(orderID int) []Event {
-	return s.queue.GetByOrderID(orderID)
+func (s *EventStore) GetEventsForOrder(orderID OrderID) []Event {
+	events, _ := s.backend.ReadStream(orderID, 0)
+	return events
+}
+
+// GetStream возвращает события заказа и текущую версию его потока
+func (s *EventStore) GetStream(orderID OrderID) ([]Event, int) {
+	return s.backend.ReadStream(orderID, 0)
 }
 
 // GetAllEvents возвращает все события
 func (s *EventStore) GetAllEvents() []Event {
-	return s.queue.GetAll()
+	records, _, _ := s.backend.ReadAll(EventQuery{})
+	events := make([]Event, 0, len(records))
+	for _, record := range records {
+		events = append(events, record.Event)
+	}
+	return events
+}
+
+// ReadEvents возвращает события лога по курсору и фильтрам,
+// позицию, до которой лог просмотрен, и признак наличия следующих событий
+func (s *EventStore) ReadEvents(query EventQuery) ([]RecordedEvent, int64, bool) {
+	return s.backend.ReadAll(query)
+}
+
+// Changed возвращает канал, который закроется при записи новых событий
+func (s *EventStore) Changed() <-chan struct{} {
+	return s.backend.Changed()
+}
+
+// EncodeRecorded сериализует записанное событие в DTO
+func (s *EventStore) EncodeRecorded(record RecordedEvent) (EventDTO, error) {
+	return s.backend.EncodeRecorded(record)
+}
+
+// Subscriptions возвращает состояние подписчиков для мониторинга
+func (s *EventStore) Subscriptions() []SubscriptionStats {
+	return s.backend.Subscriptions()
+}
+
+// Subscribe подписывает обработчик на события с позицией больше after
+func (s *EventStore) Subscribe(name string, after int64, options SubscriptionOptions, handler func(record RecordedEvent)) *Subscription {
+	return s.backend.Subscribe(name, after, options, handler)
+}
+
+// LastPosition возвращает глобальную позицию последнего записанного события
+func (s *EventStore) LastPosition() int64 {
+	return s.backend.LastPosition()
 }
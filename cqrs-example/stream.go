@@ -0,0 +1,184 @@
+// stream.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	streamBatchSize    = 100              // Сколько событий читать из лога за раз
+	streamWriteTimeout = 10 * time.Second // Таймаут записи клиенту WebSocket
+)
+
+// EventStreamer отдает события лога внешним клиентам: сначала историю с заданной позиции,
+// затем новые события по мере записи
+type EventStreamer struct {
+	store     *EventStore        // Хранилище событий
+	heartbeat time.Duration      // Период heartbeat-сообщений
+	upgrader  websocket.Upgrader // Параметры WebSocket соединений
+}
+
+// NewEventStreamer создает раздатчик событий
+func NewEventStreamer(store *EventStore, heartbeat time.Duration) *EventStreamer {
+	return &EventStreamer{
+		store:     store,
+		heartbeat: heartbeat,
+		upgrader: websocket.Upgrader{
+			// Пример открыт для любых источников, как и остальные эндпоинты
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// StreamMessage сообщение потока событий WebSocket
+type StreamMessage struct {
+	Kind     string    `json:"kind"`            // event или heartbeat
+	Position int64     `json:"position"`        // Позиция, до которой поток прочитан
+	Event    *EventDTO `json:"event,omitempty"` // Событие (для kind=event)
+}
+
+// follow читает события с позиции query.After и передает их в send, а при отсутствии
+// новых событий ждет записи в лог, раз в период heartbeat вызывая heartbeat
+func (s *EventStreamer) follow(ctx context.Context, query EventQuery,
+	send func(dto EventDTO) error, heartbeat func(position int64) error) error {
+	query.Limit = streamBatchSize
+
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		// Канал ожидания берем до чтения, чтобы не пропустить запись между ними
+		changed := s.store.Changed()
+
+		events, next, hasMore := s.store.ReadEvents(query)
+		for _, record := range events {
+			dto, err := s.store.EncodeRecorded(record)
+			if err != nil {
+				return err
+			}
+			if err := send(dto); err != nil {
+				return err
+			}
+		}
+		query.After = next
+		if hasMore {
+			continue
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if err := heartbeat(query.After); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ServeSSE отдает поток событий в формате Server-Sent Events.
+// Позицию для продолжения можно передать параметром after или заголовком Last-Event-ID.
+func (s *EventStreamer) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	query, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		query.After, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "Некорректный Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Потоковая передача не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	send := func(dto EventDTO) error {
+		data, err := json.Marshal(dto)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", dto.Position, dto.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	heartbeat := func(position int64) error {
+		if _, err := fmt.Fprintf(w, ": heartbeat %d\n\n", position); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := s.follow(r.Context(), query, send, heartbeat); err != nil {
+		log.Printf("Поток SSE прерван: %v", err)
+	}
+}
+
+// ServeWebSocket отдает поток событий через WebSocket в виде JSON сообщений StreamMessage
+func (s *EventStreamer) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	query, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade уже отправил клиенту ответ с ошибкой
+		log.Printf("Ошибка при открытии WebSocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Читаем входящие кадры, чтобы обрабатывать ping/close и заметить отключение клиента
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(message StreamMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(message)
+	}
+	send := func(dto EventDTO) error {
+		return write(StreamMessage{Kind: "event", Position: dto.Position, Event: &dto})
+	}
+	heartbeat := func(position int64) error {
+		return write(StreamMessage{Kind: "heartbeat", Position: position})
+	}
+
+	if err := s.follow(ctx, query, send, heartbeat); err != nil {
+		log.Printf("Поток WebSocket прерван: %v", err)
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
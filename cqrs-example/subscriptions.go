@@ -0,0 +1,226 @@
+// subscriptions.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// OverflowPolicy определяет, что делать, когда буфер подписчика заполнен
+type OverflowPolicy string
+
+const (
+	OverflowBlock      OverflowPolicy = "block"      // Запись событий ждет, пока подписчик освободит буфер
+	OverflowDrop       OverflowPolicy = "drop"       // Событие отбрасывается, подписчик помечается для перестроения
+	OverflowDisconnect OverflowPolicy = "disconnect" // Подписчик отключается
+)
+
+// ParseOverflowPolicy разбирает политику переполнения из строки
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(value); policy {
+	case OverflowBlock, OverflowDrop, OverflowDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("неизвестная политика переполнения: %q (ожидается block, drop или disconnect)", value)
+}
+
+// SubscriptionOptions настройки доставки событий подписчику
+type SubscriptionOptions struct {
+	BufferSize int            // Размер буфера событий
+	Overflow   OverflowPolicy // Политика при переполнении буфера
+	// Rebuild перестраивает состояние подписчика после потери событий (политика drop)
+	// и возвращает позицию, до которой состояние актуально. Без Rebuild политика drop
+	// заменяется на disconnect.
+	Rebuild func() int64
+}
+
+// Subscription подписка на события очереди с собственным упорядоченным буфером
+type Subscription struct {
+	name        string
+	options     SubscriptionOptions
+	handler     func(record RecordedEvent)
+	queue       *EventQueue
+	events      chan RecordedEvent // Буфер доставки
+	replayUntil int64              // Позиция, до которой события берутся из лога, а не из буфера
+
+	delivered    atomic.Int64 // Позиция последнего обработанного события
+	dropped      atomic.Int64 // Количество отброшенных событий
+	needsRebuild atomic.Bool  // Подписчик пропустил события и должен перестроиться
+	disconnected atomic.Bool  // Подписчик отключен из-за переполнения
+	done         chan struct{}
+}
+
+// SubscriptionStats состояние подписчика для мониторинга
+type SubscriptionStats struct {
+	Name              string         `json:"name"`
+	Overflow          OverflowPolicy `json:"overflow"`
+	BufferSize        int            `json:"buffer_size"`
+	Buffered          int            `json:"buffered"`           // Событий в буфере
+	DeliveredPosition int64          `json:"delivered_position"` // Последнее обработанное событие
+	Lag               int64          `json:"lag"`                // Отставание от конца лога
+	Dropped           int64          `json:"dropped"`            // Отброшено событий
+	NeedsRebuild      bool           `json:"needs_rebuild"`
+	Disconnected      bool           `json:"disconnected"`
+}
+
+// Subscribe подписывает обработчик на события с позицией больше after.
+// События с позиции after до текущего конца лога читаются из лога, новые -
+// доставляются через буфер подписки. Обработчик вызывается последовательно в порядке позиций.
+func (q *EventQueue) Subscribe(name string, after int64, options SubscriptionOptions, handler func(record RecordedEvent)) *Subscription {
+	if options.BufferSize <= 0 {
+		options.BufferSize = 1
+	}
+	if options.Overflow == "" {
+		options.Overflow = OverflowBlock
+	}
+	// Без Rebuild подписчик не узнал бы об отброшенных событиях: вместо тихой потери отключаем его
+	if options.Overflow == OverflowDrop && options.Rebuild == nil {
+		log.Printf("Подписчик %s не умеет перестраиваться, вместо политики drop используется disconnect", name)
+		options.Overflow = OverflowDisconnect
+	}
+
+	sub := &Subscription{
+		name:    name,
+		options: options,
+		handler: handler,
+		queue:   q,
+		events:  make(chan RecordedEvent, options.BufferSize),
+		done:    make(chan struct{}),
+	}
+	sub.delivered.Store(after)
+
+	q.mu.Lock()
+	sub.replayUntil = int64(len(q.events))
+	q.subscribers = append(q.subscribers, sub)
+	q.mu.Unlock()
+
+	go sub.run()
+	return sub
+}
+
+// Subscriptions возвращает состояние всех подписчиков
+func (q *EventQueue) Subscriptions() []SubscriptionStats {
+	q.mu.RLock()
+	subscribers := append([]*Subscription(nil), q.subscribers...)
+	lastPosition := int64(len(q.events))
+	q.mu.RUnlock()
+
+	stats := make([]SubscriptionStats, 0, len(subscribers))
+	for _, sub := range subscribers {
+		delivered := sub.delivered.Load()
+		stats = append(stats, SubscriptionStats{
+			Name:              sub.name,
+			Overflow:          sub.options.Overflow,
+			BufferSize:        sub.options.BufferSize,
+			Buffered:          len(sub.events),
+			DeliveredPosition: delivered,
+			Lag:               max(lastPosition-delivered, 0),
+			Dropped:           sub.dropped.Load(),
+			NeedsRebuild:      sub.needsRebuild.Load(),
+			Disconnected:      sub.disconnected.Load(),
+		})
+	}
+	return stats
+}
+
+// offer передает событие в буфер подписчика с учетом политики переполнения.
+// Вызывается только писателем очереди, поэтому события поступают по порядку.
+func (s *Subscription) offer(record RecordedEvent) {
+	if s.disconnected.Load() {
+		return
+	}
+
+	switch s.options.Overflow {
+	case OverflowBlock:
+		s.events <- record
+	case OverflowDrop:
+		select {
+		case s.events <- record:
+		default:
+			s.dropped.Add(1)
+			if !s.needsRebuild.Swap(true) {
+				log.Printf("Буфер подписчика %s переполнен, события отбрасываются до перестроения", s.name)
+			}
+		}
+	case OverflowDisconnect:
+		select {
+		case s.events <- record:
+		default:
+			log.Printf("Буфер подписчика %s переполнен, подписчик отключен на позиции %d", s.name, s.delivered.Load())
+			s.disconnect()
+		}
+	}
+}
+
+// disconnect отключает подписчика; вызывается писателем очереди
+func (s *Subscription) disconnect() {
+	if s.disconnected.Swap(true) {
+		return
+	}
+	close(s.events)
+	s.queue.removeSubscription(s)
+}
+
+// stop завершает доставку после закрытия очереди
+func (s *Subscription) stop() {
+	if !s.disconnected.Swap(true) {
+		close(s.events)
+	}
+	<-s.done
+}
+
+// run доставляет подписчику сначала события из лога, затем из буфера
+func (s *Subscription) run() {
+	defer close(s.done)
+
+	// Догоняем события, записанные до подписки
+	for s.delivered.Load() < s.replayUntil {
+		records, _, _ := s.queue.ReadAll(EventQuery{After: s.delivered.Load(), Limit: streamBatchSize})
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			if record.Position > s.replayUntil {
+				break
+			}
+			s.handle(record)
+		}
+	}
+
+	for record := range s.events {
+		// После потери событий перестраиваем состояние; события из буфера,
+		// вошедшие в перестроение, будут пропущены по позиции
+		if s.needsRebuild.Load() && s.options.Rebuild != nil {
+			s.needsRebuild.Store(false)
+			position := s.options.Rebuild()
+			if position > s.delivered.Load() {
+				s.delivered.Store(position)
+			}
+			log.Printf("Подписчик %s перестроен до позиции %d", s.name, position)
+		}
+		s.handle(record)
+	}
+}
+
+// handle вызывает обработчик, пропуская уже обработанные события
+func (s *Subscription) handle(record RecordedEvent) {
+	if record.Position <= s.delivered.Load() {
+		return
+	}
+	s.handler(record)
+	s.delivered.Store(record.Position)
+}
+
+// removeSubscription удаляет подписчика из очереди
+func (q *EventQueue) removeSubscription(sub *Subscription) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, existing := range q.subscribers {
+		if existing == sub {
+			q.subscribers = append(q.subscribers[:i:i], q.subscribers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// trusted_proxies.go
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies адреса прокси, которые проверяют пользователя и передают инициатора
+// команды в заголовках X-Actor-ID и X-Actor-Roles. От остальных клиентов эти заголовки
+// игнорируются: иначе любой клиент мог бы назначить себе роль admin.
+type TrustedProxies []netip.Prefix
+
+// ParseTrustedProxies разбирает список адресов и подсетей через запятую.
+// Пустой список или none - заголовкам инициатора не доверять.
+func ParseTrustedProxies(value string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	if value == "none" {
+		return proxies, nil
+	}
+	for _, item := range splitList(value) {
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("некорректная подсеть доверенного прокси %q: %v", item, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный адрес доверенного прокси %q: %v", item, err)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return proxies, nil
+}
+
+// Trusts проверяет, что запрос пришел напрямую от доверенного прокси
+func (p TrustedProxies) Trusts(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ActorMiddleware кладет в контекст запроса инициатора из заголовков, если запрос
+// пришел от доверенного прокси. Остальные запросы выполняются от анонимного инициатора.
+func (p TrustedProxies) ActorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.Trusts(r) {
+			r = r.WithContext(WithActor(r.Context(), actorFromHeaders(r)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,36 @@
+// upcasters.go
+package main
+
+import (
+	"encoding/json"
+)
+
+// upcastOrderCreatedV1 переводит OrderCreated из версии 1 в версию 2:
+// список названий товаров ([]string) заменяется позициями с количеством
+func upcastOrderCreatedV1(data json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if raw, ok := fields["Items"]; ok {
+		if err := json.Unmarshal(raw, &names); err != nil {
+			return nil, err
+		}
+	}
+
+	// Каждый товар версии 1 соответствует одной единице
+	items := make([]OrderItem, 0, len(names))
+	for _, name := range names {
+		items = append(items, OrderItem{Name: name, Quantity: 1})
+	}
+
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	fields["Items"] = raw
+
+	return json.Marshal(fields)
+}
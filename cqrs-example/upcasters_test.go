@@ -0,0 +1,100 @@
+// upcasters_test.go
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestUpcastOrderCreatedV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		items   []OrderItem
+		wantErr bool
+	}{
+		{
+			name:  "каждое название - одна единица товара",
+			data:  `{"CustomerID":"user123","Items":["книга","ручка"]}`,
+			items: []OrderItem{{Name: "книга", Quantity: 1}, {Name: "ручка", Quantity: 1}},
+		},
+		{
+			name:  "повторяющиеся названия не объединяются",
+			data:  `{"CustomerID":"user123","Items":["книга","книга"]}`,
+			items: []OrderItem{{Name: "книга", Quantity: 1}, {Name: "книга", Quantity: 1}},
+		},
+		{
+			name:  "пустой список",
+			data:  `{"CustomerID":"user123","Items":[]}`,
+			items: []OrderItem{},
+		},
+		{
+			name:  "без товаров",
+			data:  `{"CustomerID":"user123"}`,
+			items: []OrderItem{},
+		},
+		{
+			name:    "товары уже в формате версии 2",
+			data:    `{"CustomerID":"user123","Items":[{"Name":"книга","Quantity":2}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "не объект",
+			data:    `["книга"]`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := upcastOrderCreatedV1(json.RawMessage(test.data))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ожидалась ошибка, получено %s", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var event struct {
+				CustomerID string
+				Items      []OrderItem
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.CustomerID != "user123" {
+				t.Fatalf("остальные поля изменились: %s", data)
+			}
+			if !reflect.DeepEqual(event.Items, test.items) {
+				t.Fatalf("позиции %+v, ожидались %+v", event.Items, test.items)
+			}
+		})
+	}
+}
+
+func TestDecodeOrderCreatedV1(t *testing.T) {
+	// Записи без версии сделаны до версионирования и читаются как версия 1
+	for _, version := range []int{0, 1} {
+		event, err := eventRegistry.Decode(EventDTO{
+			Type:      "OrderCreated",
+			Version:   version,
+			OrderID:   "1",
+			Timestamp: "2024-01-01T00:00:00Z",
+			Data:      json.RawMessage(`{"CustomerID":"user123","Items":["книга"]}`),
+		})
+		if err != nil {
+			t.Fatalf("версия %d: %v", version, err)
+		}
+		created, ok := event.(OrderCreatedEvent)
+		if !ok {
+			t.Fatalf("версия %d: событие %T", version, event)
+		}
+		if want := []OrderItem{{Name: "книга", Quantity: 1}}; !reflect.DeepEqual(created.Items, want) {
+			t.Fatalf("версия %d: позиции %+v", version, created.Items)
+		}
+	}
+}